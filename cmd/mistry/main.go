@@ -20,10 +20,13 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
 	"os/user"
+	"path"
+	"strconv"
 	"strings"
 	"time"
 
@@ -36,6 +39,9 @@ var transports = make(map[types.TransportMethod]Transport)
 func init() {
 	transports[types.Scp] = Scp{}
 	transports[types.Rsync] = Rsync{}
+	transports[types.HTTP] = HTTP{}
+
+	rand.Seed(time.Now().UnixNano())
 }
 
 func main() {
@@ -55,6 +61,11 @@ func main() {
 		clearTarget   bool
 		rebuild       bool
 		timeout       string
+		buildTimeout  string
+		jobID         string
+		token         string
+		priority      int
+		env           cli.StringSlice
 	)
 
 	currentUser, err := user.Current()
@@ -85,6 +96,21 @@ EXAMPLES:
 		the no-wait flag.
 
 		$ {{.HelpName}} --host example.org --port 9090 --project yarn --no-wait
+
+	3. Cancel a queued or running job.
+
+		$ mistry cancel --host example.org --port 9090 --project yarn --id <job id>
+
+	4. Authenticate to a server that requires API tokens. The token may also be
+		provided using the MISTRY_TOKEN environment variable.
+
+		$ {{.HelpName}} --host example.org --project yarn --token <token>
+
+	5. Pass environment variables to the build container. Like parameters,
+		variables prepended with '_' are opaque and do not affect the build result.
+
+		$ {{.HelpName}} --host example.org --project yarn \
+			--env NODE_ENV=production --env _CACHE_BUST=1
 `, cli.CommandHelpTemplate)
 
 	app := cli.NewApp()
@@ -107,6 +133,12 @@ EXAMPLES:
 					Destination: &port,
 					Value:       "8462",
 				},
+				cli.StringFlag{
+					Name:        "token",
+					Usage:       "the API token to authenticate with, if the server requires one",
+					EnvVar:      "MISTRY_TOKEN",
+					Destination: &token,
+				},
 				cli.StringFlag{
 					Name:        "project",
 					Usage:       "job's project",
@@ -133,10 +165,25 @@ EXAMPLES:
 				},
 				cli.StringFlag{
 					Name:        "timeout",
-					Usage:       "time to wait for the build to finish, accepts values as defined at https://golang.org/pkg/time/#ParseDuration",
+					Usage:       "time to wait for the build to finish, including retries while the server is unavailable; accepts values as defined at https://golang.org/pkg/time/#ParseDuration",
 					Destination: &timeout,
 					Value:       "60m",
 				},
+				cli.StringFlag{
+					Name:        "build-timeout",
+					Usage:       "maximum duration of the build on the server, after which it is stopped (default: the server's default)",
+					Destination: &buildTimeout,
+				},
+				cli.StringSliceFlag{
+					Name:  "env, e",
+					Usage: "environment variable of the build container, in the form KEY=VALUE (may be repeated); variables prepended with '_' are opaque",
+					Value: &env,
+				},
+				cli.IntFlag{
+					Name:        "priority",
+					Usage:       fmt.Sprintf("priority of the build over other queued builds, between %d and %d", types.MinPriority, types.MaxPriority),
+					Destination: &priority,
+				},
 
 				// transport flags
 				cli.BoolFlag{
@@ -146,7 +193,7 @@ EXAMPLES:
 				},
 				cli.StringFlag{
 					Name:        "transport",
-					Usage:       "the method to use for fetching artifacts",
+					Usage:       "the method to use for fetching artifacts (scp, rsync or http)",
 					Destination: &transport,
 					Value:       types.Scp,
 				},
@@ -182,6 +229,9 @@ EXAMPLES:
 				if !noWait && transport == "" {
 					return errors.New("you need to either specify a transport or use the async flag")
 				}
+				if priority < types.MinPriority || priority > types.MaxPriority {
+					return fmt.Errorf("priority must be between %d and %d", types.MinPriority, types.MaxPriority)
+				}
 
 				var (
 					clientTimeout time.Duration
@@ -194,6 +244,14 @@ EXAMPLES:
 					}
 				}
 
+				var serverTimeout time.Duration
+				if buildTimeout != "" {
+					serverTimeout, err = time.ParseDuration(buildTimeout)
+					if err != nil {
+						return err
+					}
+				}
+
 				if jsonResult {
 					verbose = false
 				}
@@ -207,6 +265,14 @@ EXAMPLES:
 				if !tsExists {
 					return fmt.Errorf("invalid transport argument (%v)", transport)
 				}
+				if _, ok := ts.(HTTP); ok {
+					ts = HTTP{Token: token}
+				}
+
+				envVars, err := parseEnv(env)
+				if err != nil {
+					return err
+				}
 
 				params := parseDynamicArgs(c.Args())
 
@@ -255,7 +321,8 @@ EXAMPLES:
 					url += "?async"
 				}
 
-				jr := types.JobRequest{Project: project, Group: group, Params: params, Rebuild: rebuild}
+				jr := types.JobRequest{Project: project, Group: group, Params: params, Env: envVars,
+					Rebuild: rebuild, Timeout: serverTimeout, Priority: priority}
 				jrJSON, err := json.Marshal(jr)
 				if err != nil {
 					return err
@@ -265,7 +332,7 @@ EXAMPLES:
 					fmt.Printf("Scheduling %#v...\n", jr)
 				}
 
-				body, err := sendRequest(url, jrJSON, verbose, clientTimeout)
+				body, err := sendRequest(url, jrJSON, token, verbose, clientTimeout)
 				if err != nil {
 					if isTimeout(err) {
 						return fmt.Errorf("The build did not finish after %s, %s", clientTimeout, err)
@@ -274,8 +341,18 @@ EXAMPLES:
 				}
 
 				if noWait {
+					st := types.JobStatus{}
+					err = json.Unmarshal(body, &st)
+					if err != nil {
+						return err
+					}
+
+					if jsonResult {
+						fmt.Printf("%s\n", body)
+					}
 					if verbose {
-						fmt.Println("Build scheduled successfully")
+						fmt.Println("Build scheduled successfully with job ID", st.ID)
+						fmt.Println("Logs can be found at", baseURL+"/"+st.URL)
 					}
 					return nil
 				}
@@ -287,14 +364,24 @@ EXAMPLES:
 					return err
 				}
 
+				// builds performed by remote agents of the server are
+				// fetched from the agents themselves
+				if bi.AgentURL != "" {
+					host, err = urlHostname(bi.AgentURL)
+					if err != nil {
+						return fmt.Errorf("Invalid agent URL '%s': %s", bi.AgentURL, err)
+					}
+					baseURL = strings.TrimSuffix(bi.AgentURL, "/")
+				}
+
 				if !jsonResult {
 					fmt.Println("Logs can be found at", baseURL+"/"+bi.URL)
 				}
 
 				if verbose {
 					fmt.Printf(
-						"\nResult:\nStarted at: %s ExitCode: %v Params: %s Cached: %v Coalesced: %v\n\nLogs:\n%s\n",
-						bi.StartedAt, bi.ExitCode, bi.Params, bi.Cached, bi.Coalesced, bi.ContainerStdouterr)
+						"\nResult:\nStarted at: %s ExitCode: %v Params: %s Cached: %v Coalesced: %v Attempts: %d\n\nLogs:\n%s\n",
+						bi.StartedAt, bi.ExitCode, bi.Params, bi.Cached, bi.Coalesced, bi.Attempts, bi.ContainerStdouterr)
 				}
 
 				if jsonResult {
@@ -307,13 +394,21 @@ EXAMPLES:
 					} else {
 						fmt.Fprintln(os.Stderr, "There are no container error logs.")
 					}
+					if bi.OOMKilled {
+						return fmt.Errorf("Build failed with exit code %d; the build ran out of memory", bi.ExitCode)
+					}
 					return fmt.Errorf("Build failed with exit code %d", bi.ExitCode)
 				}
 
 				if verbose {
 					fmt.Println("Copying artifacts to", target, "...")
 				}
-				out, err := ts.Copy(transportUser, host, project, bi.Path+"/*", target, clearTarget)
+				src := bi.Path + "/*"
+				if types.TransportMethod(transport) == types.HTTP {
+					// bi.URL is in the form of job/{project}/{id}
+					src = fmt.Sprintf("%s/%s/%s/%s/artifacts", baseURL, JobsPath, project, path.Base(bi.URL))
+				}
+				out, err := ts.Copy(transportUser, host, project, src, target, clearTarget)
 				fmt.Println(out)
 				if err != nil {
 					return err
@@ -325,6 +420,66 @@ EXAMPLES:
 				return nil
 			},
 		},
+		{
+			Name:  "cancel",
+			Usage: "Cancel a queued or running job.",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "host",
+					Usage:       "host to connect to",
+					Destination: &host,
+					Value:       "0.0.0.0",
+				},
+				cli.StringFlag{
+					Name:        "port, p",
+					Usage:       "port to connect to",
+					Destination: &port,
+					Value:       "8462",
+				},
+				cli.StringFlag{
+					Name:        "token",
+					Usage:       "the API token to authenticate with, if the server requires one",
+					EnvVar:      "MISTRY_TOKEN",
+					Destination: &token,
+				},
+				cli.StringFlag{
+					Name:        "project",
+					Usage:       "job's project",
+					Destination: &project,
+				},
+				cli.StringFlag{
+					Name:        "id",
+					Usage:       "the ID of the job to cancel",
+					Destination: &jobID,
+				},
+				cli.BoolFlag{
+					Name:        "verbose, v",
+					Destination: &verbose,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if host == "" {
+					return errors.New("host cannot be empty")
+				}
+				if project == "" {
+					return errors.New("project cannot be empty")
+				}
+				if jobID == "" {
+					return errors.New("id cannot be empty")
+				}
+
+				url := fmt.Sprintf("http://%s:%s/%s/%s/%s", host, port, JobsPath, project, jobID)
+				err := sendCancelRequest(url, token, verbose)
+				if err != nil {
+					return err
+				}
+
+				if verbose {
+					fmt.Println("Job cancelled successfully")
+				}
+				return nil
+			},
+		},
 	}
 
 	err = app.Run(os.Args)
@@ -334,28 +489,136 @@ EXAMPLES:
 	}
 }
 
-func sendRequest(url string, reqBody []byte, verbose bool, timeout time.Duration) ([]byte, error) {
-	client := &http.Client{Timeout: timeout}
-	resp, err := client.Post(url, "application/json", bytes.NewBuffer(reqBody))
+const (
+	// retryBaseDelay is the delay before the first retry of a request that
+	// was rejected because the server was unavailable; it's doubled on
+	// every retry, up to retryMaxDelay
+	retryBaseDelay = 1 * time.Second
+	retryMaxDelay  = 1 * time.Minute
+)
+
+// sendRequest schedules a build. If the server is unavailable (ie. overloaded
+// or drained), the request is retried with exponential backoff, honouring
+// any Retry-After delay suggested by the server, until timeout elapses. Zero
+// means no timeout.
+func sendRequest(url string, reqBody []byte, token string, verbose bool, timeout time.Duration) ([]byte, error) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest("POST", url, bytes.NewBuffer(reqBody))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		setToken(req, token)
+
+		client := &http.Client{}
+		if !deadline.IsZero() {
+			client.Timeout = time.Until(deadline)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		respBody, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		if verbose {
+			fmt.Printf("Server response: %#v\n", resp)
+		}
+
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			delay := retryDelay(attempt, resp.Header.Get("Retry-After"))
+			if !deadline.IsZero() && time.Now().Add(delay).After(deadline) {
+				return nil, fmt.Errorf("(error: %d) Server is unavailable; try again later: %s",
+					resp.StatusCode, bytes.TrimSpace(respBody))
+			}
+			if verbose {
+				fmt.Printf("Server is unavailable; retrying in %s...\n", delay)
+			}
+			time.Sleep(delay)
+			continue
+		} else if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			return nil, fmt.Errorf("(error: %d) Not authorized to schedule build: %s", resp.StatusCode, respBody)
+		} else if resp.StatusCode != http.StatusCreated {
+			return nil, fmt.Errorf("(error: %d) Error scheduling build: %s", resp.StatusCode, respBody)
+		}
+
+		return respBody, nil
+	}
+}
+
+// retryDelay returns how long to wait before retrying a request that was
+// rejected attempt+1 times. The delay grows exponentially, but is never less
+// than retryAfter, the value of the Retry-After header in seconds, if any. Up
+// to 50% of random jitter is added, so that rejected clients don't retry in
+// lockstep.
+func retryDelay(attempt int, retryAfter string) time.Duration {
+	delay := retryMaxDelay
+	if attempt < 6 {
+		delay = retryBaseDelay << uint(attempt)
+	}
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+
+	secs, err := strconv.Atoi(retryAfter)
+	if err == nil && time.Duration(secs)*time.Second > delay {
+		delay = time.Duration(secs) * time.Second
+	}
+
+	return delay + time.Duration(rand.Int63n(int64(delay)/2+1))
+}
+
+func sendCancelRequest(url, token string, verbose bool) error {
+	req, err := http.NewRequest("DELETE", url, nil)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	setToken(req, token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
 	respBody, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	if verbose {
 		fmt.Printf("Server response: %#v\n", resp)
 	}
 
-	if resp.StatusCode == http.StatusServiceUnavailable {
-		return nil, fmt.Errorf("(error: %d) Server is overloaded; try again later", resp.StatusCode)
-	} else if resp.StatusCode != http.StatusCreated {
-		return nil, fmt.Errorf("(error: %d) Error scheduling build: %s", resp.StatusCode, respBody)
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("(error: %d) Job is not queued or running", resp.StatusCode)
+	} else if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("(error: %d) Error cancelling job: %s", resp.StatusCode, respBody)
 	}
 
-	return respBody, nil
+	return nil
+}
+
+// setToken authenticates req with token, unless it's empty.
+func setToken(req *http.Request, token string) {
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+// urlHostname returns the hostname of the given URL.
+func urlHostname(rawurl string) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+	return u.Hostname(), nil
 }
 
 func isTimeout(err error) bool {
@@ -363,6 +626,23 @@ func isTimeout(err error) bool {
 	return ok && urlErr.Timeout()
 }
 
+// parseEnv parses environment variables given in the form KEY=VALUE.
+func parseEnv(vars []string) (map[string]string, error) {
+	if len(vars) == 0 {
+		return nil, nil
+	}
+
+	env := make(map[string]string)
+	for _, v := range vars {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid environment variable '%s', expected KEY=VALUE", v)
+		}
+		env[parts[0]] = parts[1]
+	}
+	return env, nil
+}
+
 func parseDynamicArgs(args cli.Args) map[string]string {
 	parsed := make(map[string]string)
 
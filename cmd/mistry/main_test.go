@@ -1,8 +1,11 @@
 package main
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/urfave/cli"
 )
@@ -42,3 +45,110 @@ func TestParseDynamicArgs(t *testing.T) {
 		}
 	}
 }
+
+func TestParseEnv(t *testing.T) {
+	env, err := parseEnv([]string{"A=b", "C=d=e", "_F="})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"A": "b", "C": "d=e", "_F": ""}
+	if !reflect.DeepEqual(env, expected) {
+		t.Errorf("expected %v, got %v", expected, env)
+	}
+
+	for _, v := range []string{"A", "=b"} {
+		_, err = parseEnv([]string{v})
+		if err == nil {
+			t.Errorf("expected error for '%s'", v)
+		}
+	}
+}
+
+func TestSendCancelRequest(t *testing.T) {
+	var method, path, auth string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path, auth = r.Method, r.URL.Path, r.Header.Get("Authorization")
+		if path == "/jobs/foo/unknown" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+
+	err := sendCancelRequest(ts.URL+"/jobs/foo/abc", "s3cr3t", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if method != "DELETE" || path != "/jobs/foo/abc" {
+		t.Errorf("expected DELETE /jobs/foo/abc, got %s %s", method, path)
+	}
+	if auth != "Bearer s3cr3t" {
+		t.Errorf("expected Authorization header 'Bearer s3cr3t', got '%s'", auth)
+	}
+
+	err = sendCancelRequest(ts.URL+"/jobs/foo/unknown", "", false)
+	if err == nil {
+		t.Error("expected error for unknown job")
+	}
+}
+
+func TestSendRequestRetries(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("{}"))
+	}))
+	defer ts.Close()
+
+	body, err := sendRequest(ts.URL, []byte("{}"), "", false, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests != 2 || string(body) != "{}" {
+		t.Errorf("expected a retry to succeed, got %d requests and body '%s'", requests, body)
+	}
+
+	// the server asks for a delay longer than the timeout
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	start := time.Now()
+	_, err = sendRequest(ts.URL, []byte("{}"), "", false, 10*time.Second)
+	if err == nil {
+		t.Error("expected error from overloaded server")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("expected to give up without waiting, waited %s", time.Since(start))
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempt    int
+		retryAfter string
+		min        time.Duration
+	}{
+		{0, "", retryBaseDelay},
+		{3, "", 8 * retryBaseDelay},
+		{100, "", retryMaxDelay},
+		{0, "20", 20 * time.Second},
+		{0, "invalid", retryBaseDelay},
+	}
+
+	for _, test := range tests {
+		d := retryDelay(test.attempt, test.retryAfter)
+		if d < test.min || d > test.min*3/2 {
+			t.Errorf("retryDelay(%d, %q): expected between %s and %s, got %s",
+				test.attempt, test.retryAfter, test.min, test.min*3/2, d)
+		}
+	}
+}
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"compress/gzip"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/skroutz/mistry/pkg/utils"
 )
 
@@ -81,3 +85,148 @@ func (ts Rsync) Copy(user, host, project, src, dst string, clearDst bool) (strin
 
 	return utils.RunCmd(cmd)
 }
+
+// HTTP downloads the build artifacts as a tar archive from the artifacts
+// endpoint of the server. It needs no SSH accounts or rsync daemon on the
+// server.
+type HTTP struct {
+	// Token is the API token to authenticate with, if the server requires
+	// one
+	Token string
+}
+
+// httpMaxAttempts is the number of times a download is attempted before
+// giving up. Each attempt resumes from where the previous one stopped.
+const httpMaxAttempts = 5
+
+// Copy downloads the artifacts archive from the URL denoted by src and
+// extracts it to dst. Interrupted downloads are resumed using Range requests.
+// user, host and project are ignored. If clearDst is set, all contents of
+// dst will be removed before extracting the archive.
+func (ts HTTP) Copy(user, host, project, src, dst string, clearDst bool) (string, error) {
+	f, err := ioutil.TempFile("", "mistry-artifacts")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	dl := &archiveDownload{url: src, token: ts.Token, f: f}
+	done := false
+	for i := 0; i < httpMaxAttempts && !done; i++ {
+		done, err = dl.resume()
+	}
+	if !done {
+		return "", fmt.Errorf("could not download artifacts after %d attempts; %s", httpMaxAttempts, err)
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+
+	var r io.Reader = f
+	switch dl.encoding {
+	case "gzip":
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			return "", err
+		}
+		defer gr.Close()
+		r = gr
+	case "zstd":
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			return "", err
+		}
+		defer zr.Close()
+		r = zr
+	case "":
+	default:
+		return "", fmt.Errorf("unsupported content encoding '%s'", dl.encoding)
+	}
+
+	if clearDst {
+		err = removeDirContents(dst)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = utils.ExtractArchive(r, dst)
+	if err != nil {
+		return "", fmt.Errorf("could not extract artifacts; %s", err)
+	}
+	return "", nil
+}
+
+// archiveDownload is a download of an artifacts archive to a local file,
+// that can be resumed if interrupted.
+type archiveDownload struct {
+	url   string
+	token string
+	f     *os.File
+
+	// populated from the response that started the download
+	encoding string
+	etag     string
+}
+
+// resume downloads the archive, appending to the local file. If the file is
+// not empty, only the remaining bytes are requested, provided that the
+// archive on the server didn't change in the meantime. It returns true if
+// the download is complete.
+func (d *archiveDownload) resume() (bool, error) {
+	offset, err := d.f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequest("GET", d.url, nil)
+	if err != nil {
+		return false, err
+	}
+	// setting Accept-Encoding ourselves prevents net/http from
+	// transparently decompressing the response, which would break resuming
+	req.Header.Set("Accept-Encoding", "zstd, gzip")
+	setToken(req, d.token)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", d.etag)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// either a fresh download or the archive changed in the meantime,
+		// in which case we have to start over
+		err = d.f.Truncate(0)
+		if err != nil {
+			return false, err
+		}
+		_, err = d.f.Seek(0, io.SeekStart)
+		if err != nil {
+			return false, err
+		}
+		d.encoding = resp.Header.Get("Content-Encoding")
+		d.etag = resp.Header.Get("ETag")
+	case http.StatusPartialContent:
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the previous attempt got the whole archive
+		return true, nil
+	default:
+		body, _ := ioutil.ReadAll(resp.Body)
+		return false, fmt.Errorf("(error: %d) %s", resp.StatusCode, body)
+	}
+
+	_, err = io.Copy(d.f, resp.Body)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
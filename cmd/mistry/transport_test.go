@@ -0,0 +1,192 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/skroutz/mistry/pkg/utils"
+)
+
+func TestHTTPCopyResume(t *testing.T) {
+	src, err := ioutil.TempDir("", "mistry-http-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "mistry-http-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	err = os.MkdirAll(filepath.Join(src, "dir"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(src, "dir", "out.txt"), bytes.Repeat([]byte("foo"), 1000), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	err = utils.ArchiveDir(src, gw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = gw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := buf.Bytes()
+
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("ETag", `"foo"`)
+
+		// interrupt the first download halfway
+		if requests == 1 {
+			w.Header().Set("Content-Length", strconv.Itoa(len(archive)))
+			w.WriteHeader(http.StatusOK)
+			w.Write(archive[:len(archive)/2])
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(archive))
+	}))
+	defer ts.Close()
+
+	_, err = HTTP{}.Copy("", "", "", ts.URL, dst, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := ioutil.ReadFile(filepath.Join(dst, "dir", "out.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, bytes.Repeat([]byte("foo"), 1000)) {
+		t.Errorf("unexpected extracted file contents: %s", out)
+	}
+	if requests != 2 {
+		t.Errorf("expected the download to be resumed once, got %d requests", requests)
+	}
+}
+
+func TestHTTPCopyMaliciousSymlinks(t *testing.T) {
+	cases := []struct {
+		name    string
+		entries []tar.Header
+	}{
+		{"absolute symlink", []tar.Header{
+			{Name: "x", Typeflag: tar.TypeSymlink, Linkname: "<outside>"},
+			{Name: "x/.bashrc", Typeflag: tar.TypeReg, Mode: 0644, Size: 4},
+		}},
+		{"relative symlink", []tar.Header{
+			{Name: "x", Typeflag: tar.TypeSymlink, Linkname: "../outside"},
+		}},
+		{"symlink through symlink", []tar.Header{
+			{Name: "d/b", Typeflag: tar.TypeSymlink, Linkname: "../c"},
+			{Name: "d/a", Typeflag: tar.TypeSymlink, Linkname: "b/../.."},
+		}},
+		{"entry under symlink", []tar.Header{
+			{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "x", Typeflag: tar.TypeSymlink, Linkname: "dir"},
+			{Name: "x/.bashrc", Typeflag: tar.TypeReg, Mode: 0644, Size: 4},
+		}},
+	}
+
+	for _, c := range cases {
+		outside, err := ioutil.TempDir("", "mistry-http-outside")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(outside)
+		dst, err := ioutil.TempDir("", "mistry-http-dst")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dst)
+
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, hdr := range c.entries {
+			if hdr.Linkname == "<outside>" {
+				hdr.Linkname = outside
+			}
+			err = tw.WriteHeader(&hdr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hdr.Typeflag == tar.TypeReg {
+				_, err = tw.Write([]byte("evil"))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		err = tw.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(buf.Bytes()))
+		}))
+
+		_, err = HTTP{}.Copy("", "", "", ts.URL, dst, false)
+		ts.Close()
+		if err == nil {
+			t.Errorf("%s: expected error", c.name)
+		}
+
+		_, err = os.Stat(filepath.Join(outside, ".bashrc"))
+		if !os.IsNotExist(err) {
+			t.Errorf("%s: expected no file to be written outside of the target", c.name)
+		}
+	}
+	// symlinks within the target are preserved
+	dst, err := ioutil.TempDir("", "mistry-http-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []tar.Header{
+		{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "dir/link", Typeflag: tar.TypeSymlink, Linkname: "../out.txt"},
+	} {
+		err = tw.WriteHeader(&hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = utils.ExtractArchive(&buf, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := os.Readlink(filepath.Join(dst, "dir", "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "../out.txt" {
+		t.Errorf("expected link to '../out.txt', got '%s'", target)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// HandlePool reports the size of the worker pool (GET), or resizes it (PUT).
+// The body of PUT requests is a PoolSize; omitted or zero fields are left
+// unchanged. It requires the admin role on all projects.
+func (s *Server) HandlePool(w http.ResponseWriter, r *http.Request) {
+	_, ok := s.authorize(w, r, AllProjects, RoleAdmin)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error reading request body: %s", err), http.StatusBadRequest)
+			return
+		}
+		r.Body.Close()
+
+		var req PoolSize
+		err = json.Unmarshal(body, &req)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error unmarshalling body '%s' to pool size: %s", body, err),
+				http.StatusBadRequest)
+			return
+		}
+
+		size := s.workerPool.Size()
+		if req.Concurrency != 0 {
+			size.Concurrency = req.Concurrency
+		}
+		if req.Backlog != 0 {
+			size.Backlog = req.Backlog
+		}
+
+		err = s.workerPool.Resize(size.Concurrency, size.Backlog)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Cannot resize worker pool: %s", err), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Expected GET or PUT, got "+r.Method, http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp, err := json.Marshal(s.workerPool.Size())
+	if err != nil {
+		s.Log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(resp)
+	if err != nil {
+		s.Log.Printf("Error writing pool size response: %s", err)
+	}
+}
+
+// DrainRequest is the body of requests that drain a project or the whole
+// server.
+type DrainRequest struct {
+	// Project is the project to drain. If empty, the whole server is
+	// drained.
+	Project string `json:"project"`
+	Reason  string `json:"reason"`
+
+	// Duration is how long the drain is expected to last, if known
+	Duration Duration `json:"duration"`
+}
+
+// HandleDrain reports the drains of the server (GET), drains a project or the
+// whole server (PUT, with a DrainRequest body), or lifts a drain (DELETE,
+// with the project in the query string). Draining or undraining a project
+// requires the admin role on it; the rest require the admin role on all
+// projects.
+func (s *Server) HandleDrain(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		_, ok := s.authorize(w, r, AllProjects, RoleAdmin)
+		if !ok {
+			return
+		}
+	case "PUT":
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error reading request body: %s", err), http.StatusBadRequest)
+			return
+		}
+		r.Body.Close()
+
+		var req DrainRequest
+		err = json.Unmarshal(body, &req)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error unmarshalling body '%s' to drain request: %s", body, err),
+				http.StatusBadRequest)
+			return
+		}
+
+		_, ok := s.authorize(w, r, drainScope(req.Project), RoleAdmin)
+		if !ok {
+			return
+		}
+
+		if req.Project != "" {
+			_, err = os.Stat(filepath.Join(s.cfg.ProjectsPath, req.Project))
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Unknown project '%s'", req.Project), http.StatusBadRequest)
+				return
+			}
+		}
+
+		dr := Drain{Reason: req.Reason, Since: time.Now()}
+		if req.Duration > 0 {
+			until := dr.Since.Add(time.Duration(req.Duration))
+			dr.Until = &until
+		}
+		err = s.drains.Drain(req.Project, dr)
+		if err != nil {
+			s.Log.Print(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		s.Log.Printf("Drained %s: %s", drainTarget(req.Project), req.Reason)
+	case "DELETE":
+		project := r.URL.Query().Get("project")
+		_, ok := s.authorize(w, r, drainScope(project), RoleAdmin)
+		if !ok {
+			return
+		}
+
+		err := s.drains.Undrain(project)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Cannot undrain %s: %s", drainTarget(project), err), http.StatusNotFound)
+			return
+		}
+		s.Log.Printf("Undrained %s", drainTarget(project))
+	default:
+		http.Error(w, "Expected GET, PUT or DELETE, got "+r.Method, http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp, err := json.Marshal(s.drains.Status())
+	if err != nil {
+		s.Log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(resp)
+	if err != nil {
+		s.Log.Printf("Error writing drain response: %s", err)
+	}
+}
+
+// drainScope returns the project whose admins may drain project, which is
+// all projects for the whole server.
+func drainScope(project string) string {
+	if project == "" {
+		return AllProjects
+	}
+	return project
+}
+
+func drainTarget(project string) string {
+	if project == "" {
+		return "server"
+	}
+	return "project " + project
+}
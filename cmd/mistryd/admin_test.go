@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandlePool(t *testing.T) {
+	s, cleanup := newAuthServer(t)
+	defer cleanup()
+
+	request := func(method, body, token string) (int, PoolSize) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, "/admin/pool", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		s.srv.Handler.ServeHTTP(rec, req)
+
+		var size PoolSize
+		if rec.Code == 200 {
+			err := json.Unmarshal(rec.Body.Bytes(), &size)
+			if err != nil {
+				t.Fatalf("cannot unmarshal %s; %s", rec.Body, err)
+			}
+		}
+		return rec.Code, size
+	}
+
+	code, size := request("GET", "", "ops-token")
+	assertEq(code, 200, t)
+	assertEq(size, PoolSize{Concurrency: 0, Backlog: 10}, t)
+
+	// administering the pool requires the admin role on all projects
+	code, _ = request("GET", "", "ci-token")
+	assertEq(code, 403, t)
+
+	code, size = request("PUT", `{"concurrency": 2}`, "ops-token")
+	assertEq(code, 200, t)
+	assertEq(size, PoolSize{Concurrency: 2, Backlog: 10, Workers: 2}, t)
+
+	code, _ = request("PUT", `{"backlog": -1}`, "ops-token")
+	assertEq(code, 400, t)
+
+	code, _ = request("DELETE", "", "ops-token")
+	assertEq(code, 405, t)
+}
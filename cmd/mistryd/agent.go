@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/skroutz/mistry/pkg/types"
+)
+
+const (
+	// agentHeartbeatInterval is how often agents send heartbeats to their
+	// coordinator; it must be well below agentTimeout
+	agentHeartbeatInterval = 10 * time.Second
+
+	// agentRetryInterval is how long agents wait before retrying a failed
+	// request to their coordinator
+	agentRetryInterval = 5 * time.Second
+)
+
+// Agent builds jobs of the queue of a coordinator mistryd. It runs alongside
+// a Server, whose worker pool builds the jobs and whose HTTP API serves their
+// logs and artifacts.
+type Agent struct {
+	Info        AgentInfo
+	Coordinator string
+	Token       string
+
+	server *Server
+	client *http.Client
+	log    *log.Logger
+
+	// generation is incremented every time a registers with the
+	// coordinator; registerMu serializes registrations
+	registerMu sync.Mutex
+	generation uint64
+
+	// running contains the jobs received from the coordinator whose result
+	// is not reported yet, keyed by their sequence number in the
+	// coordinator; the job is nil until it's created. unsent contains the
+	// results that could not be reported, to be reported again later.
+	mu      sync.Mutex
+	running map[uint64]*Job
+	unsent  map[uint64]AgentResult
+}
+
+// NewAgent returns an Agent that builds the jobs of the coordinator at the
+// given base URL, using s. token authenticates the agent with the
+// coordinator, if it requires authentication.
+func NewAgent(s *Server, info AgentInfo, coordinator, token string) *Agent {
+	return &Agent{
+		Info:        info,
+		Coordinator: strings.TrimSuffix(coordinator, "/"),
+		Token:       token,
+		server:      s,
+		client:      &http.Client{Timeout: agentPollTimeout + 10*time.Second},
+		log:         s.Log,
+		running:     make(map[uint64]*Job),
+		unsent:      make(map[uint64]AgentResult),
+	}
+}
+
+// Run registers a with its coordinator and builds the jobs it receives, as
+// many at a time as the workers of its server, until ctx is done. Builds in
+// progress are not stopped and their results are still reported, as well as
+// any results that could not be reported before.
+func (a *Agent) Run(ctx context.Context) error {
+	err := a.register(ctx)
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		a.heartbeat(ctx)
+	}()
+
+	for i := 0; i < a.server.workerPool.Size().Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.poll(ctx)
+		}()
+	}
+
+	wg.Wait()
+	a.reportUnsent(context.Background())
+	return nil
+}
+
+// register registers a with its coordinator, retrying until it succeeds or
+// ctx is done.
+func (a *Agent) register(ctx context.Context) error {
+	a.registerMu.Lock()
+	defer a.registerMu.Unlock()
+
+	return a.registerLocked(ctx)
+}
+
+// reregister registers a with its coordinator again, after the coordinator
+// responded that it doesn't know about a, unless a registered again since
+// generation gen (eg. because another request got the same response).
+func (a *Agent) reregister(ctx context.Context, gen uint64) {
+	a.registerMu.Lock()
+	defer a.registerMu.Unlock()
+
+	if atomic.LoadUint64(&a.generation) != gen {
+		return
+	}
+	a.registerLocked(ctx)
+}
+
+func (a *Agent) registerLocked(ctx context.Context) error {
+	for {
+		err := a.do(ctx, "", a.Info, nil)
+		if err == nil {
+			atomic.AddUint64(&a.generation, 1)
+			a.log.Printf("Registered with %s as %s", a.Coordinator, a.Info.Name)
+			return nil
+		}
+		a.log.Printf("Cannot register with %s; %s", a.Coordinator, err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(agentRetryInterval):
+		}
+	}
+}
+
+// poll receives and builds jobs, one at a time, until ctx is done.
+func (a *Agent) poll(ctx context.Context) {
+	for ctx.Err() == nil {
+		var aj AgentJob
+		gen := atomic.LoadUint64(&a.generation)
+		err := a.do(ctx, "/poll", struct{}{}, &aj)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			a.log.Printf("Cannot poll for jobs; %s", err)
+			if err == errUnknownAgent {
+				a.reregister(ctx, gen)
+				continue
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(agentRetryInterval):
+			}
+			continue
+		}
+		if aj.Request.Project == "" {
+			// no jobs were available
+			continue
+		}
+
+		a.mu.Lock()
+		a.running[aj.Seq] = nil
+		a.mu.Unlock()
+
+		// the result is reported even if ctx is done, since the
+		// coordinator is waiting for it
+		a.report(a.build(aj))
+	}
+}
+
+// report reports res to the coordinator, retrying a few times. If it still
+// cannot be reported, it's kept and reported again after the next heartbeat
+// (see reportUnsent).
+//
+// The job of res is reported as running in heartbeats until its result is
+// reported, so that the coordinator doesn't consider it lost in the meantime.
+func (a *Agent) report(res AgentResult) {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = a.do(context.Background(), "/results", res, nil)
+		if err == nil || err == errUnknownAgent || attempt == 3 {
+			break
+		}
+		time.Sleep(agentRetryInterval)
+	}
+	a.reported(res, err)
+}
+
+// reportUnsent reports the results that could not be reported before, once.
+func (a *Agent) reportUnsent(ctx context.Context) {
+	a.mu.Lock()
+	unsent := make([]AgentResult, 0, len(a.unsent))
+	for _, res := range a.unsent {
+		unsent = append(unsent, res)
+	}
+	a.mu.Unlock()
+
+	for _, res := range unsent {
+		a.reported(res, a.do(ctx, "/results", res, nil))
+	}
+}
+
+// reported records the outcome of reporting res. Results that the
+// coordinator doesn't wait for (eg. because it restarted) are dropped; the
+// rest are kept if err is not nil.
+func (a *Agent) reported(res AgentResult, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err != nil && err != errUnknownAgent {
+		if _, ok := a.unsent[res.Seq]; !ok {
+			a.log.Printf("Cannot report result of job %d, will retry; %s", res.Seq, err)
+		}
+		a.unsent[res.Seq] = res
+		return
+	}
+	if err == errUnknownAgent {
+		a.log.Printf("Dropping result of job %d; the coordinator is not waiting for it", res.Seq)
+	}
+	delete(a.unsent, res.Seq)
+	delete(a.running, res.Seq)
+}
+
+// build builds aj using the worker pool of the server of a.
+func (a *Agent) build(aj AgentJob) AgentResult {
+	res := AgentResult{Seq: aj.Seq}
+
+	jr := aj.Request
+	j, err := NewJob(jr.Project, jr.Params, jr.Env, jr.Group, a.server.cfg)
+	if err != nil {
+		res.Error = fmt.Sprintf("cannot create job: %s", err)
+		res.FailureKind = types.FailureProject
+		return res
+	}
+	j.Rebuild = jr.Rebuild
+	j.Priority = jr.Priority
+	j.RequestedBy = aj.RequestedBy
+	j.Timeout = a.server.cfg.JobTimeout(j.Project, j.Settings, jr.Timeout)
+
+	a.mu.Lock()
+	a.running[aj.Seq] = j
+	a.mu.Unlock()
+
+	a.log.Printf("Building %s for %s", j, a.Coordinator)
+	future, err := a.server.workerPool.SendWork(j)
+	if err != nil {
+		res.Error = fmt.Sprintf("cannot schedule job: %s", err)
+		res.FailureKind = types.FailureAgent
+		return res
+	}
+
+	r := future.Wait()
+	res.BuildInfo = r.BuildInfo
+	if r.Err != nil {
+		res.Error = r.Err.Error()
+		res.FailureKind = types.FailureKindOf(r.Err)
+	}
+	return res
+}
+
+// heartbeat sends heartbeats to the coordinator, cancels the jobs it asks to
+// and reports the results that could not be reported before, until ctx is
+// done.
+func (a *Agent) heartbeat(ctx context.Context) {
+	ticker := time.NewTicker(agentHeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		st := AgentStatus{Running: []uint64{}}
+		a.mu.Lock()
+		for seq := range a.running {
+			st.Running = append(st.Running, seq)
+		}
+		a.mu.Unlock()
+
+		var hb AgentHeartbeat
+		gen := atomic.LoadUint64(&a.generation)
+		err := a.do(ctx, "/heartbeat", st, &hb)
+		if err != nil {
+			a.log.Printf("Cannot send heartbeat; %s", err)
+			if err == errUnknownAgent {
+				a.reregister(ctx, gen)
+			}
+			continue
+		}
+
+		for _, seq := range hb.Cancel {
+			a.mu.Lock()
+			j := a.running[seq]
+			a.mu.Unlock()
+			if j != nil && a.server.workerPool.Cancel(j.Project, j.ID) {
+				a.log.Printf("Cancelled %s", j)
+			}
+		}
+
+		a.reportUnsent(ctx)
+	}
+}
+
+// do posts body to the given path of the agent in the agents API of the
+// coordinator, and decodes the response into v, unless it's empty. If path
+// is empty, body is posted to the agents API itself.
+func (a *Agent) do(ctx context.Context, path string, body, v interface{}) error {
+	reqBody, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	url := a.Coordinator + "/agents"
+	if path != "" {
+		url += "/" + a.Info.Name + path
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if a.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.Token)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNoContent:
+		return nil
+	case http.StatusNotFound:
+		// the coordinator forgot about the agent, eg. because it
+		// restarted or considered the agent lost
+		return errUnknownAgent
+	default:
+		return fmt.Errorf("(error: %d) %s", resp.StatusCode, bytes.TrimSpace(respBody))
+	}
+
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(respBody, v)
+}
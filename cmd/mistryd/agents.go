@@ -0,0 +1,633 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/skroutz/mistry/pkg/types"
+)
+
+const (
+	// agentTimeout is how long an agent may go without contacting the
+	// coordinator before it's considered lost; the jobs it was building
+	// fail
+	agentTimeout = 1 * time.Minute
+
+	// agentPollTimeout is how long a poll request of an agent waits for a
+	// job before it's answered with no job
+	agentPollTimeout = 30 * time.Second
+
+	// agentAckTimeout is how long an agent may take to report a job it was
+	// assigned in its heartbeats, before the job is put back in the queue
+	// (eg. because the response to its poll was lost)
+	agentAckTimeout = 3 * agentHeartbeatInterval
+)
+
+var errUnknownAgent = errors.New("unknown agent")
+
+// errBuildRequeued is the outcome shared with the jobs coalesced with a job
+// that was put back in the queue, instead of being built by an agent.
+var errBuildRequeued = errors.New("build was put back in the queue")
+
+// agent is a remote mistryd process that builds jobs of the queue of the
+// WorkerPool it's registered with.
+type agent struct {
+	name     string
+	url      string
+	lastSeen time.Time
+
+	// jobs contains the items the agent is building, keyed by their
+	// sequence number in the journal
+	jobs map[uint64]*workItem
+}
+
+// AgentInfo is sent by agents to register with a coordinator.
+type AgentInfo struct {
+	Name string `json:"name"`
+
+	// URL is the base URL of the agent's HTTP API, from which the logs
+	// and artifacts of its builds are fetched
+	URL string `json:"url"`
+}
+
+// AgentReport is the state of a registered agent.
+type AgentReport struct {
+	AgentInfo
+	LastSeen time.Time `json:"lastSeen"`
+	Jobs     []PoolJob `json:"jobs"`
+}
+
+// AgentJob is a job assigned to an agent. Seq identifies the job in the
+// agent's heartbeats and results.
+type AgentJob struct {
+	Seq         uint64           `json:"seq"`
+	Request     types.JobRequest `json:"request"`
+	RequestedBy string           `json:"requestedBy"`
+}
+
+// AgentResult is the outcome of an AgentJob, reported by the agent.
+type AgentResult struct {
+	Seq         uint64            `json:"seq"`
+	BuildInfo   *types.BuildInfo  `json:"buildInfo,omitempty"`
+	Error       string            `json:"error,omitempty"`
+	FailureKind types.FailureKind `json:"failureKind,omitempty"`
+}
+
+// AgentStatus is sent by agents with their heartbeats.
+type AgentStatus struct {
+	// Running contains the jobs that the agent is building, or reporting
+	// the result of
+	Running []uint64 `json:"running"`
+}
+
+// AgentHeartbeat is the response to the heartbeats of agents, containing
+// the jobs that the agent should cancel.
+type AgentHeartbeat struct {
+	Cancel []uint64 `json:"cancel"`
+}
+
+// RegisterAgent registers an agent with p, so that it may pop jobs from its
+// queue. If an agent with the same name and URL is already registered (eg.
+// because it registered again after a request failed), it's kept along with
+// its jobs; the ones it's not building anymore fail at its next heartbeat.
+// If the URL differs, the agent is replaced and the jobs it was building
+// fail.
+func (p *WorkerPool) RegisterAgent(info AgentInfo) error {
+	if info.Name == "" || info.URL == "" {
+		return errors.New("agents must have a name and a URL")
+	}
+
+	p.mu.Lock()
+	old := p.agents[info.Name]
+	if old != nil && old.url == info.URL {
+		old.lastSeen = time.Now()
+		p.mu.Unlock()
+		p.logger.Printf("Agent %s at %s registered again", info.Name, info.URL)
+		return nil
+	}
+	p.agents[info.Name] = &agent{
+		name:     info.Name,
+		url:      info.URL,
+		lastSeen: time.Now(),
+		jobs:     make(map[uint64]*workItem),
+	}
+	p.mu.Unlock()
+
+	p.logger.Printf("Registered agent %s at %s", info.Name, info.URL)
+	if old != nil {
+		p.failAgent(old, failErr(types.FailureAgent, fmt.Sprintf("agent %s restarted", old.name), nil))
+	}
+	return nil
+}
+
+// PopRemote removes the next item from the queue of p, to be built by the
+// agent name. It waits for an item until ctx is done, in which case nil is
+// returned; nil is also returned if p is closed, so that the remaining items
+// are built by its workers. Items are unregistered when CompleteRemote is
+// called or if the agent is lost.
+//
+// Items whose job is already built, or being built, are not assigned to the
+// agent; they complete with the outcome of that build, as if a worker of p
+// popped them. Items that the agent doesn't report as running within
+// agentAckTimeout are put back in the queue.
+func (p *WorkerPool) PopRemote(ctx context.Context, name string) (*workItem, error) {
+	for {
+		closed, err := p.touchAgent(name)
+		if err != nil || closed {
+			return nil, err
+		}
+
+		qi, ok := p.queue.PopContext(ctx)
+		if !ok {
+			return nil, nil
+		}
+		item := qi.wi
+
+		if p.metrics != nil {
+			p.metrics.RecordJobDequeued(item.job.Priority, time.Since(qi.enqueuedAt))
+		}
+
+		p.mu.Lock()
+		p.start(item)
+		p.mu.Unlock()
+
+		if item.ctx.Err() != nil {
+			p.complete(item, nil, droppedErr(item))
+			continue
+		}
+
+		// build coalescing, as in Server.Work
+		completion, added := p.server.jq.Add(item.job)
+		if !added {
+			p.wg.Add(1)
+			go p.coalesceRemote(item, completion)
+			continue
+		}
+
+		// build result cache
+		if bi := p.server.readyBuild(item.job); bi != nil {
+			if p.metrics != nil {
+				p.metrics.RecordCacheUtilization(item.job.Project)
+			}
+			p.server.jq.Complete(item.job, bi, nil)
+			p.complete(item, bi, nil)
+			continue
+		}
+
+		p.mu.Lock()
+		a := p.agents[name]
+		if a != nil && !p.closed {
+			item.agent = name
+			item.assignedAt = time.Now()
+			a.jobs[item.seq] = item
+			p.wg.Add(1)
+		}
+		closed = p.closed
+		p.mu.Unlock()
+
+		if closed || a == nil {
+			// the item is built by the workers of p, or by another
+			// agent, instead
+			p.server.jq.Complete(item.job, nil, errBuildRequeued)
+			p.requeueRemote(item)
+			if closed {
+				return nil, nil
+			}
+			return nil, errUnknownAgent
+		}
+
+		bi := p.server.newBuildInfo(item.job)
+		bi.AgentURL = a.url
+		err = p.server.index.PutPending(item.job.Project, item.job.ID, bi)
+		if err != nil {
+			p.logger.Printf("Cannot index %s; %s", item.job, err)
+		}
+		return item, nil
+	}
+}
+
+// coalesceRemote completes wi, which was popped for an agent, with the outcome
+// of the identical job that is being built, once its completion c is done. If
+// that job is put back in the queue instead, so is wi.
+func (p *WorkerPool) coalesceRemote(wi *workItem, c *JobCompletion) {
+	defer p.wg.Done()
+
+	select {
+	case <-wi.ctx.Done():
+		p.complete(wi, nil, failErr(types.FailureCancelled, "context cancelled while coalescing", nil))
+		return
+	case <-c.Done():
+	}
+
+	bi, err := c.Result()
+	if err == errBuildRequeued {
+		p.requeueRemote(wi)
+		return
+	}
+	if bi != nil {
+		coalesced := *bi
+		coalesced.Coalesced = true
+		bi = &coalesced
+	}
+	if p.metrics != nil {
+		p.metrics.RecordBuildCoalesced(wi.job.Project)
+	}
+	p.complete(wi, bi, err)
+}
+
+// requeueRemote puts wi, which was popped for an agent but not built by it,
+// back in the queue. If wi cannot be queued (eg. because p is closed), it
+// fails.
+func (p *WorkerPool) requeueRemote(wi *workItem) {
+	p.mu.Lock()
+	wi.running = false
+	wi.agent = ""
+	wi.acked = false
+	p.mu.Unlock()
+
+	err := p.queue.Push(wi)
+	if err == errQueueClosed {
+		p.complete(wi, nil, failErr(types.FailureCancelled, "server is shutting down", nil))
+		return
+	} else if err != nil {
+		p.complete(wi, nil, failErr(types.FailureAgent, "could not put the job back in the queue", err))
+		return
+	}
+	p.queue.Done(wi.job.Project)
+
+	if p.metrics != nil {
+		p.metrics.RecordJobQueued(wi.job.Priority)
+	}
+}
+
+// CompleteRemote records the outcome of the item with the given sequence
+// number, built by the agent name. It returns false if the agent is not
+// building such an item (eg. because it was lost in the meantime).
+func (p *WorkerPool) CompleteRemote(name string, seq uint64, buildInfo *types.BuildInfo, err error) bool {
+	p.mu.Lock()
+	a := p.agents[name]
+	if a == nil || a.jobs[seq] == nil {
+		p.mu.Unlock()
+		return false
+	}
+	wi := a.jobs[seq]
+	delete(a.jobs, seq)
+	a.lastSeen = time.Now()
+	p.recordDuration(time.Since(wi.startedAt))
+	p.mu.Unlock()
+
+	p.completeRemote(wi, a.url, buildInfo, err)
+	return true
+}
+
+// completeRemote records the outcome of wi, which was assigned to the agent
+// at url, and indexes it, so that the job can be looked up in the server of p
+// as well. Its logs and artifacts are served by the agent (see
+// Server.proxyToAgent).
+func (p *WorkerPool) completeRemote(wi *workItem, url string, buildInfo *types.BuildInfo, err error) {
+	bi := buildInfo
+	if bi == nil {
+		// the agent didn't get to build the job
+		bi = p.server.newBuildInfo(wi.job)
+		if err != nil {
+			bi.ErrBuild = err.Error()
+			bi.FailureKind = types.FailureKindOf(err)
+			bi.Cancelled = bi.FailureKind == types.FailureCancelled
+		}
+	}
+	bi.AgentURL = url
+	ierr := p.server.index.Put(wi.job.Project, wi.job.ID, "ready", bi)
+	if ierr != nil {
+		p.logger.Printf("Cannot index %s; %s", wi.job, ierr)
+	}
+
+	p.server.jq.Complete(wi.job, bi, err)
+	p.complete(wi, buildInfo, err)
+	p.wg.Done()
+}
+
+// Heartbeat records that the agent name is alive and building the items with
+// the given sequence numbers. It returns the sequence numbers of the items it
+// should stop building, since they were cancelled.
+//
+// Items that the agent reported as running in a previous heartbeat, but not
+// anymore, fail: the agent lost them (eg. because it restarted) without
+// reporting their result.
+func (p *WorkerPool) Heartbeat(name string, running []uint64) ([]uint64, error) {
+	p.mu.Lock()
+	a := p.agents[name]
+	if a == nil {
+		p.mu.Unlock()
+		return nil, errUnknownAgent
+	}
+	a.lastSeen = time.Now()
+
+	reported := make(map[uint64]bool)
+	for _, seq := range running {
+		reported[seq] = true
+	}
+
+	cancel := []uint64{}
+	acked := []*workItem{}
+	lost := []*workItem{}
+	for seq, wi := range a.jobs {
+		if !reported[seq] {
+			if wi.acked {
+				delete(a.jobs, seq)
+				lost = append(lost, wi)
+			}
+			continue
+		}
+		if !wi.acked {
+			wi.acked = true
+			acked = append(acked, wi)
+		}
+		if wi.ctx.Err() != nil {
+			cancel = append(cancel, seq)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, wi := range acked {
+		jerr := p.journal.MarkStarted(wi.seq)
+		if jerr != nil {
+			p.logger.Printf("Cannot mark %s as started in the journal; %s", wi.job, jerr)
+		}
+	}
+	for _, wi := range lost {
+		p.completeRemote(wi, a.url, nil,
+			failErr(types.FailureAgent, fmt.Sprintf("agent %s is not building the job anymore", name), nil))
+	}
+	return cancel, nil
+}
+
+// Agents reports the registered agents and the jobs they're building.
+func (p *WorkerPool) Agents() []AgentReport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	agents := []AgentReport{}
+	for _, a := range p.agents {
+		r := AgentReport{
+			AgentInfo: AgentInfo{Name: a.name, URL: a.url},
+			LastSeen:  a.lastSeen,
+			Jobs:      []PoolJob{},
+		}
+		for _, wi := range a.jobs {
+			r.Jobs = append(r.Jobs, newPoolJob(wi.job))
+		}
+		agents = append(agents, r)
+	}
+	sort.Slice(agents, func(i, j int) bool { return agents[i].Name < agents[j].Name })
+	return agents
+}
+
+// touchAgent records that the agent name is alive. It returns true if p is
+// closed.
+func (p *WorkerPool) touchAgent(name string) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	a := p.agents[name]
+	if a == nil {
+		return false, errUnknownAgent
+	}
+	a.lastSeen = time.Now()
+	return p.closed, nil
+}
+
+// reapAgents periodically unregisters the agents that haven't contacted p
+// within agentTimeout, until p is closed.
+func (p *WorkerPool) reapAgents() {
+	ticker := time.NewTicker(agentTimeout / 4)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		lost := []*agent{}
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return
+		}
+		for name, a := range p.agents {
+			if time.Since(a.lastSeen) > agentTimeout {
+				delete(p.agents, name)
+				lost = append(lost, a)
+			}
+		}
+		p.mu.Unlock()
+
+		for _, a := range lost {
+			p.logger.Printf("Agent %s stopped responding", a.name)
+			p.failAgent(a, failErr(types.FailureAgent, fmt.Sprintf("agent %s stopped responding", a.name), nil))
+		}
+		p.requeueUnacked()
+	}
+}
+
+// requeueUnacked puts the items that were assigned to agents more than
+// agentAckTimeout ago, but not reported by them as running, back in the
+// queue.
+func (p *WorkerPool) requeueUnacked() {
+	unacked := []*workItem{}
+	p.mu.Lock()
+	for _, a := range p.agents {
+		for seq, wi := range a.jobs {
+			if !wi.acked && time.Since(wi.assignedAt) > agentAckTimeout {
+				delete(a.jobs, seq)
+				unacked = append(unacked, wi)
+			}
+		}
+	}
+	p.mu.Unlock()
+
+	for _, wi := range unacked {
+		p.logger.Printf("Agent %s did not acknowledge %s; putting it back in the queue", wi.agent, wi.job)
+		p.server.jq.Complete(wi.job, nil, errBuildRequeued)
+		p.requeueRemote(wi)
+		p.wg.Done()
+	}
+}
+
+// failAgent fails the items that a, which is no longer registered, was
+// building.
+func (p *WorkerPool) failAgent(a *agent, err error) {
+	p.mu.Lock()
+	items := a.jobs
+	a.jobs = make(map[uint64]*workItem)
+	p.mu.Unlock()
+
+	for _, wi := range items {
+		p.completeRemote(wi, a.url, nil, err)
+	}
+}
+
+// dropRemote fails the items that are being built by agents.
+func (p *WorkerPool) dropRemote(err error) {
+	p.mu.Lock()
+	agents := make([]*agent, 0, len(p.agents))
+	for _, a := range p.agents {
+		agents = append(agents, a)
+	}
+	p.mu.Unlock()
+
+	for _, a := range agents {
+		p.failAgent(a, err)
+	}
+}
+
+// HandleAgents implements the API used by agents, in the form of:
+//
+//	GET  /agents                   lists the registered agents
+//	POST /agents                   registers an agent (see AgentInfo)
+//	POST /agents/{name}/poll       waits for an AgentJob
+//	POST /agents/{name}/heartbeat  reports an AgentStatus and keeps the agent
+//	                               registered (see AgentHeartbeat)
+//	POST /agents/{name}/results    reports an AgentResult
+//
+// Requests for unknown agents fail with 404, in which case agents should
+// register again. It requires the admin role on all projects.
+func (s *Server) HandleAgents(w http.ResponseWriter, r *http.Request) {
+	_, ok := s.authorize(w, r, AllProjects, RoleAdmin)
+	if !ok {
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) == 1 {
+		switch r.Method {
+		case "GET":
+			s.writeAgentsJSON(w, s.workerPool.Agents())
+		case "POST":
+			var info AgentInfo
+			if !readAgentsJSON(w, r, &info) {
+				return
+			}
+			err := s.workerPool.RegisterAgent(info)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Cannot register agent: %s", err), http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "Expected GET or POST, got "+r.Method, http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if len(parts) != 3 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Expected POST, got "+r.Method, http.StatusMethodNotAllowed)
+		return
+	}
+	name := parts[1]
+
+	switch parts[2] {
+	case "poll":
+		// the body is consumed, so that the request is cancelled if the
+		// agent disconnects while waiting
+		var empty struct{}
+		if !readAgentsJSON(w, r, &empty) {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), agentPollTimeout)
+		defer cancel()
+
+		wi, err := s.workerPool.PopRemote(ctx, name)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Cannot poll for jobs: %s", err), http.StatusNotFound)
+			return
+		}
+		if wi == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		s.Log.Printf("Assigned %s to agent %s", wi.job, name)
+		s.writeAgentsJSON(w, AgentJob{
+			Seq: wi.seq,
+			Request: types.JobRequest{
+				Project:  wi.job.Project,
+				Group:    wi.job.Group,
+				Params:   wi.job.Params,
+				Env:      wi.job.Env,
+				Rebuild:  wi.job.Rebuild,
+				Timeout:  wi.job.Timeout,
+				Priority: wi.job.Priority,
+			},
+			RequestedBy: wi.job.RequestedBy,
+		})
+	case "heartbeat":
+		var st AgentStatus
+		if !readAgentsJSON(w, r, &st) {
+			return
+		}
+		cancel, err := s.workerPool.Heartbeat(name, st.Running)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Cannot record heartbeat: %s", err), http.StatusNotFound)
+			return
+		}
+		s.writeAgentsJSON(w, AgentHeartbeat{Cancel: cancel})
+	case "results":
+		var res AgentResult
+		if !readAgentsJSON(w, r, &res) {
+			return
+		}
+
+		var err error
+		if res.Error != "" {
+			err = fmt.Errorf("agent %s: %s", name, res.Error)
+			if res.FailureKind != "" {
+				err = types.ErrBuildFailure{Kind: res.FailureKind, Err: err}
+			}
+		}
+		if !s.workerPool.CompleteRemote(name, res.Seq, res.BuildInfo, err) {
+			http.Error(w, fmt.Sprintf("Agent %s is not building job %d", name, res.Seq), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func readAgentsJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading request body: %s", err), http.StatusBadRequest)
+		return false
+	}
+	r.Body.Close()
+
+	err = json.Unmarshal(body, v)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error unmarshalling body '%s': %s", body, err), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func (s *Server) writeAgentsJSON(w http.ResponseWriter, v interface{}) {
+	resp, err := json.Marshal(v)
+	if err != nil {
+		s.Log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(resp)
+	if err != nil {
+		s.Log.Printf("Error writing agents response: %s", err)
+	}
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/skroutz/mistry/pkg/types"
+)
+
+// newAgentServer returns a server with its own build path and the given
+// number of workers.
+func newAgentServer(t *testing.T, concurrency int, projectsPath string) (*Server, func()) {
+	cfg := *testcfg
+	cfg.Concurrency = concurrency
+	cfg.Backlog = 10
+	cfg.ProjectsPath = projectsPath
+	path, err := ioutil.TempDir("", "mistry-test-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.BuildPath = path
+
+	s, err := NewServer(&cfg, nil, false)
+	if err != nil {
+		os.RemoveAll(path)
+		t.Fatal(err)
+	}
+
+	return s, func() {
+		s.workerPool.Stop()
+		s.index.Close()
+		s.journal.Close()
+		os.RemoveAll(path)
+	}
+}
+
+func TestRemoteWork(t *testing.T) {
+	s, cleanup := newAgentServer(t, 0, testcfg.ProjectsPath)
+	defer cleanup()
+	p := s.workerPool
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := p.PopRemote(ctx, "foo")
+	assertEq(err, errUnknownAgent, t)
+
+	failIfError(p.RegisterAgent(AgentInfo{Name: "foo", URL: "http://foo:8462"}), t)
+
+	// no jobs are queued
+	wi, err := p.PopRemote(ctx, "foo")
+	failIfError(err, t)
+	assertEq(wi, (*workItem)(nil), t)
+
+	j, future := sendWorkNoErr(p, "simple", types.Params{"test": "remote-work"}, s.cfg, t)
+	wi, err = p.PopRemote(context.Background(), "foo")
+	failIfError(err, t)
+	assertEq(wi.job, j, t)
+
+	agents := p.Agents()
+	assertEq(len(agents), 1, t)
+	assertEq(agents[0].Jobs[0].ID, j.ID, t)
+
+	cancelled, err := p.Heartbeat("foo", []uint64{wi.seq})
+	failIfError(err, t)
+	assertEq(cancelled, []uint64{}, t)
+
+	assertEq(p.Cancel(j.Project, j.ID), true, t)
+	cancelled, err = p.Heartbeat("foo", []uint64{wi.seq})
+	failIfError(err, t)
+	assertEq(cancelled, []uint64{wi.seq}, t)
+
+	bi := types.NewBuildInfo()
+	bi.Cancelled = true
+	assertEq(p.CompleteRemote("foo", wi.seq, bi, nil), true, t)
+	assertEq(p.CompleteRemote("foo", wi.seq, bi, nil), false, t)
+
+	r := future.Wait()
+	failIfError(r.Err, t)
+	assertEq(r.BuildInfo.Cancelled, true, t)
+	assertEq(r.BuildInfo.AgentURL, "http://foo:8462", t)
+
+	// agents that register again keep their jobs, unless they're not
+	// building them anymore
+	_, future = sendWorkNoErr(p, "simple", types.Params{"test": "remote-work2"}, s.cfg, t)
+	wi, err = p.PopRemote(context.Background(), "foo")
+	failIfError(err, t)
+	_, err = p.Heartbeat("foo", []uint64{wi.seq})
+	failIfError(err, t)
+	failIfError(p.RegisterAgent(AgentInfo{Name: "foo", URL: "http://foo:8462"}), t)
+	assertEq(len(p.Agents()[0].Jobs), 1, t)
+	_, err = p.Heartbeat("foo", []uint64{})
+	failIfError(err, t)
+	r = future.Wait()
+	assertEq(types.FailureKindOf(r.Err), types.FailureAgent, t)
+
+	// the jobs of agents that register with a different URL are lost
+	_, future = sendWorkNoErr(p, "simple", types.Params{"test": "remote-work3"}, s.cfg, t)
+	_, err = p.PopRemote(context.Background(), "foo")
+	failIfError(err, t)
+	failIfError(p.RegisterAgent(AgentInfo{Name: "foo", URL: "http://foo:8463"}), t)
+	r = future.Wait()
+	assertEq(types.FailureKindOf(r.Err), types.FailureAgent, t)
+}
+
+func TestRemoteWorkIndex(t *testing.T) {
+	s, cleanup := newAgentServer(t, 0, testcfg.ProjectsPath)
+	defer cleanup()
+	p := s.workerPool
+
+	// the agent responds with the URI and the token of the request
+	agentSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.URL.RequestURI(), r.Header.Get("Authorization"))
+	}))
+	defer agentSrv.Close()
+
+	failIfError(p.RegisterAgent(AgentInfo{Name: "foo", URL: agentSrv.URL}), t)
+	j, future := sendWorkNoErr(p, "simple", types.Params{"test": "remote-work-index"}, s.cfg, t)
+	wi, err := p.PopRemote(context.Background(), "foo")
+	failIfError(err, t)
+
+	get := func(path string) *http.Response {
+		rec := httptest.NewRecorder()
+		s.srv.Handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec.Result()
+	}
+	body := func(resp *http.Response) string {
+		b, err := ioutil.ReadAll(resp.Body)
+		failIfError(err, t)
+		return string(b)
+	}
+
+	// the logs of running builds are served by the agent
+	for _, path := range []string{"/job/simple/" + j.ID, "/log/simple/" + j.ID} {
+		resp := get(path)
+		assertEq(resp.StatusCode, http.StatusOK, t)
+		assertEq(body(resp), path+" ", t)
+	}
+
+	// tokens are passed in headers, never in URLs
+	resp := get("/job/simple/" + j.ID + "?access_token=secret&foo=bar")
+	assertEq(body(resp), "/job/simple/"+j.ID+"?foo=bar Bearer secret", t)
+
+	bi := types.NewBuildInfo()
+	bi.ExitCode = 0
+	assertEq(p.CompleteRemote("foo", wi.seq, bi, nil), true, t)
+	r := future.Wait()
+	failIfError(r.Err, t)
+
+	indexed, err := s.index.Get(j.Project, j.ID)
+	failIfError(err, t)
+	assertEq(indexed.State, "ready", t)
+	assertEq(indexed.BuildInfo.AgentURL, agentSrv.URL, t)
+
+	resp = get("/jobs/simple/" + j.ID)
+	assertEq(resp.StatusCode, http.StatusOK, t)
+	var st types.JobStatus
+	failIfError(json.NewDecoder(resp.Body).Decode(&st), t)
+	assertEq(st.State, types.JobFinished, t)
+
+	resp = get("/jobs/simple/" + j.ID + "/artifacts")
+	assertEq(body(resp), "/jobs/simple/"+j.ID+"/artifacts ", t)
+
+	// builds that the agent didn't complete are indexed as failed
+	j, future = sendWorkNoErr(p, "simple", types.Params{"test": "remote-work-index2"}, s.cfg, t)
+	_, err = p.PopRemote(context.Background(), "foo")
+	failIfError(err, t)
+	failIfError(p.RegisterAgent(AgentInfo{Name: "foo", URL: "http://foo:8463"}), t)
+	assertNotEq(future.Wait().Err, nil, t)
+
+	indexed, err = s.index.Get(j.Project, j.ID)
+	failIfError(err, t)
+	assertEq(indexed.State, "ready", t)
+	assertEq(indexed.BuildInfo.FailureKind, types.FailureAgent, t)
+}
+
+func TestPopRemoteCoalescing(t *testing.T) {
+	s, cleanup := newAgentServer(t, 0, testcfg.ProjectsPath)
+	defer cleanup()
+	p := s.workerPool
+
+	failIfError(p.RegisterAgent(AgentInfo{Name: "foo", URL: "http://foo:8462"}), t)
+	params := types.Params{"test": "pop-remote-coalescing"}
+	j, future1 := sendWorkNoErr(p, "simple", params, s.cfg, t)
+	_, future2 := sendWorkNoErr(p, "simple", params, s.cfg, t)
+
+	wi, err := p.PopRemote(context.Background(), "foo")
+	failIfError(err, t)
+	assertEq(wi.job, j, t)
+
+	// identical jobs are not assigned to agents
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	other, err := p.PopRemote(ctx, "foo")
+	failIfError(err, t)
+	assertEq(other, (*workItem)(nil), t)
+
+	bi := types.NewBuildInfo()
+	bi.ExitCode = types.ContainerSuccessExitCode
+	assertEq(p.CompleteRemote("foo", wi.seq, bi, nil), true, t)
+	r := future1.Wait()
+	failIfError(r.Err, t)
+	r = future2.Wait()
+	failIfError(r.Err, t)
+	assertEq(r.BuildInfo.Coalesced, true, t)
+	assertEq(r.BuildInfo.AgentURL, "http://foo:8462", t)
+
+	// neither are jobs that are already built
+	_, future3 := sendWorkNoErr(p, "simple", params, s.cfg, t)
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	other, err = p.PopRemote(ctx, "foo")
+	failIfError(err, t)
+	assertEq(other, (*workItem)(nil), t)
+	r = future3.Wait()
+	failIfError(r.Err, t)
+	assertEq(r.BuildInfo.Cached, true, t)
+	assertEq(r.BuildInfo.AgentURL, "http://foo:8462", t)
+}
+
+func TestPopRemoteUnacked(t *testing.T) {
+	s, cleanup := newAgentServer(t, 0, testcfg.ProjectsPath)
+	defer cleanup()
+	p := s.workerPool
+
+	failIfError(p.RegisterAgent(AgentInfo{Name: "foo", URL: "http://foo:8462"}), t)
+	j, future := sendWorkNoErr(p, "simple", types.Params{"test": "pop-remote-unacked"}, s.cfg, t)
+	wi, err := p.PopRemote(context.Background(), "foo")
+	failIfError(err, t)
+
+	// items are kept until agentAckTimeout passes
+	p.requeueUnacked()
+	assertEq(len(p.Agents()[0].Jobs), 1, t)
+
+	// the response to the poll was lost
+	p.mu.Lock()
+	wi.assignedAt = time.Now().Add(-2 * agentAckTimeout)
+	p.mu.Unlock()
+	p.requeueUnacked()
+	assertEq(len(p.Agents()[0].Jobs), 0, t)
+	assertEq(p.queue.Len(), 1, t)
+
+	wi, err = p.PopRemote(context.Background(), "foo")
+	failIfError(err, t)
+	assertEq(wi.job, j, t)
+	_, err = p.Heartbeat("foo", []uint64{wi.seq})
+	failIfError(err, t)
+
+	// items reported by the agent are not put back
+	p.mu.Lock()
+	wi.assignedAt = time.Now().Add(-2 * agentAckTimeout)
+	p.mu.Unlock()
+	p.requeueUnacked()
+	assertEq(len(p.Agents()[0].Jobs), 1, t)
+
+	assertEq(p.CompleteRemote("foo", wi.seq, types.NewBuildInfo(), nil), true, t)
+	failIfError(future.Wait().Err, t)
+}
+
+func TestAgent(t *testing.T) {
+	coordinator, cleanup := newAgentServer(t, 0, testcfg.ProjectsPath)
+	defer cleanup()
+	ts := httptest.NewServer(coordinator.srv.Handler)
+	defer ts.Close()
+
+	// the agents don't know about any projects, so that their builds
+	// fail without running any containers
+	projectsPath, err := ioutil.TempDir("", "mistry-test-agent-projects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(projectsPath)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, name := range []string{"agent1", "agent2"} {
+		s, cleanup := newAgentServer(t, 1, projectsPath)
+		defer cleanup()
+
+		info := AgentInfo{Name: name, URL: "http://" + name + ":8462"}
+		go NewAgent(s, info, ts.URL, "").Run(ctx)
+	}
+
+	listAgents := func() []AgentReport {
+		resp, err := http.Get(ts.URL + "/agents")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		agents := []AgentReport{}
+		err = json.NewDecoder(resp.Body).Decode(&agents)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return agents
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(listAgents()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("agents did not register")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	agents := listAgents()
+	assertEq(agents[0].Name, "agent1", t)
+	assertEq(agents[1].URL, "http://agent2:8462", t)
+
+	_, future := sendWorkNoErr(coordinator.workerPool, "simple", types.Params{"test": "agent"}, coordinator.cfg, t)
+	select {
+	case r := <-future.result:
+		assertNotEq(r.Err, nil, t)
+		if !strings.Contains(r.Err.Error(), "Unknown project 'simple'") {
+			t.Fatalf("Expected the error of the agent, got %s", r.Err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the job was not built by an agent")
+	}
+}
+
+func TestAgentRegistersAgainOnce(t *testing.T) {
+	s, cleanup := newAgentServer(t, 4, testcfg.ProjectsPath)
+	defer cleanup()
+
+	var (
+		mu            sync.Mutex
+		registrations int
+	)
+	coordinator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		n := registrations
+		if r.URL.Path == "/agents" {
+			registrations++
+		}
+		mu.Unlock()
+
+		switch {
+		case r.URL.Path == "/agents":
+			w.WriteHeader(http.StatusNoContent)
+		case n == 1:
+			// the coordinator restarted and forgot about the agent
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			time.Sleep(10 * time.Millisecond)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer coordinator.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		NewAgent(s, AgentInfo{Name: "foo", URL: "http://foo:8462"}, coordinator.URL, "").Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := registrations
+		mu.Unlock()
+		if n >= 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the agent did not register again")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the concurrent polls that failed don't register the agent again
+	time.Sleep(200 * time.Millisecond)
+	mu.Lock()
+	assertEq(registrations, 2, t)
+	mu.Unlock()
+}
+
+func TestAgentReportsUnsentResults(t *testing.T) {
+	s, cleanup := newAgentServer(t, 1, testcfg.ProjectsPath)
+	defer cleanup()
+
+	var (
+		mu     sync.Mutex
+		status = http.StatusInternalServerError
+		seqs   []uint64
+	)
+	coordinator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var res AgentResult
+		failIfError(json.NewDecoder(r.Body).Decode(&res), t)
+
+		mu.Lock()
+		defer mu.Unlock()
+		seqs = append(seqs, res.Seq)
+		w.WriteHeader(status)
+	}))
+	defer coordinator.Close()
+
+	a := NewAgent(s, AgentInfo{Name: "foo", URL: "http://foo:8462"}, coordinator.URL, "")
+	a.running[1] = nil
+	a.running[2] = nil
+	a.reported(AgentResult{Seq: 1}, errors.New("connection refused"))
+	a.reported(AgentResult{Seq: 2}, errors.New("connection refused"))
+
+	// results are kept until they're reported
+	a.reportUnsent(context.Background())
+	assertEq(len(a.unsent), 2, t)
+	assertEq(len(a.running), 2, t)
+
+	mu.Lock()
+	status = http.StatusNoContent
+	mu.Unlock()
+	a.reportUnsent(context.Background())
+	assertEq(len(a.unsent), 0, t)
+	assertEq(len(a.running), 0, t)
+	assertEq(len(seqs), 4, t)
+
+	// results that the coordinator doesn't wait for are dropped
+	mu.Lock()
+	status = http.StatusNotFound
+	mu.Unlock()
+	a.running[3] = nil
+	a.reported(AgentResult{Seq: 3}, errors.New("connection refused"))
+	a.reportUnsent(context.Background())
+	assertEq(len(a.unsent), 0, t)
+	assertEq(len(a.running), 0, t)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/skroutz/mistry/pkg/utils"
+)
+
+// artifactEncodings are the content encodings in which the artifacts archive
+// can be served, in order of preference.
+var artifactEncodings = []string{"zstd", "gzip"}
+
+// negotiateEncoding returns the most preferred encoding of artifactEncodings
+// that is acceptable according to the value of an Accept-Encoding header. An
+// empty string is returned if the archive should be served uncompressed.
+func negotiateEncoding(acceptEncoding string) string {
+	accepted := make(map[string]bool)
+
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "q=") {
+				v, err := strconv.ParseFloat(strings.TrimPrefix(f, "q="), 64)
+				if err == nil {
+					q = v
+				}
+			}
+		}
+		accepted[coding] = q > 0
+	}
+
+	for _, enc := range artifactEncodings {
+		if accepted[enc] {
+			return enc
+		}
+	}
+	return ""
+}
+
+// artifactsArchivePath returns the path of the artifacts archive of the
+// build found at buildPath, in the given encoding.
+func artifactsArchivePath(buildPath, encoding string) string {
+	path := filepath.Join(buildPath, ArtifactsArchiveFname)
+
+	switch encoding {
+	case "gzip":
+		path += ".gz"
+	case "zstd":
+		path += ".zst"
+	}
+	return path
+}
+
+// EnsureArtifactsArchive creates the archive of the artifacts of the ready
+// build found at buildPath in the given encoding, unless it already exists,
+// and returns its path.
+//
+// Archives are created once and then reused, since ready builds never
+// change. This also makes the archives suitable for serving byte ranges.
+func EnsureArtifactsArchive(buildPath, encoding string) (string, error) {
+	path := artifactsArchivePath(buildPath, encoding)
+
+	_, err := os.Stat(path)
+	if err == nil {
+		return path, nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	// concurrent requests may create the same archive; writing to a
+	// temporary file and renaming it guarantees that readers never see
+	// a partial archive
+	tmp, err := ioutil.TempFile(buildPath, ArtifactsArchiveFname+".tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	err = writeArtifactsArchive(filepath.Join(buildPath, DataDir, ArtifactsDir), encoding, tmp)
+	if err != nil {
+		tmp.Close()
+		return "", err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return "", err
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// writeArtifactsArchive writes to w a tar archive of the directory denoted
+// by root, compressed in the given encoding.
+func writeArtifactsArchive(root, encoding string, w io.Writer) error {
+	var (
+		cw  io.WriteCloser
+		err error
+	)
+
+	switch encoding {
+	case "gzip":
+		cw = gzip.NewWriter(w)
+	case "zstd":
+		cw, err = zstd.NewWriter(w)
+		if err != nil {
+			return err
+		}
+	default:
+		return utils.ArchiveDir(root, w)
+	}
+
+	err = utils.ArchiveDir(root, cw)
+	if err != nil {
+		cw.Close()
+		return err
+	}
+
+	return cw.Close()
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Role is a level of access to a project. Each role includes the permissions
+// of the roles before it.
+type Role string
+
+const (
+	// RoleView allows viewing the jobs of a project, along with their logs
+	// and artifacts.
+	RoleView Role = "view"
+
+	// RoleBuild allows scheduling builds of a project.
+	RoleBuild Role = "build"
+
+	// RoleAdmin allows administering the jobs of a project (eg.
+	// cancelling them).
+	RoleAdmin Role = "admin"
+)
+
+// AllProjects is the key of TokenConfig.Projects that applies to all
+// projects.
+const AllProjects = "*"
+
+func (r Role) level() int {
+	switch r {
+	case RoleView:
+		return 1
+	case RoleBuild:
+		return 2
+	case RoleAdmin:
+		return 3
+	default:
+		return 0
+	}
+}
+
+// TokenConfig is an API token and the projects it grants access to.
+type TokenConfig struct {
+	// Name identifies the holder of the token. It is recorded as the
+	// requester of the builds scheduled with the token.
+	Name string `json:"name"`
+
+	Token string `json:"token"`
+
+	// Projects maps projects to the role granted on them. The AllProjects
+	// key applies to all projects.
+	Projects map[string]Role `json:"projects"`
+}
+
+// Allows returns true if t grants role on project.
+func (t *TokenConfig) Allows(project string, role Role) bool {
+	granted := t.Projects[project]
+	if all := t.Projects[AllProjects]; all.level() > granted.level() {
+		granted = all
+	}
+	return granted.level() >= role.level()
+}
+
+func validateTokens(tokens []TokenConfig) error {
+	names := make(map[string]bool)
+
+	for _, t := range tokens {
+		if t.Name == "" {
+			return errors.New("tokens must have a name")
+		}
+		if names[t.Name] {
+			return fmt.Errorf("duplicate token name '%s'", t.Name)
+		}
+		names[t.Name] = true
+
+		if t.Token == "" {
+			return fmt.Errorf("token '%s' cannot be empty", t.Name)
+		}
+		for p, r := range t.Projects {
+			if r.level() == 0 {
+				return fmt.Errorf("unknown role '%s' of token '%s' for project '%s'", r, t.Name, p)
+			}
+		}
+	}
+	return nil
+}
+
+// authenticate returns the configured token that r was made with, or nil if
+// authentication is disabled. The token is read from the Authorization
+// header, or the access_token query parameter (eg. for browsers).
+func (s *Server) authenticate(r *http.Request) (*TokenConfig, error) {
+	if len(s.cfg.Tokens) == 0 {
+		return nil, nil
+	}
+
+	token := r.URL.Query().Get("access_token")
+	if h := r.Header.Get("Authorization"); h != "" {
+		if !strings.HasPrefix(h, "Bearer ") {
+			return nil, errors.New("expected a Bearer token")
+		}
+		token = strings.TrimPrefix(h, "Bearer ")
+	}
+	if token == "" {
+		return nil, errors.New("missing token")
+	}
+
+	for i, t := range s.cfg.Tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t.Token)) == 1 {
+			return &s.cfg.Tokens[i], nil
+		}
+	}
+	return nil, errors.New("invalid token")
+}
+
+// authorize checks that r is allowed role on project and returns the name
+// of the requester, which is empty if authentication is disabled. Otherwise,
+// it responds with an appropriate error and returns false.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, project string, role Role) (string, bool) {
+	t, err := s.authenticate(r)
+	if err != nil {
+		unauthorized(w, err)
+		return "", false
+	}
+	if t == nil {
+		return "", true
+	}
+
+	if !t.Allows(project, role) {
+		http.Error(w, fmt.Sprintf("Token '%s' is not allowed to %s project '%s'", t.Name, role, project),
+			http.StatusForbidden)
+		return "", false
+	}
+	return t.Name, true
+}
+
+// requireToken wraps h so that it's only served to authenticated requests.
+func (s *Server) requireToken(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := s.authenticate(r)
+		if err != nil {
+			unauthorized(w, err)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func unauthorized(w http.ResponseWriter, err error) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="mistry"`)
+	http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+}
+
+// visibleProjects returns the projects that r is allowed to view, or nil if
+// it's allowed to view all of them.
+func (s *Server) visibleProjects(r *http.Request) (map[string]bool, error) {
+	t, err := s.authenticate(r)
+	if err != nil || t == nil || t.Allows(AllProjects, RoleView) {
+		return nil, err
+	}
+
+	projects := make(map[string]bool)
+	for p := range t.Projects {
+		if t.Allows(p, RoleView) {
+			projects[p] = true
+		}
+	}
+	return projects, nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skroutz/mistry/pkg/types"
+)
+
+var testTokens = []TokenConfig{
+	{Name: "ci", Token: "ci-token", Projects: map[string]Role{"simple": RoleBuild, "other": RoleView}},
+	{Name: "ops", Token: "ops-token", Projects: map[string]Role{AllProjects: RoleAdmin}},
+}
+
+// newAuthServer returns a server without workers that requires testTokens,
+// operating on a build path of its own.
+func newAuthServer(t *testing.T) (*Server, func()) {
+	cfg := *testcfg
+	cfg.Concurrency = 0
+	cfg.Backlog = 10
+	cfg.Tokens = testTokens
+	path, err := ioutil.TempDir("", "mistry-test-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.BuildPath = path
+
+	s, err := NewServer(&cfg, nil, false)
+	if err != nil {
+		os.RemoveAll(path)
+		t.Fatal(err)
+	}
+
+	return s, func() {
+		s.workerPool.Stop()
+		s.index.Close()
+		s.journal.Close()
+		os.RemoveAll(path)
+	}
+}
+
+func TestTokenConfigAllows(t *testing.T) {
+	ci, ops := testTokens[0], testTokens[1]
+
+	cases := []struct {
+		token   TokenConfig
+		project string
+		role    Role
+		allowed bool
+	}{
+		{ci, "simple", RoleView, true},
+		{ci, "simple", RoleBuild, true},
+		{ci, "simple", RoleAdmin, false},
+		{ci, "other", RoleView, true},
+		{ci, "other", RoleBuild, false},
+		{ci, "unknown", RoleView, false},
+		{ops, "unknown", RoleAdmin, true},
+	}
+
+	for _, c := range cases {
+		actual := c.token.Allows(c.project, c.role)
+		if actual != c.allowed {
+			t.Errorf("expected %s allowed to %s %s to be %v, got %v",
+				c.token.Name, c.role, c.project, c.allowed, actual)
+		}
+	}
+}
+
+func TestValidateTokens(t *testing.T) {
+	err := validateTokens(testTokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := [][]TokenConfig{
+		{{Token: "foo"}},
+		{{Name: "foo"}},
+		{{Name: "foo", Token: "foo"}, {Name: "foo", Token: "bar"}},
+		{{Name: "foo", Token: "foo", Projects: map[string]Role{"simple": "owner"}}},
+	}
+	for _, tokens := range invalid {
+		err := validateTokens(tokens)
+		if err == nil {
+			t.Errorf("expected error for %v", tokens)
+		}
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	s, cleanup := newAuthServer(t)
+	defer cleanup()
+
+	cases := []struct {
+		method   string
+		path     string
+		token    string
+		expected int
+	}{
+		{"GET", "/jobs/simple/foo", "", 401},
+		{"GET", "/jobs/simple/foo", "invalid", 401},
+		{"GET", "/jobs/simple/foo", "ci-token", 404},
+		{"GET", "/jobs/unknown/foo", "ci-token", 403},
+		{"DELETE", "/jobs/simple/foo", "ci-token", 403},
+		{"DELETE", "/jobs/simple/foo", "ops-token", 404},
+		{"GET", "/jobs/simple/foo/artifacts", "", 401},
+		{"GET", "/index/?project=unknown", "ci-token", 403},
+		{"GET", "/metrics", "", 401},
+		{"GET", "/metrics", "ci-token", 200},
+	}
+
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(c.method, c.path, nil)
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		s.srv.Handler.ServeHTTP(rec, req)
+
+		if rec.Code != c.expected {
+			t.Errorf("%s %s with token '%s': expected %d, got %d (%s)",
+				c.method, c.path, c.token, c.expected, rec.Code, rec.Body)
+		}
+		if rec.Code == 401 && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s %s: expected WWW-Authenticate header", c.method, c.path)
+		}
+	}
+
+	// browsers authenticate using the query string
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/jobs/simple/foo?access_token=ci-token", nil)
+	s.srv.Handler.ServeHTTP(rec, req)
+	assertEq(rec.Code, 404, t)
+
+	// health checks are public, so that load balancers can probe them
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/healthz", nil)
+	s.srv.Handler.ServeHTTP(rec, req)
+	assertNotEq(rec.Code, 401, t)
+}
+
+func TestHandleIndexVisibleProjects(t *testing.T) {
+	s, cleanup := newAuthServer(t)
+	defer cleanup()
+
+	for _, project := range []string{"simple", "other", "hidden"} {
+		bi := types.NewBuildInfo()
+		bi.StartedAt = time.Now()
+		err := s.index.Put(project, "abc", "ready", bi)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/index/", nil)
+	req.Header.Set("Authorization", "Bearer ci-token")
+	s.srv.Handler.ServeHTTP(rec, req)
+	assertEq(rec.Code, 200, t)
+
+	var page struct {
+		Jobs []Job `json:"jobs"`
+	}
+	err := json.Unmarshal(rec.Body.Bytes(), &page)
+	if err != nil {
+		t.Fatalf("cannot unmarshal %s; %s", rec.Body, err)
+	}
+
+	projects := make(map[string]bool)
+	for _, j := range page.Jobs {
+		projects[j.Project] = true
+	}
+	assertEq(len(page.Jobs), 2, t)
+	assertEq(projects["simple"] && projects["other"], true, t)
+}
+
+func TestNewJobRequestedBy(t *testing.T) {
+	s, cleanup := newAuthServer(t)
+	defer cleanup()
+
+	newJob := func(project, token string) int {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/jobs?async", strings.NewReader(`{"project": "`+project+`"}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		s.srv.Handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assertEq(newJob("simple", "ci-token"), 201, t)
+
+	// ci may only view the jobs of other
+	assertEq(newJob("other", "ci-token"), 403, t)
+
+	entries, err := s.journal.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(len(entries), 1, t)
+	assertEq(entries[0].RequestedBy, "ci", t)
+}
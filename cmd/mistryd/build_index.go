@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/skroutz/mistry/pkg/types"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// jobsBucket maps "<project>/<id>" keys to the indexed jobs
+	jobsBucket = []byte("jobs")
+
+	// startedBucket contains the keys of all jobs, prefixed with their
+	// start time, so that they can be traversed in chronological order
+	startedBucket = []byte("started")
+
+	// projectsBucket contains one bucket per project, with the same
+	// contents as startedBucket, but only for the jobs of that project
+	projectsBucket = []byte("projects")
+
+	errJobNotFound = errors.New("job not found")
+)
+
+// BuildIndex is an on-disk index of the pending and ready builds found in a
+// build path, so that jobs can be looked up and listed without scanning the
+// filesystem. It is kept up to date by Server.Work and can be rebuilt from
+// the filesystem at any time using Rebuild.
+type BuildIndex struct {
+	db        *sharedDB
+	buildPath string
+}
+
+// indexedJob is the value stored in jobsBucket.
+type indexedJob struct {
+	State     string
+	BuildInfo *types.BuildInfo
+}
+
+// OpenBuildIndex opens the index of the builds found in buildPath, creating it
+// if it doesn't exist. A new index is populated from the existing builds.
+//
+// Servers operating on the same build path share the same BuildIndex, which
+// is closed when all of them have closed it.
+func OpenBuildIndex(buildPath string) (*BuildIndex, error) {
+	idx := &BuildIndex{buildPath: buildPath}
+	path := filepath.Join(buildPath, BuildIndexFname)
+
+	db, err := openSharedDB(path, func(db *sharedDB) error {
+		var created bool
+		err := db.View(func(tx *bolt.Tx) error {
+			created = tx.Bucket(jobsBucket) == nil
+			return nil
+		})
+		if err == nil && created {
+			idx.db = db
+			_, err = idx.Rebuild()
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot open build index %s; %s", path, err)
+	}
+	idx.db = db
+
+	return idx, nil
+}
+
+// Close closes the index, once it's closed by all of its users.
+func (idx *BuildIndex) Close() error {
+	return idx.db.Close()
+}
+
+// Put indexes the job of project denoted by id in the given state ("pending"
+// or "ready"), replacing any previous entry of it.
+func (idx *BuildIndex) Put(project, id, state string, bi *types.BuildInfo) error {
+	return idx.db.Update(func(tx *bolt.Tx) error {
+		return putJob(tx, project, id, state, bi)
+	})
+}
+
+// PutPending indexes the job of project denoted by id as pending, unless it's
+// already indexed as ready.
+func (idx *BuildIndex) PutPending(project, id string, bi *types.BuildInfo) error {
+	return idx.db.Update(func(tx *bolt.Tx) error {
+		v := tx.Bucket(jobsBucket).Get(jobKey(project, id))
+		if v != nil {
+			j, err := decodeJob(project, id, v)
+			if err != nil {
+				return err
+			}
+			if j.State == "ready" {
+				return nil
+			}
+		}
+		return putJob(tx, project, id, "pending", bi)
+	})
+}
+
+// Delete removes the job of project denoted by id from the index, if it
+// exists.
+func (idx *BuildIndex) Delete(project, id string) error {
+	return idx.db.Update(func(tx *bolt.Tx) error {
+		return deleteJob(tx, project, id)
+	})
+}
+
+// Get returns the indexed job of project denoted by id, or errJobNotFound.
+func (idx *BuildIndex) Get(project, id string) (Job, error) {
+	var j Job
+
+	err := idx.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(jobsBucket).Get(jobKey(project, id))
+		if v == nil {
+			return errJobNotFound
+		}
+
+		var err error
+		j, err = decodeJob(project, id, v)
+		return err
+	})
+
+	return j, err
+}
+
+// List returns the jobs that match f, in the order and from the position
+// denoted by f, up to f.Limit. It also returns the cursor of the next page, or
+// nil if there are no more jobs.
+//
+// Only the relevant range of the index is traversed, so listing doesn't get
+// slower as the build history grows.
+func (idx *BuildIndex) List(f JobFilter) ([]Job, *JobCursor, error) {
+	jobs := []Job{}
+	var next *JobCursor
+
+	err := idx.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(startedBucket)
+		if f.Project != "" {
+			b = tx.Bucket(projectsBucket).Bucket([]byte(f.Project))
+			if b == nil {
+				return nil
+			}
+		}
+		jb := tx.Bucket(jobsBucket)
+
+		c := b.Cursor()
+		step := c.Next
+		if !f.Ascending {
+			step = c.Prev
+		}
+
+		for k := seek(c, f); k != nil; k, _ = step() {
+			started := time.Unix(0, int64(binary.BigEndian.Uint64(k[:8])))
+			if f.Ascending && !f.Until.IsZero() && !started.Before(f.Until) {
+				break
+			}
+			if !f.Ascending && !f.Since.IsZero() && started.Before(f.Since) {
+				break
+			}
+
+			project, id := splitJobKey(k[8:])
+			j, err := decodeJob(project, id, jb.Get(k[8:]))
+			if err != nil {
+				return err
+			}
+			if !f.Match(j) {
+				continue
+			}
+
+			if len(jobs) == f.Limit {
+				last := jobs[len(jobs)-1]
+				next = &JobCursor{StartedAt: last.StartedAt, Project: last.Project, ID: last.ID}
+				break
+			}
+			jobs = append(jobs, j)
+		}
+		return nil
+	})
+
+	return jobs, next, err
+}
+
+// seek positions c at the first key to be visited according to the order,
+// the cursor and the time range of f, and returns it.
+func seek(c *bolt.Cursor, f JobFilter) []byte {
+	var start []byte
+	if f.Cursor != nil {
+		start = startedKey(f.Cursor.StartedAt, f.Cursor.Project, f.Cursor.ID)
+	}
+
+	if f.Ascending {
+		if start == nil && !f.Since.IsZero() {
+			start = timeKey(f.Since)
+		}
+		if start == nil {
+			k, _ := c.First()
+			return k
+		}
+
+		k, _ := c.Seek(start)
+		if f.Cursor != nil && bytes.Equal(k, start) {
+			k, _ = c.Next()
+		}
+		return k
+	}
+
+	if start == nil && !f.Until.IsZero() {
+		start = timeKey(f.Until)
+	}
+	if start == nil {
+		k, _ := c.Last()
+		return k
+	}
+
+	// position at the last key that is before start
+	k, _ := c.Seek(start)
+	if k == nil {
+		k, _ = c.Last()
+		return k
+	}
+	k, _ = c.Prev()
+	return k
+}
+
+// Rebuild discards the contents of the index and populates it from the
+// pending and ready builds found in the build path. Builds without a readable
+// build info are skipped. It returns the number of builds indexed.
+func (idx *BuildIndex) Rebuild() (int, error) {
+	n := 0
+
+	err := idx.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{jobsBucket, startedBucket, projectsBucket} {
+			err := tx.DeleteBucket(name)
+			if err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+			_, err = tx.CreateBucket(name)
+			if err != nil {
+				return err
+			}
+		}
+
+		projects, err := ioutil.ReadDir(idx.buildPath)
+		if err != nil {
+			return fmt.Errorf("cannot scan projects; %s", err)
+		}
+
+		for _, p := range projects {
+			if !p.IsDir() {
+				continue
+			}
+
+			for _, state := range []string{"pending", "ready"} {
+				statePath := filepath.Join(idx.buildPath, p.Name(), state)
+				builds, err := ioutil.ReadDir(statePath)
+				if err != nil {
+					if os.IsNotExist(err) {
+						continue
+					}
+					return fmt.Errorf("cannot scan %s jobs of project %s; %s", state, p.Name(), err)
+				}
+
+				for _, b := range builds {
+					bi, err := ReadJobBuildInfo(filepath.Join(statePath, b.Name()), false)
+					if err != nil {
+						// eg. the server crashed before the
+						// build info of the job was persisted
+						log.Printf("[index] Skipping %s job %s of project %s; %s", state, b.Name(), p.Name(), err)
+						continue
+					}
+
+					err = putJob(tx, p.Name(), b.Name(), state, bi)
+					if err != nil {
+						return err
+					}
+					n++
+				}
+			}
+		}
+		return nil
+	})
+
+	return n, err
+}
+
+func putJob(tx *bolt.Tx, project, id, state string, bi *types.BuildInfo) error {
+	// the job may be re-run (eg. if it previously failed), in which case
+	// its start time changes
+	err := deleteJob(tx, project, id)
+	if err != nil {
+		return err
+	}
+
+	// logs are read from the build directory on demand
+	stripped := *bi
+	stripped.ContainerStdouterr = ""
+	stripped.ContainerStderr = ""
+
+	v, err := json.Marshal(indexedJob{State: state, BuildInfo: &stripped})
+	if err != nil {
+		return err
+	}
+
+	err = tx.Bucket(jobsBucket).Put(jobKey(project, id), v)
+	if err != nil {
+		return err
+	}
+
+	k := startedKey(bi.StartedAt, project, id)
+	err = tx.Bucket(startedBucket).Put(k, nil)
+	if err != nil {
+		return err
+	}
+
+	pb, err := tx.Bucket(projectsBucket).CreateBucketIfNotExists([]byte(project))
+	if err != nil {
+		return err
+	}
+	return pb.Put(k, nil)
+}
+
+func deleteJob(tx *bolt.Tx, project, id string) error {
+	jb := tx.Bucket(jobsBucket)
+
+	v := jb.Get(jobKey(project, id))
+	if v == nil {
+		return nil
+	}
+
+	j, err := decodeJob(project, id, v)
+	if err != nil {
+		return err
+	}
+
+	k := startedKey(j.StartedAt, project, id)
+	err = tx.Bucket(startedBucket).Delete(k)
+	if err != nil {
+		return err
+	}
+
+	pb := tx.Bucket(projectsBucket).Bucket([]byte(project))
+	if pb != nil {
+		err = pb.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+
+	return jb.Delete(jobKey(project, id))
+}
+
+func decodeJob(project, id string, v []byte) (Job, error) {
+	var ij indexedJob
+
+	err := json.Unmarshal(v, &ij)
+	if err != nil {
+		return Job{}, fmt.Errorf("cannot decode indexed job %s of project %s; %s", id, project, err)
+	}
+
+	return Job{
+		ID:        id,
+		Project:   project,
+		StartedAt: ij.BuildInfo.StartedAt,
+		State:     ij.State,
+		BuildInfo: ij.BuildInfo}, nil
+}
+
+func jobKey(project, id string) []byte {
+	return []byte(project + "/" + id)
+}
+
+func splitJobKey(k []byte) (string, string) {
+	parts := strings.SplitN(string(k), "/", 2)
+	return parts[0], parts[1]
+}
+
+// timeKey encodes t so that keys sort chronologically. Times before the Unix
+// epoch are all encoded as the epoch.
+func timeKey(t time.Time) []byte {
+	k := make([]byte, 8)
+	if t.After(time.Unix(0, 0)) {
+		binary.BigEndian.PutUint64(k, uint64(t.UnixNano()))
+	}
+	return k
+}
+
+func startedKey(t time.Time, project, id string) []byte {
+	return append(timeKey(t), jobKey(project, id)...)
+}
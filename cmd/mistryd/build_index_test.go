@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/skroutz/mistry/pkg/types"
+)
+
+func openTestIndex(t *testing.T) (*BuildIndex, string) {
+	path, err := ioutil.TempDir("", "mistry-test-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err := OpenBuildIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return idx, path
+}
+
+func TestBuildIndexList(t *testing.T) {
+	idx, path := openTestIndex(t)
+	defer os.RemoveAll(path)
+	defer idx.Close()
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		bi := types.NewBuildInfo()
+		bi.ExitCode = i % 2
+		bi.StartedAt = start.Add(time.Duration(i) * time.Minute)
+		err := idx.Put("foo", string(rune('a'+i)), "ready", bi)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	bi := types.NewBuildInfo()
+	bi.StartedAt = start.Add(90 * time.Second)
+	err := idx.Put("bar", "z", "pending", bi)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := func(jobs []Job) []string {
+		res := []string{}
+		for _, j := range jobs {
+			res = append(res, j.ID)
+		}
+		return res
+	}
+
+	f := JobFilter{Project: "foo", Limit: 2}
+	page, next, err := idx.List(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(ids(page), []string{"e", "d"}, t)
+
+	// the cursor survives encoding
+	f.Cursor, err = ParseJobCursor(next.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, next, err = idx.List(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(ids(page), []string{"c", "b"}, t)
+
+	f.Cursor = next
+	page, next, err = idx.List(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(ids(page), []string{"a"}, t)
+	if next != nil {
+		t.Fatalf("expected no more pages, got %v", next)
+	}
+
+	// all projects, ascending, in a time range
+	f = JobFilter{Limit: 10, Ascending: true, Since: start.Add(time.Minute), Until: start.Add(3 * time.Minute)}
+	page, _, err = idx.List(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(ids(page), []string{"b", "z", "c"}, t)
+
+	failed := 1
+	f = JobFilter{Limit: 10, ExitCode: &failed, State: "ready"}
+	page, _, err = idx.List(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(ids(page), []string{"d", "b"}, t)
+
+	page, _, err = idx.List(JobFilter{Project: "idontexist", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(len(page), 0, t)
+}
+
+func TestBuildIndexPut(t *testing.T) {
+	idx, path := openTestIndex(t)
+	defer os.RemoveAll(path)
+	defer idx.Close()
+
+	bi := types.NewBuildInfo()
+	bi.StartedAt = time.Now()
+	bi.ContainerStdouterr = "logs"
+	err := idx.Put("foo", "abc", "pending", bi)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := idx.Get("foo", "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(j.State, "pending", t)
+	assertEq(j.BuildInfo.ContainerStdouterr, "", t)
+
+	// re-running the build replaces its previous entry
+	bi.StartedAt = bi.StartedAt.Add(time.Hour)
+	bi.ExitCode = 0
+	err = idx.Put("foo", "abc", "ready", bi)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jobs, _, err := idx.List(JobFilter{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(len(jobs), 1, t)
+	assertEq(jobs[0].State, "ready", t)
+	assertEq(jobs[0].StartedAt.Equal(bi.StartedAt), true, t)
+
+	// ready builds are never marked as pending again
+	err = idx.PutPending("foo", "abc", types.NewBuildInfo())
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err = idx.Get("foo", "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(j.State, "ready", t)
+	assertEq(j.StartedAt.Equal(bi.StartedAt), true, t)
+
+	err = idx.Delete("foo", "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = idx.Get("foo", "abc")
+	assertEq(err, errJobNotFound, t)
+
+	jobs, _, err = idx.List(JobFilter{Project: "foo", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(len(jobs), 0, t)
+}
+
+func TestBuildIndexRebuild(t *testing.T) {
+	path, err := ioutil.TempDir("", "mistry-test-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	for _, b := range []struct{ state, id string }{{"pending", "abc"}, {"ready", "def"}, {"ready", "ghi"}} {
+		buildPath := filepath.Join(path, "foo", b.state, b.id)
+		err = os.MkdirAll(buildPath, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		biJSON, err := json.Marshal(types.NewBuildInfo())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filepath.Join(buildPath, BuildInfoFname), biJSON, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a new index is populated from the existing builds
+	idx, err := OpenBuildIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	j, err := idx.Get("foo", "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(j.State, "pending", t)
+
+	err = os.Rename(filepath.Join(path, "foo", "pending", "abc"), filepath.Join(path, "foo", "ready", "abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.Put("foo", "stale", "ready", types.NewBuildInfo())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// builds without a build info are skipped
+	err = os.MkdirAll(filepath.Join(path, "foo", "pending", "crashed"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := idx.Rebuild()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(n, 3, t)
+
+	j, err = idx.Get("foo", "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(j.State, "ready", t)
+	_, err = idx.Get("foo", "stale")
+	assertEq(err, errJobNotFound, t)
+	_, err = idx.Get("foo", "crashed")
+	assertEq(err, errJobNotFound, t)
+}
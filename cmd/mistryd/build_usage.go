@@ -0,0 +1,93 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// buildUsageGrace is how long a ready build is protected from pruning after
+// it was last served, so that clients have the time to download it (eg. with
+// rsync after receiving the result of a build).
+const buildUsageGrace = 30 * time.Minute
+
+// BuildUsage tracks the ready builds that are being served, so that they're
+// not pruned while they're in use. Builds are denoted by their path.
+type BuildUsage struct {
+	mu sync.Mutex
+
+	// readers are the number of requests currently using each build
+	readers map[string]int
+
+	// lastUsed is when each build was last used
+	lastUsed map[string]time.Time
+
+	// removing are the builds that are being removed, which cannot be
+	// used anymore
+	removing map[string]bool
+}
+
+// NewBuildUsage returns a new BuildUsage.
+func NewBuildUsage() *BuildUsage {
+	return &BuildUsage{
+		readers:  make(map[string]int),
+		lastUsed: make(map[string]time.Time),
+		removing: make(map[string]bool),
+	}
+}
+
+// Use marks the build at path as used until release is called. It returns
+// false if the build is being removed, in which case it should be
+// considered missing.
+func (u *BuildUsage) Use(path string) (release func(), ok bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.removing[path] {
+		return nil, false
+	}
+	u.readers[path]++
+	u.lastUsed[path] = time.Now()
+
+	return func() {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+
+		u.readers[path]--
+		if u.readers[path] == 0 {
+			delete(u.readers, path)
+		}
+		u.lastUsed[path] = time.Now()
+	}, true
+}
+
+// Touch records that the build at path was used just now, eg. because its
+// result was returned to a client that will download it.
+func (u *BuildUsage) Touch(path string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.lastUsed[path] = time.Now()
+}
+
+// Remove calls remove to remove the build at path, unless the build is in
+// use or was used in the last buildUsageGrace. It returns false if the build
+// was not removed because of that. The build cannot be used while it's
+// being removed.
+func (u *BuildUsage) Remove(path string, remove func() error) (bool, error) {
+	u.mu.Lock()
+	if u.readers[path] > 0 || time.Since(u.lastUsed[path]) < buildUsageGrace {
+		u.mu.Unlock()
+		return false, nil
+	}
+	u.removing[path] = true
+	u.mu.Unlock()
+
+	err := remove()
+
+	u.mu.Lock()
+	delete(u.removing, path)
+	delete(u.lastUsed, path)
+	u.mu.Unlock()
+
+	return err == nil, err
+}
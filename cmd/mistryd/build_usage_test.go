@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestBuildUsage(t *testing.T) {
+	u := NewBuildUsage()
+
+	removed, err := u.Remove("a", func() error { return nil })
+	failIfError(err, t)
+	assertEq(removed, true, t)
+
+	release, ok := u.Use("a")
+	assertEq(ok, true, t)
+	removed, err = u.Remove("a", func() error {
+		t.Fatal("expected build in use not to be removed")
+		return nil
+	})
+	failIfError(err, t)
+	assertEq(removed, false, t)
+
+	// recently used builds are not removed either
+	release()
+	removed, _ = u.Remove("a", func() error { return nil })
+	assertEq(removed, false, t)
+
+	u.Touch("b")
+	removed, _ = u.Remove("b", func() error { return nil })
+	assertEq(removed, false, t)
+
+	// builds cannot be used while they're being removed
+	removed, err = u.Remove("c", func() error {
+		_, ok := u.Use("c")
+		assertEq(ok, false, t)
+		return errors.New("failed")
+	})
+	assertEq(removed, false, t)
+	assertEq(err.Error(), "failed", t)
+	_, ok = u.Use("c")
+	assertEq(ok, true, t)
+}
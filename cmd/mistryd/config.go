@@ -3,15 +3,35 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strconv"
+	"time"
 
 	"github.com/skroutz/mistry/pkg/filesystem"
+	"github.com/skroutz/mistry/pkg/types"
 	"github.com/skroutz/mistry/pkg/utils"
 )
 
+// DefaultShutdownGracePeriod is the default value of
+// Config.ShutdownGracePeriod.
+const DefaultShutdownGracePeriod = 5 * time.Minute
+
+// DefaultPriorityAging is the default value of Config.PriorityAging.
+const DefaultPriorityAging = 1 * time.Minute
+
+// DefaultRetryPolicy is the retry policy used if none is configured: builds
+// are attempted up to 3 times if the Docker daemon failed to build the image,
+// the container could not be started or the filesystem failed.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	Delay:       Duration(5 * time.Second),
+	On:          []types.FailureKind{types.FailureImageBuild, types.FailureContainerStart, types.FailureFilesystem},
+}
+
 // Config holds the configuration values that the Server needs in order to
 // function.
 type Config struct {
@@ -23,8 +43,213 @@ type Config struct {
 	BuildPath    string            `json:"build_path"`
 	Mounts       map[string]string `json:"mounts"`
 
+	// AllowedMounts are the directories of the host whose contents may be
+	// mounted by the mounts of project settings. Projects may not mount
+	// anything if it's empty.
+	AllowedMounts []string `json:"allowed_mounts"`
+
+	// SecretsPath is the directory containing the secrets that may be
+	// granted to projects, one file per secret.
+	SecretsPath string `json:"secrets_path"`
+
 	Concurrency int `json:"job_concurrency"`
 	Backlog     int `json:"job_backlog"`
+
+	// BacklogWait is how long a build request waits for room in a full
+	// backlog before it's rejected. Zero means requests are rejected
+	// immediately.
+	BacklogWait Duration `json:"backlog_wait"`
+
+	// BuildTimeout is the default maximum duration of a build. Zero
+	// means no timeout.
+	BuildTimeout Duration `json:"build_timeout"`
+
+	// MaxBuildTimeout caps the timeout of all builds, including the ones
+	// requested by users. Zero means no cap.
+	MaxBuildTimeout Duration `json:"max_build_timeout"`
+
+	Projects map[string]ProjectConfig `json:"projects"`
+
+	// Resources are the default limits of build containers.
+	Resources Resources `json:"resources"`
+
+	// NetworkMode are the default network modes of builds. Both default
+	// to DefaultNetworkMode.
+	NetworkMode NetworkModes `json:"network_mode"`
+
+	// TransportMethod is the method that clients are advised to use for
+	// downloading build artifacts.
+	TransportMethod types.TransportMethod `json:"transport_method"`
+
+	// ShutdownGracePeriod is how long running builds are given to
+	// complete when the server is shutting down, before they are
+	// interrupted.
+	ShutdownGracePeriod Duration `json:"shutdown_grace_period"`
+
+	// RequeueInterrupted determines whether builds that were interrupted
+	// by a server shutdown are re-enqueued when the server starts again.
+	RequeueInterrupted RequeuePolicy `json:"requeue_interrupted"`
+
+	// PriorityAging is how long a queued job has to wait for its priority
+	// to be raised by one, so that low-priority jobs are eventually built
+	// even if higher-priority jobs keep coming.
+	PriorityAging Duration `json:"priority_aging"`
+
+	// Tokens are the API tokens that clients authenticate with. If there
+	// are no tokens, authentication is disabled.
+	Tokens []TokenConfig `json:"tokens"`
+
+	// Retry determines which failed builds are retried automatically.
+	Retry RetryPolicy `json:"retry"`
+
+	// Schedules are builds that run periodically, to keep the images and
+	// build caches of projects warm.
+	Schedules []ScheduleConfig `json:"schedules"`
+}
+
+// RequeuePolicy determines whether interrupted builds are re-enqueued.
+type RequeuePolicy string
+
+const (
+	// RequeueNever drops interrupted builds.
+	RequeueNever RequeuePolicy = "never"
+
+	// RequeueOnce re-enqueues interrupted builds, unless they were
+	// already interrupted before. This guards against builds that keep
+	// crashing the server.
+	RequeueOnce RequeuePolicy = "once"
+
+	// RequeueAlways re-enqueues interrupted builds.
+	RequeueAlways RequeuePolicy = "always"
+)
+
+// Allows returns true if a build that was interrupted the given number of
+// times should be re-enqueued.
+func (p RequeuePolicy) Allows(interruptions int) bool {
+	switch p {
+	case RequeueNever:
+		return interruptions == 0
+	case RequeueOnce:
+		return interruptions <= 1
+	default:
+		return true
+	}
+}
+
+// RetryPolicy determines whether builds that failed due to infrastructure
+// failures are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times a build is attempted,
+	// including the first one. 1 disables retries.
+	MaxAttempts int `json:"max_attempts"`
+
+	// Delay is how long to wait before the first retry. It is doubled
+	// before every subsequent one.
+	Delay Duration `json:"delay"`
+
+	// On are the kinds of failures that are retried. Only infrastructure
+	// failures may be retried.
+	On []types.FailureKind `json:"on"`
+}
+
+// Allows returns true if a build that failed with the given kind of failure
+// after the given number of attempts should be retried.
+func (p RetryPolicy) Allows(kind types.FailureKind, attempts int) bool {
+	if attempts >= p.MaxAttempts {
+		return false
+	}
+	for _, k := range p.On {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Backoff returns how long to wait before retrying a build that failed after
+// the given number of attempts. The delay stops growing after 10 retries.
+func (p RetryPolicy) Backoff(attempts int) time.Duration {
+	n := attempts - 1
+	if n > 10 {
+		n = 10
+	}
+	return time.Duration(p.Delay) << uint(n)
+}
+
+// ProjectConfig holds the settings of a particular project, overriding the
+// server-wide defaults.
+type ProjectConfig struct {
+	// Timeout is the default maximum duration of the project's builds.
+	Timeout Duration `json:"timeout"`
+
+	// MaxConcurrency is the maximum number of builds of the project that
+	// may run in parallel. Zero means no limit, other than the server's
+	// concurrency.
+	MaxConcurrency int `json:"max_concurrency"`
+
+	// Backlog is the maximum number of queued builds of the project. Zero
+	// means no limit, other than the server's backlog.
+	Backlog int `json:"backlog"`
+
+	// Weight is the share of the workers the project gets relative to
+	// other projects, when they all have builds queued. Zero means 1.
+	Weight int `json:"weight"`
+
+	// Resources are the limits of the project's build containers,
+	// overriding the ones of the server and of the project's settings.
+	Resources Resources `json:"resources"`
+
+	// NetworkMode are the network modes of the project's builds,
+	// overriding the ones of the server and of the project's settings.
+	NetworkMode NetworkModes `json:"network_mode"`
+
+	// Secrets are the names of the secrets in SecretsPath that are
+	// granted to the project. They're mounted read-only in SecretsDir
+	// inside its build containers and redacted from the build logs.
+	Secrets []string `json:"secrets"`
+}
+
+// ScheduleConfig describes a build that is scheduled to run periodically.
+// Scheduled builds are enqueued with the lowest priority.
+type ScheduleConfig struct {
+	// Name identifies the schedule. It defaults to the project.
+	Name    string `json:"name"`
+	Project string `json:"project"`
+
+	// Cron is when the build runs, in the standard 5-field cron format
+	// (see parseCron), in the local time zone of the server.
+	Cron string `json:"cron"`
+
+	Params types.Params      `json:"params"`
+	Env    map[string]string `json:"env"`
+	Group  string            `json:"group"`
+
+	spec *cronSpec
+}
+
+// Duration is a time.Duration that is configured using strings such as
+// "1h30m". See time.ParseDuration.
+type Duration time.Duration
+
+// UnmarshalJSON parses a Duration from a JSON string.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalJSON serializes d to a JSON string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
 }
 
 // ParseConfig accepts the listening address, a filesystem adapter and a
@@ -69,5 +294,166 @@ func ParseConfig(addr string, fs filesystem.FileSystem, r io.Reader) (*Config, e
 		cfg.Backlog = cfg.Concurrency * 2
 	}
 
+	if cfg.BacklogWait < 0 {
+		return nil, errors.New("backlog_wait cannot be negative")
+	}
+
+	if cfg.ShutdownGracePeriod == 0 {
+		cfg.ShutdownGracePeriod = Duration(DefaultShutdownGracePeriod)
+	}
+
+	if cfg.SecretsPath != "" {
+		err = utils.PathIsDir(cfg.SecretsPath)
+		if err != nil {
+			return nil, err
+		}
+		// secrets are bind-mounted, which requires absolute paths
+		cfg.SecretsPath, err = filepath.Abs(cfg.SecretsPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, dir := range cfg.AllowedMounts {
+		if !filepath.IsAbs(dir) {
+			return nil, fmt.Errorf("allowed mount '%s' must be absolute", dir)
+		}
+	}
+
+	err = cfg.Resources.validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid resources; %s", err)
+	}
+
+	err = cfg.NetworkMode.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	for name, p := range cfg.Projects {
+		if p.MaxConcurrency < 0 || p.Backlog < 0 || p.Weight < 0 {
+			return nil, fmt.Errorf("limits of project '%s' cannot be negative", name)
+		}
+		err = p.Resources.validate()
+		if err != nil {
+			return nil, fmt.Errorf("invalid resources of project '%s'; %s", name, err)
+		}
+		err = p.NetworkMode.validate()
+		if err != nil {
+			return nil, fmt.Errorf("project '%s': %s", name, err)
+		}
+		err = validateSecrets(cfg.SecretsPath, p.Secrets)
+		if err != nil {
+			return nil, fmt.Errorf("project '%s': %s", name, err)
+		}
+	}
+
+	if cfg.PriorityAging < 0 {
+		return nil, errors.New("priority_aging cannot be negative")
+	}
+	if cfg.PriorityAging == 0 {
+		cfg.PriorityAging = Duration(DefaultPriorityAging)
+	}
+
+	if cfg.Retry.MaxAttempts < 0 || cfg.Retry.Delay < 0 {
+		return nil, errors.New("retry settings cannot be negative")
+	}
+	if cfg.Retry.MaxAttempts == 0 {
+		cfg.Retry.MaxAttempts = DefaultRetryPolicy.MaxAttempts
+	}
+	if cfg.Retry.Delay == 0 {
+		cfg.Retry.Delay = DefaultRetryPolicy.Delay
+	}
+	if cfg.Retry.On == nil {
+		cfg.Retry.On = DefaultRetryPolicy.On
+	}
+	for _, k := range cfg.Retry.On {
+		if !k.Infrastructure() {
+			return nil, fmt.Errorf("failures of kind '%s' cannot be retried", k)
+		}
+	}
+
+	names := make(map[string]bool)
+	for i := range cfg.Schedules {
+		sc := &cfg.Schedules[i]
+		if sc.Project == "" {
+			return nil, errors.New("project of schedule cannot be empty")
+		}
+		if sc.Name == "" {
+			sc.Name = sc.Project
+		}
+		if names[sc.Name] {
+			return nil, fmt.Errorf("duplicate schedule '%s'", sc.Name)
+		}
+		names[sc.Name] = true
+
+		sc.spec, err = parseCron(sc.Cron)
+		if err != nil {
+			return nil, fmt.Errorf("schedule '%s': %s", sc.Name, err)
+		}
+	}
+
+	err = validateTokens(cfg.Tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	switch cfg.RequeueInterrupted {
+	case "":
+		cfg.RequeueInterrupted = RequeueOnce
+	case RequeueNever, RequeueOnce, RequeueAlways:
+	default:
+		return nil, fmt.Errorf("unknown requeue policy '%s'", cfg.RequeueInterrupted)
+	}
+
+	switch cfg.TransportMethod {
+	case "":
+		cfg.TransportMethod = types.Rsync
+	case types.Rsync, types.Scp, types.HTTP:
+	default:
+		return nil, fmt.Errorf("unknown transport method '%s'", cfg.TransportMethod)
+	}
+
 	return cfg, nil
 }
+
+// JobTimeout returns the timeout of a build of project, which has the given
+// settings, given the timeout requested by the user (if any). It falls back to
+// the project's default, as configured in the server and then in its
+// settings, and then to the server's default, and it's capped by
+// MaxBuildTimeout. Zero means no timeout.
+func (cfg *Config) JobTimeout(project string, ps ProjectSettings, requested time.Duration) time.Duration {
+	timeout := requested
+	if timeout <= 0 {
+		timeout = time.Duration(cfg.Projects[project].Timeout)
+	}
+	if timeout <= 0 {
+		timeout = time.Duration(ps.Timeout)
+	}
+	if timeout <= 0 {
+		timeout = time.Duration(cfg.BuildTimeout)
+	}
+
+	max := time.Duration(cfg.MaxBuildTimeout)
+	if max > 0 && (timeout <= 0 || timeout > max) {
+		timeout = max
+	}
+
+	return timeout
+}
+
+// JobResources returns the limits of the build containers of project, which
+// has the given settings. The server's defaults are overridden by the limits
+// in the project's settings, which are in turn overridden by the ones
+// configured for the project in the server.
+func (cfg *Config) JobResources(project string, ps ProjectSettings) Resources {
+	return cfg.Resources.Override(ps.Resources).Override(cfg.Projects[project].Resources)
+}
+
+// JobNetwork returns the network modes of the builds of project, which has
+// the given settings. They're overridden in the same order as the ones of
+// JobResources.
+func (cfg *Config) JobNetwork(project string, ps ProjectSettings) NetworkModes {
+	modes := NetworkModes{Build: DefaultNetworkMode, Run: DefaultNetworkMode}
+	return modes.Override(cfg.NetworkMode).Override(ps.NetworkMode).Override(cfg.Projects[project].NetworkMode)
+}
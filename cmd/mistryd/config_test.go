@@ -0,0 +1,132 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skroutz/mistry/pkg/types"
+)
+
+func TestParseConfigDurations(t *testing.T) {
+	cfgJSON := `{"projects_path": "testdata/projects", "build_path": "/tmp",
+		"build_timeout": "30m", "max_build_timeout": "1h",
+		"projects": {"simple": {"timeout": "5m"}}}`
+
+	cfg, err := ParseConfig("localhost:8462", nil, strings.NewReader(cfgJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEq(time.Duration(cfg.BuildTimeout), 30*time.Minute, t)
+	assertEq(time.Duration(cfg.MaxBuildTimeout), time.Hour, t)
+	assertEq(time.Duration(cfg.Projects["simple"].Timeout), 5*time.Minute, t)
+}
+
+func TestParseConfigProjectLimits(t *testing.T) {
+	cfgJSON := `{"projects_path": "testdata/projects", "build_path": "/tmp",
+		"projects": {"simple": {"max_concurrency": 2, "backlog": 10, "weight": 3}}}`
+
+	cfg, err := ParseConfig("localhost:8462", nil, strings.NewReader(cfgJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(cfg.Projects["simple"], ProjectConfig{MaxConcurrency: 2, Backlog: 10, Weight: 3}, t)
+
+	_, err = ParseConfig("localhost:8462", nil, strings.NewReader(`{"projects_path": "testdata/projects",
+		"build_path": "/tmp", "projects": {"simple": {"weight": -1}}}`))
+	if err == nil {
+		t.Fatal("expected error for negative weight")
+	}
+}
+
+func TestJobTimeout(t *testing.T) {
+	cfg := &Config{
+		BuildTimeout:    Duration(30 * time.Minute),
+		MaxBuildTimeout: Duration(time.Hour),
+		Projects:        map[string]ProjectConfig{"simple": {Timeout: Duration(5 * time.Minute)}},
+	}
+
+	assertEq(cfg.JobTimeout("simple", ProjectSettings{}, 0), 5*time.Minute, t)
+	assertEq(cfg.JobTimeout("simple", ProjectSettings{}, 10*time.Minute), 10*time.Minute, t)
+	assertEq(cfg.JobTimeout("other", ProjectSettings{}, 0), 30*time.Minute, t)
+	assertEq(cfg.JobTimeout("other", ProjectSettings{}, 2*time.Hour), time.Hour, t)
+
+	cfg.BuildTimeout = 0
+	assertEq(cfg.JobTimeout("other", ProjectSettings{}, 0), time.Hour, t)
+
+	cfg.MaxBuildTimeout = 0
+	assertEq(cfg.JobTimeout("other", ProjectSettings{}, 0), time.Duration(0), t)
+}
+
+func TestRequeuePolicy(t *testing.T) {
+	cfg, err := ParseConfig("localhost:8462", nil,
+		strings.NewReader(`{"projects_path": "testdata/projects", "build_path": "/tmp"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(cfg.RequeueInterrupted, RequeueOnce, t)
+
+	_, err = ParseConfig("localhost:8462", nil,
+		strings.NewReader(`{"projects_path": "testdata/projects", "build_path": "/tmp", "requeue_interrupted": "sometimes"}`))
+	if err == nil {
+		t.Fatal("expected error for unknown requeue policy")
+	}
+
+	assertEq(RequeueNever.Allows(0), true, t)
+	assertEq(RequeueNever.Allows(1), false, t)
+	assertEq(RequeueOnce.Allows(1), true, t)
+	assertEq(RequeueOnce.Allows(2), false, t)
+	assertEq(RequeueAlways.Allows(5), true, t)
+}
+
+func TestRetryPolicy(t *testing.T) {
+	cfg, err := ParseConfig("localhost:8462", nil,
+		strings.NewReader(`{"projects_path": "testdata/projects", "build_path": "/tmp"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(cfg.Retry, DefaultRetryPolicy, t)
+
+	cfg, err = ParseConfig("localhost:8462", nil, strings.NewReader(`{"projects_path": "testdata/projects",
+		"build_path": "/tmp", "retry": {"max_attempts": 2, "on": ["image_build"]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := cfg.Retry
+	assertEq(p.Allows(types.FailureImageBuild, 1), true, t)
+	assertEq(p.Allows(types.FailureImageBuild, 2), false, t)
+	assertEq(p.Allows(types.FailureContainerStart, 1), false, t)
+	assertEq(p.Backoff(1), 5*time.Second, t)
+	assertEq(p.Backoff(3), 20*time.Second, t)
+
+	_, err = ParseConfig("localhost:8462", nil, strings.NewReader(`{"projects_path": "testdata/projects",
+		"build_path": "/tmp", "retry": {"on": ["exit_code"]}}`))
+	if err == nil {
+		t.Fatal("expected error for retrying user failures")
+	}
+}
+
+func TestParseConfigSchedules(t *testing.T) {
+	cfg, err := ParseConfig("localhost:8462", nil, strings.NewReader(`{"projects_path": "testdata/projects",
+		"build_path": "/tmp", "schedules": [{"project": "simple", "cron": "@daily", "group": "latest"},
+		{"name": "nightly", "project": "simple", "cron": "0 3 * * *"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(len(cfg.Schedules), 2, t)
+	assertEq(cfg.Schedules[0].Name, "simple", t)
+	assertNotEq(cfg.Schedules[1].spec, (*cronSpec)(nil), t)
+
+	for _, schedules := range []string{
+		`[{"project": "simple", "cron": "0 25 * * *"}]`,
+		`[{"cron": "@daily"}]`,
+		`[{"project": "simple", "cron": "@daily"}, {"project": "simple", "cron": "@hourly"}]`,
+	} {
+		_, err = ParseConfig("localhost:8462", nil, strings.NewReader(`{"projects_path": "testdata/projects",
+			"build_path": "/tmp", "schedules": `+schedules+`}`))
+		if err == nil {
+			t.Fatalf("expected error for schedules %s", schedules)
+		}
+	}
+}
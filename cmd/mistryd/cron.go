@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSpec is a parsed cron expression. Each field is a bit set of the
+// values it matches.
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+
+	// domAny and dowAny are true if the day of month and day of week
+	// fields are "*". As in cron, if both are restricted, a day matches
+	// if either of them does.
+	domAny, dowAny bool
+}
+
+// cronField describes the range of values of a field of a cron expression.
+type cronField struct {
+	name     string
+	min, max int
+}
+
+var cronFields = []cronField{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+var cronShorthands = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+}
+
+// parseCron parses an expression in the standard 5-field cron format
+// (minute, hour, day of month, month and day of week). Fields may contain
+// "*", values, ranges ("1-5"), steps ("*/15", "0-30/10") and lists thereof
+// separated by commas. Days of week are 0 (Sunday) to 6, with 7 being
+// Sunday as well. The shorthands @hourly, @daily, @weekly, @monthly and
+// @yearly are also accepted.
+func parseCron(expr string) (*cronSpec, error) {
+	if s, ok := cronShorthands[expr]; ok {
+		expr = s
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("expected %d fields in cron expression '%s', got %d",
+			len(cronFields), expr, len(fields))
+	}
+
+	sets := make([]uint64, len(fields))
+	for i, f := range fields {
+		set, err := parseCronField(f, cronFields[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression '%s'; %s", expr, err)
+		}
+		sets[i] = set
+	}
+
+	spec := &cronSpec{
+		minute: sets[0],
+		hour:   sets[1],
+		dom:    sets[2],
+		month:  sets[3],
+		dow:    sets[4],
+		domAny: fields[2] == "*",
+		dowAny: fields[4] == "*",
+	}
+	if spec.dow&(1<<7) != 0 {
+		spec.dow |= 1
+	}
+	return spec, nil
+}
+
+func parseCronField(s string, f cronField) (uint64, error) {
+	var set uint64
+
+	for _, part := range strings.Split(s, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			rng = part[:i]
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %s '%s'", f.name, part)
+			}
+		}
+
+		lo, hi := f.min, f.max
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			lo, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return 0, fmt.Errorf("invalid %s '%s'", f.name, part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				hi, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return 0, fmt.Errorf("invalid %s '%s'", f.name, part)
+				}
+			} else if step > 1 {
+				// "5/10" means from 5 up to the maximum
+				hi = f.max
+			}
+		}
+		if lo < f.min || hi > f.max || lo > hi {
+			return 0, fmt.Errorf("%s '%s' is out of range %d-%d", f.name, part, f.min, f.max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+
+	return set, nil
+}
+
+// cronSearchLimit bounds the search for the next matching time, for
+// expressions that never match (eg. February 30).
+const cronSearchLimit = 5 * 366 * 24 * time.Hour
+
+// Next returns the first time after t that matches spec, in the location of
+// t, or the zero time if there is none within the next 5 years.
+func (spec *cronSpec) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(cronSearchLimit)
+
+	for t.Before(limit) {
+		if !spec.matches(spec.month, int(t.Month())) {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !spec.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !spec.matches(spec.hour, t.Hour()) {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if !spec.matches(spec.minute, t.Minute()) {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+
+	return time.Time{}
+}
+
+func (spec *cronSpec) matchesDay(t time.Time) bool {
+	dom := spec.matches(spec.dom, t.Day())
+	dow := spec.matches(spec.dow, int(t.Weekday()))
+
+	switch {
+	case spec.domAny:
+		return dow
+	case spec.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+func (spec *cronSpec) matches(set uint64, v int) bool {
+	return set&(1<<uint(v)) != 0
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	// a Wednesday
+	now := time.Date(2020, time.January, 15, 10, 30, 20, 0, time.UTC)
+
+	cases := []struct {
+		expr     string
+		expected time.Time
+	}{
+		{"* * * * *", time.Date(2020, time.January, 15, 10, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2020, time.January, 15, 10, 45, 0, 0, time.UTC)},
+		{"30 10 * * *", time.Date(2020, time.January, 16, 10, 30, 0, 0, time.UTC)},
+		{"0 3,4 * * *", time.Date(2020, time.January, 16, 3, 0, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", time.Date(2020, time.January, 15, 13, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2020, time.January, 16, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2020, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2020, time.January, 19, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 1-5", time.Date(2020, time.January, 16, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2020, time.February, 29, 0, 0, 0, 0, time.UTC)},
+
+		// either the day of month or the day of week must match
+		{"0 0 20 * 5", time.Date(2020, time.January, 17, 0, 0, 0, 0, time.UTC)},
+
+		// never matches
+		{"0 0 30 2 *", time.Time{}},
+	}
+
+	for _, c := range cases {
+		spec, err := parseCron(c.expr)
+		if err != nil {
+			t.Fatalf("%s: %s", c.expr, err)
+		}
+		actual := spec.Next(now)
+		if !actual.Equal(c.expected) {
+			t.Errorf("%s: expected %s, got %s", c.expr, c.expected, actual)
+		}
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *", "@often"} {
+		_, err := parseCron(expr)
+		if err == nil {
+			t.Errorf("expected error for '%s'", expr)
+		}
+	}
+}
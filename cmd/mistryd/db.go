@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	sharedDBsMu sync.Mutex
+	// the open databases, by path
+	sharedDBs = make(map[string]*sharedDB)
+)
+
+// sharedDB is a bolt database that may be opened many times in the same
+// process (eg. by servers operating on the same build path). bolt locks its
+// files exclusively, so opening the same file twice would block.
+type sharedDB struct {
+	*bolt.DB
+	path string
+
+	// guarded by sharedDBsMu
+	refs int
+}
+
+// openSharedDB opens the bolt database at path, creating it if it doesn't
+// exist, or returns it if it's already open. init is called when the
+// database is actually opened.
+func openSharedDB(path string, init func(db *sharedDB) error) (*sharedDB, error) {
+	sharedDBsMu.Lock()
+	defer sharedDBsMu.Unlock()
+
+	db, ok := sharedDBs[path]
+	if ok {
+		db.refs++
+		return db, nil
+	}
+
+	bdb, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	db = &sharedDB{DB: bdb, path: path, refs: 1}
+
+	err = init(db)
+	if err != nil {
+		bdb.Close()
+		return nil, err
+	}
+
+	sharedDBs[path] = db
+	return db, nil
+}
+
+// Close closes the database, once it's closed by all of its users.
+func (db *sharedDB) Close() error {
+	sharedDBsMu.Lock()
+	defer sharedDBsMu.Unlock()
+
+	db.refs--
+	if db.refs > 0 {
+		return nil
+	}
+	delete(sharedDBs, db.path)
+	return db.DB.Close()
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultDrainRetryAfter is the delay suggested to clients whose jobs are
+// rejected due to a drain with no known end.
+const defaultDrainRetryAfter = 5 * time.Minute
+
+// Drain describes why new builds are not accepted.
+type Drain struct {
+	Reason string    `json:"reason"`
+	Since  time.Time `json:"since"`
+
+	// Until is when the drain is expected to end, if known. It's only
+	// used to advise clients when to retry; the drain lasts until it's
+	// lifted.
+	Until *time.Time `json:"until,omitempty"`
+}
+
+func (d Drain) String() string {
+	s := fmt.Sprintf("since %s", d.Since.Format(DateFmt))
+	if d.Until != nil {
+		s += fmt.Sprintf(", expected to end at %s", d.Until.Format(DateFmt))
+	}
+	if d.Reason != "" {
+		s += " (" + d.Reason + ")"
+	}
+	return s
+}
+
+// RetryAfter returns how long clients should wait before retrying.
+func (d Drain) RetryAfter() time.Duration {
+	if d.Until == nil {
+		return defaultDrainRetryAfter
+	}
+	if left := time.Until(*d.Until); left > minRetryAfter {
+		return left
+	}
+	return minRetryAfter
+}
+
+// drainError is returned when a build is rejected due to a drain of its
+// project or, if project is empty, of the whole server.
+type drainError struct {
+	Drain
+	project string
+}
+
+func (e *drainError) Error() string {
+	what := "server"
+	if e.project != "" {
+		what = "project " + e.project
+	}
+	if e.Reason == "" {
+		return what + " is drained"
+	}
+	return fmt.Sprintf("%s is drained: %s", what, e.Reason)
+}
+
+// DrainStatus contains the drains of the server and its projects.
+type DrainStatus struct {
+	// Server is set if the whole server is drained
+	Server   *Drain           `json:"server,omitempty"`
+	Projects map[string]Drain `json:"projects"`
+}
+
+func (st DrainStatus) String() string {
+	var b strings.Builder
+	if st.Server != nil {
+		fmt.Fprintf(&b, "server: %s\n", st.Server)
+	}
+
+	projects := make([]string, 0, len(st.Projects))
+	for p := range st.Projects {
+		projects = append(projects, p)
+	}
+	sort.Strings(projects)
+	for _, p := range projects {
+		fmt.Fprintf(&b, "%s: %s\n", p, st.Projects[p])
+	}
+
+	if b.Len() == 0 {
+		return "Nothing is drained.\n"
+	}
+	return "Drained:\n" + b.String()
+}
+
+// Drains keeps track of the projects that don't accept new builds, or of
+// whether the whole server doesn't, eg. during maintenance. Jobs that are
+// already queued or running are not affected, and neither are requests for
+// the status, logs or artifacts of builds.
+//
+// Drains are persisted in the build path, so that they survive restarts.
+type Drains struct {
+	mu     sync.Mutex
+	path   string
+	status DrainStatus
+}
+
+// OpenDrains loads the drains persisted in buildPath.
+func OpenDrains(buildPath string) (*Drains, error) {
+	d := &Drains{
+		path:   filepath.Join(buildPath, DrainsFname),
+		status: DrainStatus{Projects: make(map[string]Drain)},
+	}
+
+	data, err := ioutil.ReadFile(d.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return d, nil
+		}
+		return nil, fmt.Errorf("cannot read drains; %s", err)
+	}
+
+	err = json.Unmarshal(data, &d.status)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse drains from %s; %s", d.path, err)
+	}
+	if d.status.Projects == nil {
+		d.status.Projects = make(map[string]Drain)
+	}
+	return d, nil
+}
+
+// Drain stops project from accepting new builds, or the whole server if
+// project is empty. A previous drain of the same project is replaced.
+func (d *Drains) Drain(project string, dr Drain) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if project == "" {
+		d.status.Server = &dr
+	} else {
+		d.status.Projects[project] = dr
+	}
+	return d.persist()
+}
+
+// Undrain lifts the drain of project, or of the whole server if project is
+// empty. An error is returned if it's not drained.
+func (d *Drains) Undrain(project string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if project == "" {
+		if d.status.Server == nil {
+			return errors.New("server is not drained")
+		}
+		d.status.Server = nil
+	} else {
+		if _, ok := d.status.Projects[project]; !ok {
+			return fmt.Errorf("project %s is not drained", project)
+		}
+		delete(d.status.Projects, project)
+	}
+	return d.persist()
+}
+
+// Check returns the drain that applies to project, if any. A drain of the
+// whole server takes precedence.
+func (d *Drains) Check(project string) *drainError {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.status.Server != nil {
+		return &drainError{Drain: *d.status.Server}
+	}
+	if dr, ok := d.status.Projects[project]; ok {
+		return &drainError{project: project, Drain: dr}
+	}
+	return nil
+}
+
+// Status returns a copy of the current drains.
+func (d *Drains) Status() DrainStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	st := DrainStatus{Projects: make(map[string]Drain)}
+	if d.status.Server != nil {
+		server := *d.status.Server
+		st.Server = &server
+	}
+	for p, dr := range d.status.Projects {
+		st.Projects[p] = dr
+	}
+	return st
+}
+
+// persist writes the drains to disk. It must be called with mu held.
+func (d *Drains) persist() error {
+	data, err := json.Marshal(d.status)
+	if err != nil {
+		return err
+	}
+
+	// replace the file atomically, so that it's never left truncated
+	tmp := d.path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot persist drains; %s", err)
+	}
+	err = os.Rename(tmp, d.path)
+	if err != nil {
+		return fmt.Errorf("cannot persist drains; %s", err)
+	}
+	return nil
+}
+
+// requestDrain sends a request with the given method, query and body to the
+// drain endpoint of the server listening on addr, and returns the resulting
+// drains.
+func requestDrain(addr, token, method, query string, body []byte) (DrainStatus, error) {
+	var st DrainStatus
+
+	u := "http://" + addr + "/admin/drain"
+	if query != "" {
+		u += "?" + query
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return st, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return st, fmt.Errorf("cannot reach the server; %s", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return st, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return st, fmt.Errorf("(error: %d) %s", resp.StatusCode, bytes.TrimSpace(respBody))
+	}
+	err = json.Unmarshal(respBody, &st)
+	return st, err
+}
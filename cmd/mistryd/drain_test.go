@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skroutz/mistry/pkg/types"
+)
+
+func TestDrains(t *testing.T) {
+	path, err := ioutil.TempDir("", "mistry-test-drains")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	d, err := OpenDrains(path)
+	failIfError(err, t)
+	assertEq(d.Check("foo"), (*drainError)(nil), t)
+
+	failIfError(d.Drain("foo", Drain{Reason: "Dockerfile upgrade"}), t)
+	assertEq(d.Check("foo").Error(), "project foo is drained: Dockerfile upgrade", t)
+	assertEq(d.Check("bar"), (*drainError)(nil), t)
+
+	// drains survive restarts
+	d, err = OpenDrains(path)
+	failIfError(err, t)
+	assertNotEq(d.Check("foo"), (*drainError)(nil), t)
+
+	failIfError(d.Drain("", Drain{Reason: "disk maintenance"}), t)
+	assertEq(d.Check("bar").Error(), "server is drained: disk maintenance", t)
+	assertEq(d.Check("foo").Error(), "server is drained: disk maintenance", t)
+
+	failIfError(d.Undrain(""), t)
+	failIfError(d.Undrain("foo"), t)
+	assertNotEq(d.Undrain("foo"), nil, t)
+	assertEq(d.Status(), DrainStatus{Projects: map[string]Drain{}}, t)
+}
+
+func TestDrainRetryAfter(t *testing.T) {
+	assertEq(Drain{}.RetryAfter(), defaultDrainRetryAfter, t)
+
+	until := time.Now().Add(time.Hour)
+	d := Drain{Until: &until}
+	assert(d.RetryAfter() > 59*time.Minute && d.RetryAfter() <= time.Hour, true, t)
+
+	until = time.Now().Add(-time.Hour)
+	assertEq(d.RetryAfter(), minRetryAfter, t)
+}
+
+func TestHandleDrain(t *testing.T) {
+	s, cleanup := newAuthServer(t)
+	defer cleanup()
+
+	do := func(method, url, token, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		s.srv.Handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// ci may build simple, but not drain it
+	assertEq(do("PUT", "/admin/drain", "ci-token", `{"project": "simple"}`).Code, 403, t)
+	assertEq(do("PUT", "/admin/drain", "ops-token", `{"project": "unknown"}`).Code, 400, t)
+
+	rec := do("PUT", "/admin/drain", "ops-token", `{"project": "simple", "reason": "upgrade", "duration": "1h"}`)
+	assertEq(rec.Code, 200, t)
+	st := DrainStatus{}
+	failIfError(json.Unmarshal(rec.Body.Bytes(), &st), t)
+	assertEq(st.Projects["simple"].Reason, "upgrade", t)
+
+	rec = do("POST", "/jobs?async", "ci-token", `{"project": "simple", "params": {"test": "drain"}}`)
+	assertEq(rec.Code, http.StatusServiceUnavailable, t)
+	assert(strings.Contains(rec.Body.String(), "project simple is drained: upgrade"), true, t)
+	assertEq(rec.Header().Get("Retry-After"), "3599", t)
+
+	// builds that are already ready are still served
+	j, err := NewJob("simple", types.Params{"test": "drain-ready"}, nil, "", s.cfg)
+	failIfError(err, t)
+	failIfError(os.MkdirAll(j.ReadyBuildPath, 0755), t)
+	bi := types.NewBuildInfo()
+	bi.ExitCode = types.ContainerSuccessExitCode
+	biJSON, err := json.Marshal(bi)
+	failIfError(err, t)
+	failIfError(ioutil.WriteFile(filepath.Join(j.ReadyBuildPath, BuildInfoFname), biJSON, 0644), t)
+	failIfError(ioutil.WriteFile(BuildLogPath(j.ReadyBuildPath), []byte("done"), 0644), t)
+
+	rec = do("POST", "/jobs", "ci-token", `{"project": "simple", "params": {"test": "drain-ready"}}`)
+	assertEq(rec.Code, http.StatusCreated, t)
+	result := types.BuildInfo{}
+	failIfError(json.Unmarshal(rec.Body.Bytes(), &result), t)
+	assertEq(result.Cached, true, t)
+	assertEq(result.ContainerStdouterr, "done", t)
+
+	assertEq(do("DELETE", "/admin/drain?project=simple", "ci-token", "").Code, 403, t)
+	assertEq(do("DELETE", "/admin/drain?project=simple", "ops-token", "").Code, 200, t)
+	assertEq(do("DELETE", "/admin/drain?project=simple", "ops-token", "").Code, 404, t)
+
+	rec = do("POST", "/jobs?async", "ci-token", `{"project": "simple", "params": {"test": "drain"}}`)
+	assertEq(rec.Code, http.StatusCreated, t)
+
+	// jobs are rejected before they're created, so even unknown projects
+	// are reported as drained
+	assertEq(do("PUT", "/admin/drain", "ops-token", `{"reason": "maintenance"}`).Code, 200, t)
+	rec = do("POST", "/jobs?async", "ops-token", `{"project": "nonexistent"}`)
+	assertEq(rec.Code, http.StatusServiceUnavailable, t)
+	assert(strings.Contains(rec.Body.String(), "maintenance"), true, t)
+	assertEq(do("DELETE", "/admin/drain", "ops-token", "").Code, 200, t)
+}
@@ -60,7 +60,7 @@ func TestSimpleRebuild(t *testing.T) {
 		t.Fatalf("mistry-cli stdout: %s, stderr: %s, err: %#v", cmdout, cmderr, err)
 	}
 
-	j, err := NewJob("simple", params, "", testcfg)
+	j, err := NewJob("simple", params, nil, "", testcfg)
 	if err != nil {
 		t.Fatalf("%s", err)
 	}
@@ -119,15 +119,21 @@ func TestAsyncSimpleBuild(t *testing.T) {
 	if err != nil {
 		t.Fatalf("mistry-cli stdout: %s, stderr: %s, err: %#v", cmdout, cmderr, err)
 	}
-	assertEq(cmdout, "", t)
 	assertEq(cmderr, "", t)
 
+	st := types.JobStatus{}
+	err = json.Unmarshal([]byte(cmdout), &st)
+	if err != nil {
+		t.Fatalf("Couldn't unmarshall '%s'", cmdout)
+	}
+
 	// wait until the build is done and verify the result
 
-	j, err := NewJob("simple", types.Params{"test": "async"}, "", testcfg)
+	j, err := NewJob("simple", types.Params{"test": "async"}, nil, "", testcfg)
 	if err != nil {
 		t.Fatalf("%s", err)
 	}
+	assertEq(st.ID, j.ID, t)
 
 	buildInfoPath := filepath.Join(j.ReadyBuildPath, BuildInfoFname)
 
@@ -176,7 +182,7 @@ func TestExistingContainer(t *testing.T) {
 	// in the manual ContainerCreate called in the test
 	params := types.Params{"testing": "existing-container-" + randomHexString()}
 
-	j, err := NewJob(project, params, "", testcfg)
+	j, err := NewJob(project, params, nil, "", testcfg)
 	failIfError(err, t)
 
 	_, err = client.ContainerCreate(
@@ -261,6 +267,82 @@ func TestJobParams(t *testing.T) {
 	assert(string(out), "zxc", t)
 }
 
+func TestProjectSettings(t *testing.T) {
+	cmdout, cmderr, err := cliBuildJob("--project", "settings", "--", "--name=world")
+	if err != nil {
+		t.Fatalf("mistry-cli stdout: %s, stderr: %s, err: %#v", cmdout, cmderr, err)
+	}
+
+	out, err := ioutil.ReadFile(filepath.Join(cliDefaultArgs.target, "out.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert(string(out), "hello world", t)
+
+	j, err := NewJob("settings", types.Params{"name": "world"}, nil, "", testcfg)
+	if err != nil {
+		t.Fatalf("failed to create job; %s", err)
+	}
+	bi, err := ReadJobBuildInfo(j.ReadyBuildPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(bi.BuildNetworkMode, "host", t)
+	assertEq(bi.RunNetworkMode, "none", t)
+}
+
+func TestSecrets(t *testing.T) {
+	cmdout, cmderr, err := cliBuildJob("--project", "secrets")
+	if err != nil {
+		t.Fatalf("mistry-cli stdout: %s, stderr: %s, err: %#v", cmdout, cmderr, err)
+	}
+
+	out, err := ioutil.ReadFile(filepath.Join(cliDefaultArgs.target, "token_size.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(strings.TrimSpace(string(out)), "13", t)
+
+	j, err := NewJob("secrets", types.Params{}, nil, "", testcfg)
+	if err != nil {
+		t.Fatalf("failed to create job; %s", err)
+	}
+	log, err := ReadJobLogs(j.ReadyBuildPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(log), "s3cr3t-t0k3n") {
+		t.Fatalf("Expected '%s' not to contain the secret", log)
+	}
+	if !strings.Contains(string(log), "token: "+RedactedSecret) {
+		t.Fatalf("Expected '%s' to contain the redacted secret", log)
+	}
+}
+
+func TestOOMKilled(t *testing.T) {
+	expErr := "the build ran out of memory"
+
+	_, cmderr, err := cliBuildJob("--project", "oom")
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if !strings.Contains(cmderr, expErr) {
+		t.Fatalf("Expected '%s' to contain '%s'", cmderr, expErr)
+	}
+
+	j, err := NewJob("oom", types.Params{}, nil, "", testcfg)
+	if err != nil {
+		t.Fatalf("failed to create job; %s", err)
+	}
+	bi, err := ReadJobBuildInfo(j.ReadyBuildPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(bi.OOMKilled, true, t)
+	assertEq(bi.FailureKind, types.FailureOOM, t)
+}
+
 func TestImageBuildFailure(t *testing.T) {
 	expErr := "could not build docker image"
 
@@ -272,7 +354,7 @@ func TestImageBuildFailure(t *testing.T) {
 	if !strings.Contains(cmderr, expErr) {
 		t.Fatalf("Expected '%s' to contain '%s'", cmderr, expErr)
 	}
-	j, err := NewJob("image-build-failure", types.Params{}, "", testcfg)
+	j, err := NewJob("image-build-failure", types.Params{}, nil, "", testcfg)
 	if err != nil {
 		t.Fatalf("failed to create job; %s", err)
 	}
@@ -298,6 +380,7 @@ func TestImageBuildFailure(t *testing.T) {
 		t.Fatalf("%s", err)
 	}
 	assertEq(bi.ExitCode, types.ContainerPendingExitCode, t)
+	assertEq(bi.FailureKind, types.FailureDockerfile, t)
 }
 
 func TestLogs(t *testing.T) {
@@ -313,7 +396,7 @@ func TestLogs(t *testing.T) {
 	}
 
 	// find the log file
-	j, err := NewJob("simple", types.Params{"testing": "logs"}, "", testcfg)
+	j, err := NewJob("simple", types.Params{"testing": "logs"}, nil, "", testcfg)
 	if err != nil {
 		t.Fatalf("failed to create job: err: %#v", err)
 	}
@@ -331,7 +414,7 @@ func TestLogsNotJson(t *testing.T) {
 	if err != nil {
 		t.Fatalf("mistry-cli stdout: %s, stderr: %s, err: %#v", cmdout, cmderr, err)
 	}
-	j, err := NewJob("simple", types.Params{"testing": "logsnotjson"}, "", testcfg)
+	j, err := NewJob("simple", types.Params{"testing": "logsnotjson"}, nil, "", testcfg)
 	if err != nil {
 		t.Fatalf("failed to create job: err: %#v", err)
 	}
@@ -540,4 +623,9 @@ func TestBuildCoalescing(t *testing.T) {
 	assertNotEq(bi1.Coalesced, bi2.Coalesced, t)
 	assert(bi1.ExitCode, 0, t)
 	assertEq(bi1.ExitCode, bi2.ExitCode, t)
+
+	// the coalesced build shares the whole result of the original one
+	assertEq(bi1.ContainerStdouterr, bi2.ContainerStdouterr, t)
+	assertEq(bi1.Duration, bi2.Duration, t)
+	assertEq(bi1.StartedAt.Equal(bi2.StartedAt), true, t)
 }
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	docker "github.com/docker/docker/client"
+)
+
+// healthCheckTimeout is the maximum time a single health check may take.
+const healthCheckTimeout = 5 * time.Second
+
+// fileSystemCheckInterval is how often the filesystem check actually runs.
+// Since it creates, clones and removes a directory (eg. a btrfs snapshot), it
+// doesn't run on every probe.
+const fileSystemCheckInterval = 1 * time.Minute
+
+// HealthCheck is the outcome of a single health check.
+type HealthCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// HealthReport is the response of the health and readiness endpoints. OK is
+// true if all of the individual checks succeeded.
+type HealthReport struct {
+	OK     bool          `json:"ok"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+type healthCheckFunc func(ctx context.Context) error
+
+type healthCheck struct {
+	name string
+	fn   healthCheckFunc
+}
+
+// cachedCheck runs a health check at most once every interval and reports
+// the outcome of its latest run in between.
+type cachedCheck struct {
+	fn       healthCheckFunc
+	interval time.Duration
+
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+func newCachedCheck(fn healthCheckFunc, interval time.Duration) *cachedCheck {
+	return &cachedCheck{fn: fn, interval: interval}
+}
+
+func (c *cachedCheck) check(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.checked.IsZero() || time.Since(c.checked) >= c.interval {
+		c.err = c.fn(ctx)
+		c.checked = time.Now()
+	}
+	return c.err
+}
+
+// HandleHealth reports whether the server and the services it depends on are
+// operational.
+func (s *Server) HandleHealth(w http.ResponseWriter, r *http.Request) {
+	s.writeHealthReport(w, r, s.healthChecks())
+}
+
+// HandleReady reports whether the server is able to accept new jobs. Apart
+// from the health checks, it also checks that the server is not shutting
+// down or drained and that the worker pool is not saturated.
+func (s *Server) HandleReady(w http.ResponseWriter, r *http.Request) {
+	checks := s.healthChecks()
+	checks = append(checks,
+		healthCheck{"shutdown", s.checkShutdown},
+		healthCheck{"drain", s.checkDrain},
+		healthCheck{"backlog", s.checkBacklog})
+
+	s.writeHealthReport(w, r, checks)
+}
+
+func (s *Server) healthChecks() []healthCheck {
+	return []healthCheck{
+		{"docker", checkDocker},
+		{"build_path", checkWritable(s.cfg.BuildPath)},
+		{"projects_path", checkWritable(s.cfg.ProjectsPath)},
+		{"filesystem", s.fileSystemCheck.check},
+	}
+}
+
+func (s *Server) writeHealthReport(w http.ResponseWriter, r *http.Request, checks []healthCheck) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Expected GET, got "+r.Method, http.StatusMethodNotAllowed)
+		return
+	}
+
+	report := HealthReport{OK: true, Checks: []HealthCheck{}}
+	for _, c := range checks {
+		ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+		err := c.fn(ctx)
+		cancel()
+
+		hc := HealthCheck{Name: c.name, OK: err == nil}
+		if err != nil {
+			hc.Error = err.Error()
+			report.OK = false
+		}
+		report.Checks = append(report.Checks, hc)
+	}
+
+	resp, err := json.Marshal(report)
+	if err != nil {
+		s.Log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if report.OK {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_, err = w.Write(resp)
+	if err != nil {
+		s.Log.Printf("cannot write health report; %s", err)
+	}
+}
+
+// checkDocker checks that the Docker daemon is reachable.
+func checkDocker(ctx context.Context) error {
+	client, err := docker.NewEnvClient()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	_, err = client.Ping(ctx)
+	return err
+}
+
+// checkWritable returns a check that path is writable, by creating a file in
+// it.
+func checkWritable(path string) healthCheckFunc {
+	return func(ctx context.Context) error {
+		f, err := ioutil.TempFile(path, ".mistry-healthcheck")
+		if err != nil {
+			return err
+		}
+		err = f.Close()
+		if err != nil {
+			return err
+		}
+		return os.Remove(f.Name())
+	}
+}
+
+// checkFileSystem checks that all the operations of the configured
+// filesystem adapter work in the build path.
+func (s *Server) checkFileSystem(ctx context.Context) error {
+	src := filepath.Join(s.cfg.BuildPath, ".mistry-healthcheck-"+randomHexString())
+	dst := src + "-clone"
+
+	err := s.cfg.FileSystem.Create(src)
+	if err != nil {
+		return fmt.Errorf("cannot create %s; %s", src, err)
+	}
+	defer s.cfg.FileSystem.Remove(src)
+
+	err = s.cfg.FileSystem.Clone(src, dst)
+	if err != nil {
+		return fmt.Errorf("cannot clone %s; %s", src, err)
+	}
+
+	err = s.cfg.FileSystem.Remove(dst)
+	if err != nil {
+		return fmt.Errorf("cannot remove %s; %s", dst, err)
+	}
+	return nil
+}
+
+// checkShutdown checks that the server is not shutting down.
+func (s *Server) checkShutdown(ctx context.Context) error {
+	if s.workerPool.Closed() {
+		return errors.New("server is shutting down")
+	}
+	return nil
+}
+
+// checkDrain checks that the whole server is not drained.
+func (s *Server) checkDrain(ctx context.Context) error {
+	if err := s.drains.Check(""); err != nil {
+		return err
+	}
+	return nil
+}
+
+// checkBacklog checks that the worker pool can accept new jobs.
+func (s *Server) checkBacklog(ctx context.Context) error {
+	if s.workerPool.Saturated() {
+		return fmt.Errorf("all workers are busy and the backlog is full (%d jobs)", s.workerPool.Size().Backlog)
+	}
+	return nil
+}
@@ -13,9 +13,11 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	dockertypes "github.com/docker/docker/api/types"
@@ -40,9 +42,25 @@ type Job struct {
 	Params  types.Params
 	Group   string
 
+	// Env contains the environment variables of the build container,
+	// in addition to the ones in the project's settings
+	Env map[string]string
+
 	// Rebuild indicates if Docker image cache will be bypassed.
 	Rebuild bool
 
+	// Timeout is the maximum duration of the build. Zero means no
+	// timeout.
+	Timeout time.Duration
+
+	// Priority determines the order in which queued jobs are built. See
+	// types.JobRequest.
+	Priority int
+
+	// RequestedBy is the name of the token the job was requested with, if
+	// any.
+	RequestedBy string
+
 	RootBuildPath    string
 	PendingBuildPath string
 	ReadyBuildPath   string
@@ -51,6 +69,12 @@ type Job struct {
 
 	ProjectPath string
 
+	// Settings are the settings of the project (see ProjectSettings)
+	Settings ProjectSettings
+
+	// Network are the effective network modes of the build
+	Network NetworkModes
+
 	// NOTE: after a job is complete, this points to an invalid (pending)
 	// path
 	BuildLogPath      string
@@ -67,11 +91,17 @@ type Job struct {
 	State     string
 
 	Log *log.Logger
+
+	// interrupted is set to 1 if the job is stopped because the server is
+	// shutting down. It is accessed atomically.
+	interrupted int32
 }
 
-// NewJob returns a new Job for the given project. project and cfg cannot be
-// empty.
-func NewJob(project string, params types.Params, group string, cfg *Config) (*Job, error) {
+// NewJob returns a new Job for the given project, whose build container is
+// given the environment variables in env. Like params, variables starting
+// with "_" are opaque to the build and don't affect the job's ID. project
+// and cfg cannot be empty.
+func NewJob(project string, params types.Params, env map[string]string, group string, cfg *Config) (*Job, error) {
 	var err error
 
 	if project == "" {
@@ -86,6 +116,7 @@ func NewJob(project string, params types.Params, group string, cfg *Config) (*Jo
 	j.Project = project
 	j.Group = group
 	j.Params = params
+	j.Env = env
 	j.ProjectPath = filepath.Join(cfg.ProjectsPath, j.Project)
 	j.RootBuildPath = filepath.Join(cfg.BuildPath, j.Project)
 
@@ -103,23 +134,26 @@ func NewJob(project string, params types.Params, group string, cfg *Config) (*Jo
 		return nil, err
 	}
 
-	// compute ID
-	keys := []string{}
-	for k := range params {
-		// params opaque to the build are not taken into account
-		// when calculating a job's ID
-		if strings.HasPrefix(k, "_") {
-			continue
-		}
-
-		keys = append(keys, k)
+	j.Settings, err = ReadProjectSettings(j.ProjectPath)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read settings of project '%s'; %s", j.Project, err)
 	}
-	sort.Strings(keys)
+	err = cfg.validateProjectMounts(j.Settings)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid settings of project '%s'; %s", j.Project, err)
+	}
+	j.Network = cfg.JobNetwork(j.Project, j.Settings)
 
+	// compute ID
 	seed := project + group
-	for _, v := range keys {
+	for _, v := range idKeys(params) {
 		seed += v + params[v]
 	}
+	// environment variables are kept apart from params, so that they
+	// don't result in the same ID
+	for _, v := range idKeys(env) {
+		seed += "env:" + v + "=" + env[v]
+	}
 	seed += string(j.ImageTar)
 
 	j.ID = fmt.Sprintf("%x", sha256.Sum256([]byte(seed)))
@@ -141,6 +175,42 @@ func NewJob(project string, params types.Params, group string, cfg *Config) (*Jo
 	return j, nil
 }
 
+// EnvList returns the environment variables of the build container in the
+// form "key=value", sorted by key. The variables of j override the ones in
+// the settings of its project.
+func (j *Job) EnvList() []string {
+	vars := make(map[string]string)
+	for k, v := range j.Settings.Env {
+		vars[k] = v
+	}
+	for k, v := range j.Env {
+		vars[k] = v
+	}
+
+	env := make([]string, 0, len(vars))
+	for k, v := range vars {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// idKeys returns the sorted keys of m that affect the ID of a job.
+func idKeys(m map[string]string) []string {
+	keys := []string{}
+	for k := range m {
+		// keys opaque to the build are not taken into account
+		// when calculating a job's ID
+		if strings.HasPrefix(k, "_") {
+			continue
+		}
+
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 // BuildImage builds the Docker image denoted by j.Image. If there is an
 // error, it will be of type types.ErrImageBuild.
 func (j *Job) BuildImage(ctx context.Context, uid string, c *docker.Client, out io.Writer, pullParent, noCache bool) error {
@@ -149,12 +219,12 @@ func (j *Job) BuildImage(ctx context.Context, uid string, c *docker.Client, out
 	buildOpts := dockertypes.ImageBuildOptions{
 		Tags:        []string{j.Image},
 		BuildArgs:   buildArgs,
-		NetworkMode: "host",
+		NetworkMode: j.Network.Build,
 		PullParent:  pullParent,
 		NoCache:     noCache,
 		ForceRemove: true,
 	}
-	resp, err := c.ImageBuild(context.Background(), bytes.NewBuffer(j.ImageTar), buildOpts)
+	resp, err := c.ImageBuild(ctx, bytes.NewBuffer(j.ImageTar), buildOpts)
 	if err != nil {
 		return types.ErrImageBuild{Image: j.Image, Err: err}
 	}
@@ -173,70 +243,120 @@ func (j *Job) BuildImage(ctx context.Context, uid string, c *docker.Client, out
 	return nil
 }
 
+// imageBuildFailure returns the kind of failure of err, which was returned by
+// BuildImage: errors reported by the steps of the Dockerfile are failures of
+// the project, while the rest are failures of the Docker daemon.
+func imageBuildFailure(err error) types.FailureKind {
+	var stepErr *jsonmessage.JSONError
+	if errors.As(err, &stepErr) {
+		return types.FailureDockerfile
+	}
+	return types.FailureImageBuild
+}
+
+// ContainerResult is the outcome of a build container.
+type ContainerResult struct {
+	ExitCode int
+
+	// OOMKilled is true if the container was killed because it exceeded
+	// its memory limit.
+	OOMKilled bool
+}
+
 // StartContainer creates and runs the container. It blocks until the container
-// exits and returns the exit code of the container command. If there was an error
-// starting the container, the exit code is irrelevant.
+// exits and returns the exit code of the container command, along with whether
+// it ran out of memory. If there was an error starting the container, the
+// result is irrelevant.
+//
+// If ctx is cancelled while the container is running, the container is
+// killed.
 //
 // NOTE: If there was an error with the user's dockerfile, the returned exit
 // code will be 1 and the error nil.
-func (j *Job) StartContainer(ctx context.Context, cfg *Config, c *docker.Client, out, outErr io.Writer) (int, error) {
-	config := container.Config{User: cfg.UID, Image: j.Image}
+func (j *Job) StartContainer(ctx context.Context, cfg *Config, c *docker.Client, out, outErr io.Writer) (ContainerResult, error) {
+	config := container.Config{User: cfg.UID, Image: j.Image, Env: j.EnvList()}
 
 	mnts := []mount.Mount{{Type: mount.TypeBind, Source: filepath.Join(j.PendingBuildPath, DataDir), Target: DataDir}}
-	for src, target := range cfg.Mounts {
+	for src, target := range cfg.ProjectMounts(j.Settings) {
 		mnts = append(mnts, mount.Mount{Type: mount.TypeBind, Source: src, Target: target})
 	}
+	for _, name := range cfg.Projects[j.Project].Secrets {
+		mnts = append(mnts, mount.Mount{Type: mount.TypeBind, Source: filepath.Join(cfg.SecretsPath, name),
+			Target: path.Join(SecretsDir, name), ReadOnly: true})
+	}
 
-	hostConfig := container.HostConfig{Mounts: mnts, AutoRemove: false, NetworkMode: "host"}
+	hostConfig := container.HostConfig{
+		Mounts:      mnts,
+		AutoRemove:  false,
+		NetworkMode: container.NetworkMode(j.Network.Run),
+		Resources:   cfg.JobResources(j.Project, j.Settings).containerResources(),
+	}
 
 	err := renameIfExists(ctx, c, j.Container)
 	res, err := c.ContainerCreate(ctx, &config, &hostConfig, nil, nil, j.Container)
 	if err != nil {
-		return 0, err
+		return ContainerResult{}, err
 	}
 
 	err = c.ContainerStart(ctx, res.ID, dockertypes.ContainerStartOptions{})
 	if err != nil {
-		return 0, err
+		return ContainerResult{}, err
 	}
 
+	// the container has to be removed even if ctx is cancelled
 	defer func(id string) {
-		err = c.ContainerRemove(ctx, id, dockertypes.ContainerRemoveOptions{})
+		err = c.ContainerRemove(context.Background(), id, dockertypes.ContainerRemoveOptions{Force: true})
 		if err != nil {
 			log.Printf("[%s] cannot remove container: %s", j, err)
 		}
 	}(res.ID)
 
-	logs, err := c.ContainerLogs(ctx, res.ID,
+	done := make(chan struct{})
+	defer close(done)
+	go func(id string) {
+		select {
+		case <-ctx.Done():
+			err := c.ContainerKill(context.Background(), id, "KILL")
+			if err != nil {
+				log.Printf("[%s] cannot kill container: %s", j, err)
+			}
+		case <-done:
+		}
+	}(res.ID)
+
+	// logs and exit code are fetched regardless of ctx, since they're
+	// still useful if the container was killed
+	logs, err := c.ContainerLogs(context.Background(), res.ID,
 		dockertypes.ContainerLogsOptions{Follow: true, ShowStdout: true, ShowStderr: true,
 			Details: true})
 	if err != nil {
-		return 0, err
+		return ContainerResult{}, err
 	}
 	defer logs.Close()
 
 	_, err = stdcopy.StdCopy(out, io.MultiWriter(out, outErr), logs)
 	if err != nil {
-		return 0, err
+		return ContainerResult{}, err
 	}
 
 	var result struct {
 		State struct {
-			ExitCode int
+			ExitCode  int
+			OOMKilled bool
 		}
 	}
 
-	_, inspect, err := c.ContainerInspectWithRaw(ctx, res.ID, false)
+	_, inspect, err := c.ContainerInspectWithRaw(context.Background(), res.ID, false)
 	if err != nil {
-		return 0, err
+		return ContainerResult{}, err
 	}
 
 	err = json.Unmarshal(inspect, &result)
 	if err != nil {
-		return 0, err
+		return ContainerResult{}, err
 	}
 
-	return result.State.ExitCode, nil
+	return ContainerResult{ExitCode: result.State.ExitCode, OOMKilled: result.State.OOMKilled}, nil
 }
 
 // renameIfExists searches for containers with the passed name and renames them
@@ -317,19 +437,15 @@ func (j *Job) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
-// GetState determines the job's current state by using it's path in the filesystem.
-func GetState(path, project, id string) (string, error) {
-	pPath := filepath.Join(path, project, "pending", id)
-	rPath := filepath.Join(path, project, "ready", id)
-	_, err := os.Stat(pPath)
-	if err == nil {
-		return "pending", nil
-	}
-	_, err = os.Stat(rPath)
-	if err == nil {
-		return "ready", nil
-	}
-	return "", fmt.Errorf("job with id=%s not found error", id)
+// Interrupt marks j as interrupted by the server shutting down. It should
+// be called before the context of the build is cancelled.
+func (j *Job) Interrupt() {
+	atomic.StoreInt32(&j.interrupted, 1)
+}
+
+// Interrupted returns true if j was interrupted by the server shutting down.
+func (j *Job) Interrupted() bool {
+	return atomic.LoadInt32(&j.interrupted) == 1
 }
 
 // CloneSrcPath returns the build path that should be used as the base
@@ -370,12 +486,24 @@ func (j *Job) BootstrapBuildDir(fs filesystem.FileSystem) error {
 		return workErr("could not create pending build path", err)
 	}
 
-	// if we cloned, empty the params dir
+	// if we cloned, empty the params dir and remove the artifact archives
+	// of the previous build
 	if cloneSrc != "" {
 		err = os.RemoveAll(filepath.Join(j.PendingBuildPath, DataDir, ParamsDir))
 		if err != nil {
 			return workErr("could not remove params dir", err)
 		}
+
+		archives, err := filepath.Glob(filepath.Join(j.PendingBuildPath, ArtifactsArchiveFname+"*"))
+		if err != nil {
+			return workErr("could not find artifact archives", err)
+		}
+		for _, archive := range archives {
+			err = os.Remove(archive)
+			if err != nil {
+				return workErr("could not remove artifacts archive", err)
+			}
+		}
 	}
 
 	dirs := [4]string{
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultIndexLimit is the number of jobs returned by the index if no
+	// limit is requested.
+	DefaultIndexLimit = 100
+
+	// MaxIndexLimit is the maximum number of jobs the index returns at
+	// once.
+	MaxIndexLimit = 1000
+)
+
+// JobFilter contains the criteria by which jobs are listed in the index. Zero
+// values match everything.
+type JobFilter struct {
+	Project string
+	Group   string
+	State   string
+
+	// ExitCode, if not nil, matches jobs that exited with that code
+	ExitCode *int
+
+	// Since and Until match jobs started in [Since, Until)
+	Since time.Time
+	Until time.Time
+
+	// Ascending sorts jobs from the oldest to the newest, instead of the
+	// other way around
+	Ascending bool
+
+	Limit int
+
+	// Cursor, if not nil, denotes the last job of the previous page
+	Cursor *JobCursor
+
+	// Projects, if not nil, restricts the jobs to those of the given
+	// projects (eg. the ones visible to the requester)
+	Projects map[string]bool
+}
+
+// JobCursor denotes the position of a job in the index.
+type JobCursor struct {
+	StartedAt time.Time
+	Project   string
+	ID        string
+}
+
+// ParseJobFilter parses a JobFilter from the query parameters of an index
+// request.
+func ParseJobFilter(q url.Values) (JobFilter, error) {
+	var err error
+
+	f := JobFilter{
+		Project: q.Get("project"),
+		Group:   q.Get("group"),
+		State:   q.Get("state"),
+		Limit:   DefaultIndexLimit,
+	}
+
+	if f.State != "" && f.State != "pending" && f.State != "ready" {
+		return f, fmt.Errorf("invalid state '%s'", f.State)
+	}
+
+	if v := q.Get("exit_code"); v != "" {
+		code, err := strconv.Atoi(v)
+		if err != nil {
+			return f, fmt.Errorf("invalid exit_code '%s'", v)
+		}
+		f.ExitCode = &code
+	}
+
+	if v := q.Get("since"); v != "" {
+		f.Since, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return f, fmt.Errorf("invalid since '%s'; %s", v, err)
+		}
+	}
+
+	if v := q.Get("until"); v != "" {
+		f.Until, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return f, fmt.Errorf("invalid until '%s'; %s", v, err)
+		}
+	}
+
+	switch q.Get("order") {
+	case "", "desc":
+	case "asc":
+		f.Ascending = true
+	default:
+		return f, fmt.Errorf("invalid order '%s'", q.Get("order"))
+	}
+
+	if v := q.Get("limit"); v != "" {
+		f.Limit, err = strconv.Atoi(v)
+		if err != nil || f.Limit <= 0 {
+			return f, fmt.Errorf("invalid limit '%s'", v)
+		}
+		if f.Limit > MaxIndexLimit {
+			f.Limit = MaxIndexLimit
+		}
+	}
+
+	if v := q.Get("cursor"); v != "" {
+		f.Cursor, err = ParseJobCursor(v)
+		if err != nil {
+			return f, err
+		}
+	}
+
+	return f, nil
+}
+
+// Match returns true if j satisfies all the criteria of f, apart from
+// its position relative to the cursor (see BuildIndex.List).
+func (f JobFilter) Match(j Job) bool {
+	if f.Project != "" && j.Project != f.Project {
+		return false
+	}
+	if f.Projects != nil && !f.Projects[j.Project] {
+		return false
+	}
+	if f.State != "" && j.State != f.State {
+		return false
+	}
+	if f.Group != "" && j.BuildInfo.Group != f.Group {
+		return false
+	}
+	if f.ExitCode != nil && j.BuildInfo.ExitCode != *f.ExitCode {
+		return false
+	}
+	if !f.Since.IsZero() && j.StartedAt.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !j.StartedAt.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+// ParseJobCursor parses a cursor previously encoded with JobCursor.String.
+func ParseJobCursor(s string) (*JobCursor, error) {
+	errInvalid := errors.New("invalid cursor '" + s + "'")
+
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errInvalid
+	}
+
+	parts := strings.SplitN(string(b), ":", 2)
+	if len(parts) != 2 {
+		return nil, errInvalid
+	}
+
+	ns, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, errInvalid
+	}
+
+	job := strings.SplitN(parts[1], "/", 2)
+	if len(job) != 2 {
+		return nil, errInvalid
+	}
+
+	return &JobCursor{StartedAt: time.Unix(0, ns), Project: job[0], ID: job[1]}, nil
+}
+
+// String encodes c in an opaque form, suitable for query parameters.
+func (c JobCursor) String() string {
+	s := fmt.Sprintf("%d:%s/%s", c.StartedAt.UnixNano(), c.Project, c.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
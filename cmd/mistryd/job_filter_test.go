@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseJobFilter(t *testing.T) {
+	q := url.Values{}
+	q.Set("project", "foo")
+	q.Set("state", "ready")
+	q.Set("exit_code", "0")
+	q.Set("since", "2018-10-01T00:00:00Z")
+	q.Set("limit", "5000")
+
+	f, err := ParseJobFilter(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(f.Project, "foo", t)
+	assertEq(f.State, "ready", t)
+	assertEq(*f.ExitCode, 0, t)
+	assertEq(f.Since, time.Date(2018, 10, 1, 0, 0, 0, 0, time.UTC), t)
+	assertEq(f.Limit, MaxIndexLimit, t)
+
+	c := JobCursor{StartedAt: time.Unix(0, 42), Project: "foo", ID: "abc"}
+	parsed, err := ParseJobCursor(c.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(*parsed, c, t)
+
+	for _, invalid := range []string{"state=foo", "exit_code=a", "limit=-1", "order=up", "cursor=@@"} {
+		q, err := url.ParseQuery(invalid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ParseJobFilter(q)
+		if err == nil {
+			t.Errorf("expected error for %s", invalid)
+		}
+	}
+}
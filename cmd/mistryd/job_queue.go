@@ -2,38 +2,73 @@ package main
 
 import (
 	"sync"
+
+	"github.com/skroutz/mistry/pkg/types"
 )
 
 // JobQueue holds the jobs that are enqueued currently in the server. It allows
-// used as a means to do build coalescing.
+// used as a means to do build coalescing: identical jobs that are requested
+// while a job is being built wait for it to complete and share its result.
 type JobQueue struct {
 	sync.Mutex
-	jobs map[string]bool
+	jobs map[string]*JobCompletion
+}
+
+// JobCompletion is the outcome of a job in a JobQueue, which becomes
+// available once the job completes.
+type JobCompletion struct {
+	done chan struct{}
+
+	// populated before done is closed
+	buildInfo *types.BuildInfo
+	err       error
 }
 
 // NewJobQueue returns a new JobQueue ready for use.
 func NewJobQueue() *JobQueue {
-	return &JobQueue{jobs: make(map[string]bool)}
+	return &JobQueue{jobs: make(map[string]*JobCompletion)}
 }
 
-// Add registers j to the list of pending jobs currently in the queue.
-// It returns false if an identical job is already enqueued.
-func (q *JobQueue) Add(j *Job) bool {
+// Add registers j to the list of pending jobs currently in the queue and
+// returns its completion. It returns false if an identical job is already
+// enqueued, along with the completion of that job.
+func (q *JobQueue) Add(j *Job) (*JobCompletion, bool) {
 	q.Lock()
 	defer q.Unlock()
 
-	if q.jobs[j.ID] {
-		return false
+	if c, ok := q.jobs[j.ID]; ok {
+		return c, false
 	}
 
-	q.jobs[j.ID] = true
-	return true
+	c := &JobCompletion{done: make(chan struct{})}
+	q.jobs[j.ID] = c
+	return c, true
 }
 
-// Delete removes j from q.
-func (q *JobQueue) Delete(j *Job) {
+// Complete removes j from q and notifies the jobs waiting for it with the
+// given outcome.
+func (q *JobQueue) Complete(j *Job, bi *types.BuildInfo, err error) {
 	q.Lock()
 	defer q.Unlock()
 
+	c, ok := q.jobs[j.ID]
+	if !ok {
+		return
+	}
 	delete(q.jobs, j.ID)
+
+	c.buildInfo = bi
+	c.err = err
+	close(c.done)
+}
+
+// Done returns a channel that is closed when the job completes.
+func (c *JobCompletion) Done() <-chan struct{} {
+	return c.done
+}
+
+// Result returns the BuildInfo and the error the job completed with. It must
+// only be called after Done is closed.
+func (c *JobCompletion) Result() (*types.BuildInfo, error) {
+	return c.buildInfo, c.err
 }
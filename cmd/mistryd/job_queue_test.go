@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/skroutz/mistry/pkg/types"
+)
+
+func TestJobQueueCoalescing(t *testing.T) {
+	q := NewJobQueue()
+	j := &Job{ID: "foo"}
+
+	c1, added := q.Add(j)
+	assertEq(added, true, t)
+
+	c2, added := q.Add(&Job{ID: "foo"})
+	assertEq(added, false, t)
+	assertEq(c1 == c2, true, t)
+
+	select {
+	case <-c2.Done():
+		t.Fatal("Expected job to be pending")
+	default:
+	}
+
+	bi := types.NewBuildInfo()
+	bi.ExitCode = 3
+	bi.ContainerStdouterr = "some logs"
+	bi.Duration = time.Second
+	jerr := errors.New("build failed")
+
+	waited := make(chan struct{})
+	go func() {
+		<-c2.Done()
+		close(waited)
+	}()
+	q.Complete(j, bi, jerr)
+
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected waiter to be notified")
+	}
+
+	rbi, rerr := c2.Result()
+	assertEq(rbi, bi, t)
+	assertEq(rerr, jerr, t)
+
+	// the job is no longer enqueued
+	_, added = q.Add(j)
+	assertEq(added, true, t)
+}
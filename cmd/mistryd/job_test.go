@@ -13,26 +13,26 @@ func TestJobID(t *testing.T) {
 	params := types.Params{"foo": "bar"}
 	group := "zzz"
 
-	j1, err := NewJob(project, params, group, testcfg)
+	j1, err := NewJob(project, params, nil, group, testcfg)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	j2, err := NewJob(project, params, group, testcfg)
+	j2, err := NewJob(project, params, nil, group, testcfg)
 	if err != nil {
 		t.Fatal(err)
 	}
 	assertEq(j1.ID, j2.ID, t)
 
 	// params seeding
-	j3, err := NewJob(project, make(types.Params), group, testcfg)
+	j3, err := NewJob(project, make(types.Params), nil, group, testcfg)
 	if err != nil {
 		t.Fatal(err)
 	}
 	assertNotEq(j1.ID, j3.ID, t)
 
 	// group seeding
-	j4, err := NewJob(project, params, "c", testcfg)
+	j4, err := NewJob(project, params, nil, "c", testcfg)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -46,7 +46,7 @@ func TestJobID(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer os.Remove(path)
-	j5, err := NewJob(project, params, group, testcfg)
+	j5, err := NewJob(project, params, nil, group, testcfg)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -57,7 +57,7 @@ func TestJobID(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	j6, err := NewJob(project, params, group, testcfg)
+	j6, err := NewJob(project, params, nil, group, testcfg)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -73,10 +73,38 @@ func TestJobID(t *testing.T) {
 	opqParams["_production"] = "ignored"
 
 	// check that params prepended with _ are ignored for ID creation
-	j7, err := NewJob(project, opqParams, group, testcfg)
+	j7, err := NewJob(project, opqParams, nil, group, testcfg)
 	if err != nil {
 		t.Fatal(err)
 	}
 	assertEq(j6.ID, j7.ID, t)
 
 }
+
+func TestJobIDEnv(t *testing.T) {
+	project := "simple"
+	params := types.Params{"foo": "bar"}
+
+	j1, err := NewJob(project, params, nil, "", testcfg)
+	failIfError(err, t)
+
+	j2, err := NewJob(project, params, map[string]string{"FOO": "bar"}, "", testcfg)
+	failIfError(err, t)
+	assertNotEq(j1.ID, j2.ID, t)
+	assertEq(j2.EnvList(), []string{"FOO=bar"}, t)
+
+	j3, err := NewJob(project, params, map[string]string{"FOO": "baz"}, "", testcfg)
+	failIfError(err, t)
+	assertNotEq(j2.ID, j3.ID, t)
+
+	// env and params with the same name don't produce the same ID
+	j4, err := NewJob(project, types.Params{"foo": "bar", "FOO": "bar"}, nil, "", testcfg)
+	failIfError(err, t)
+	assertNotEq(j2.ID, j4.ID, t)
+
+	// check that env prepended with _ is ignored for ID creation
+	j5, err := NewJob(project, params, map[string]string{"FOO": "bar", "_BUST": "1"}, "", testcfg)
+	failIfError(err, t)
+	assertEq(j2.ID, j5.ID, t)
+	assertEq(j5.EnvList(), []string{"FOO=bar", "_BUST=1"}, t)
+}
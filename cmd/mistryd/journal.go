@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/skroutz/mistry/pkg/types"
+	bolt "go.etcd.io/bbolt"
+)
+
+// entriesBucket maps sequence numbers to journal entries
+var entriesBucket = []byte("entries")
+
+// Journal is a durable log of the jobs accepted by the server, so that they
+// can be re-enqueued if the server stops before they are built. Jobs are
+// appended when they are accepted and deleted when their build completes.
+type Journal struct {
+	db *sharedDB
+}
+
+// JournalEntry is a job recorded in the Journal.
+type JournalEntry struct {
+	// Seq is the position of the entry in the journal
+	Seq uint64 `json:"-"`
+
+	ID      string
+	Project string
+	Params  types.Params
+	Env     map[string]string
+	Group   string
+	Rebuild bool
+	Timeout time.Duration
+
+	Priority    int
+	RequestedBy string
+
+	// Started is true if a worker started building the job
+	Started bool
+
+	// Interruptions is the number of times the build of the job was
+	// interrupted before completing
+	Interruptions int
+}
+
+// OpenJournal opens the journal found in buildPath, creating it if it doesn't
+// exist.
+//
+// Servers operating on the same build path share the same journal, which is
+// closed when all of them have closed it.
+func OpenJournal(buildPath string) (*Journal, error) {
+	path := filepath.Join(buildPath, JournalFname)
+
+	db, err := openSharedDB(path, func(db *sharedDB) error {
+		return db.Update(func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists(entriesBucket)
+			return err
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot open journal %s; %s", path, err)
+	}
+
+	return &Journal{db: db}, nil
+}
+
+// Close closes the journal, once it's closed by all of its users.
+func (jr *Journal) Close() error {
+	return jr.db.Close()
+}
+
+// Append records j at the end of the journal and returns the sequence
+// number of its entry.
+func (jr *Journal) Append(j *Job) (uint64, error) {
+	e := JournalEntry{
+		ID:      j.ID,
+		Project: j.Project,
+		Params:  j.Params,
+		Env:     j.Env,
+		Group:   j.Group,
+		Rebuild: j.Rebuild,
+		Timeout: j.Timeout,
+
+		Priority:    j.Priority,
+		RequestedBy: j.RequestedBy,
+	}
+
+	err := jr.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		e.Seq, err = tx.Bucket(entriesBucket).NextSequence()
+		if err != nil {
+			return err
+		}
+		return putEntry(tx, e)
+	})
+
+	return e.Seq, err
+}
+
+// Update replaces the entry denoted by e.Seq with e.
+func (jr *Journal) Update(e JournalEntry) error {
+	return jr.db.Update(func(tx *bolt.Tx) error {
+		return putEntry(tx, e)
+	})
+}
+
+// MarkStarted records that the build of the job with the given sequence
+// number has started.
+func (jr *Journal) MarkStarted(seq uint64) error {
+	return jr.db.Update(func(tx *bolt.Tx) error {
+		v := tx.Bucket(entriesBucket).Get(seqKey(seq))
+		if v == nil {
+			return fmt.Errorf("journal entry %d not found", seq)
+		}
+
+		var e JournalEntry
+		err := json.Unmarshal(v, &e)
+		if err != nil {
+			return err
+		}
+		e.Seq = seq
+		e.Started = true
+
+		return putEntry(tx, e)
+	})
+}
+
+// Delete removes the entry with the given sequence number, if it exists.
+func (jr *Journal) Delete(seq uint64) error {
+	return jr.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(entriesBucket).Delete(seqKey(seq))
+	})
+}
+
+// Entries returns all the entries of the journal, in the order they were
+// appended.
+func (jr *Journal) Entries() ([]JournalEntry, error) {
+	entries := []JournalEntry{}
+
+	err := jr.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(entriesBucket).ForEach(func(k, v []byte) error {
+			var e JournalEntry
+			err := json.Unmarshal(v, &e)
+			if err != nil {
+				return fmt.Errorf("cannot decode journal entry %x; %s", k, err)
+			}
+			e.Seq = binary.BigEndian.Uint64(k)
+			entries = append(entries, e)
+			return nil
+		})
+	})
+
+	return entries, err
+}
+
+func putEntry(tx *bolt.Tx, e JournalEntry) error {
+	v, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(entriesBucket).Put(seqKey(e.Seq), v)
+}
+
+func seqKey(seq uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return k
+}
+
+// RequeueJobs re-enqueues the jobs of the journal that were accepted but not
+// built before the server last stopped, in their original order. Jobs that
+// were interrupted while being built are re-enqueued according to the
+// configured RequeuePolicy; the rest are dropped.
+//
+// Jobs are handed to the workers in the background, as soon as there's room
+// in the backlog.
+func (s *Server) RequeueJobs() error {
+	entries, err := s.journal.Entries()
+	if err != nil {
+		return err
+	}
+
+	jobs := []*Job{}
+	seqs := []uint64{}
+	requeued := make(map[string]bool)
+
+	for _, e := range entries {
+		if e.Started {
+			e.Started = false
+			e.Interruptions++
+		}
+
+		// coalesced jobs are only built once anyway
+		drop := requeued[e.ID]
+		if !s.cfg.RequeueInterrupted.Allows(e.Interruptions) {
+			s.Log.Printf("Dropping job %s of project %s; interrupted %d time(s)", e.ID, e.Project, e.Interruptions)
+			drop = true
+		}
+
+		var j *Job
+		if !drop {
+			j, err = NewJob(e.Project, e.Params, e.Env, e.Group, s.cfg)
+			if err != nil {
+				s.Log.Printf("Dropping job %s of project %s; %s", e.ID, e.Project, err)
+				drop = true
+			}
+		}
+
+		if drop {
+			err = s.journal.Delete(e.Seq)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err = s.journal.Update(e)
+		if err != nil {
+			return err
+		}
+
+		j.Rebuild = e.Rebuild
+		j.Timeout = e.Timeout
+		j.Priority = e.Priority
+		j.RequestedBy = e.RequestedBy
+		jobs = append(jobs, j)
+		seqs = append(seqs, e.Seq)
+		requeued[e.ID] = true
+	}
+
+	if len(jobs) == 0 {
+		return nil
+	}
+
+	s.Log.Printf("Re-enqueueing %d job(s) from the journal...", len(jobs))
+	go func() {
+		for i, j := range jobs {
+			err := s.workerPool.requeue(j, seqs[i])
+			if err != nil {
+				s.Log.Printf("Cannot re-enqueue %s; %s", j, err)
+				return
+			}
+		}
+	}()
+
+	return nil
+}
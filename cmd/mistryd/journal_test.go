@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/skroutz/mistry/pkg/types"
+)
+
+func TestJournal(t *testing.T) {
+	path, err := ioutil.TempDir("", "mistry-test-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	jr, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jr.Close()
+
+	seqs := []uint64{}
+	for _, v := range []string{"a", "b", "c"} {
+		j, err := NewJob("simple", types.Params{"test": v}, nil, "", testcfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seq, err := jr.Append(j)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seqs = append(seqs, seq)
+	}
+
+	err = jr.MarkStarted(seqs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = jr.Delete(seqs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := jr.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(len(entries), 2, t)
+	assertEq(entries[0].Seq, seqs[1], t)
+	assertEq(entries[0].Params, types.Params{"test": "b"}, t)
+	assertEq(entries[0].Started, true, t)
+	assertEq(entries[1].Seq, seqs[2], t)
+	assertEq(entries[1].Started, false, t)
+}
+
+func TestRequeueJobs(t *testing.T) {
+	// a server without workers keeps the re-enqueued jobs in its queue
+	cfg := *testcfg
+	cfg.Concurrency = 0
+	cfg.Backlog = 10
+	cfg.RequeueInterrupted = RequeueOnce
+	path, err := ioutil.TempDir("", "mistry-test-requeue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+	cfg.BuildPath = path
+
+	s, err := NewServer(&cfg, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.workerPool.Stop()
+
+	record := func(params types.Params, started bool, interruptions int) *Job {
+		j, err := NewJob("simple", params, nil, "", &cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seq, err := s.journal.Append(j)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.journal.Update(JournalEntry{Seq: seq, ID: j.ID, Project: j.Project,
+			Params: j.Params, Started: started, Interruptions: interruptions})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return j
+	}
+
+	queued := record(types.Params{"test": "queued"}, false, 0)
+	interrupted := record(types.Params{"test": "interrupted"}, true, 0)
+	record(types.Params{"test": "interrupted-twice"}, true, 1)
+	record(types.Params{"test": "queued"}, false, 0)
+
+	err = s.RequeueJobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 20 && s.workerPool.queue.Len() < 2; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if s.workerPool.queue.Len() != 2 {
+		t.Fatalf("expected 2 re-enqueued jobs, got %d", s.workerPool.queue.Len())
+	}
+	qi, _ := s.workerPool.queue.Pop()
+	assertEq(qi.wi.job.ID, queued.ID, t)
+	qi, _ = s.workerPool.queue.Pop()
+	assertEq(qi.wi.job.ID, interrupted.ID, t)
+
+	entries, err := s.journal.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(len(entries), 2, t)
+	assertEq(entries[1].Started, false, t)
+	assertEq(entries[1].Interruptions, 1, t)
+}
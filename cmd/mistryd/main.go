@@ -15,12 +15,18 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
+	"net"
+	"net/url"
 	"os"
+	"os/signal"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
 	"github.com/skroutz/mistry/pkg/filesystem"
@@ -46,6 +52,10 @@ const (
 	// parameters of the build.
 	ParamsDir = "/params"
 
+	// SecretsDir is the path where the secrets granted to a project are
+	// mounted inside its build containers.
+	SecretsDir = "/run/secrets"
+
 	// BuildLogFname is the file inside DataDir, containing the build log.
 	BuildLogFname = "out.log"
 
@@ -53,6 +63,27 @@ const (
 	// info.
 	BuildInfoFname = "build_info.json"
 
+	// ArtifactsArchiveFname is the file inside the build directory,
+	// containing the tar archive of the build artifacts. It is created
+	// the first time the artifacts are requested over HTTP.
+	ArtifactsArchiveFname = "artifacts.tar"
+
+	// BuildIndexFname is the file inside the build path, containing the
+	// index of the builds.
+	BuildIndexFname = "index.db"
+
+	// JournalFname is the file inside the build path, containing the
+	// journal of the accepted jobs.
+	JournalFname = "journal.db"
+
+	// DrainsFname is the file inside the build path, containing the
+	// projects that are drained (see Drains).
+	DrainsFname = "drains.json"
+
+	// ProjectFname is the file inside a project's directory, containing
+	// the settings of the project (see ProjectSettings).
+	ProjectFname = "mistry.json"
+
 	// ImgCntPrefix is the common prefix added to the names of all
 	// Docker images/containers created by mistry.
 	ImgCntPrefix = "mistry-"
@@ -114,7 +145,9 @@ func main() {
 		if err != nil {
 			return err
 		}
-		return StartServer(cfg)
+		return StartServer(cfg, func() (*Config, error) {
+			return parseConfigFromCli(c)
+		})
 	}
 	app.Commands = []cli.Command{
 		{
@@ -152,6 +185,149 @@ func main() {
 				return nil
 			},
 		},
+		{
+			Name:  "agent",
+			Usage: "Build the jobs of a coordinator mistryd, instead of accepting jobs from clients.",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "coordinator",
+					Usage: "the base URL of the coordinator (eg. http://mistry.example.com:8462)",
+				},
+				cli.StringFlag{
+					Name:  "name",
+					Usage: "the name of the agent, unique among the agents of the coordinator (default: the host and port of --url)",
+				},
+				cli.StringFlag{
+					Name:  "url",
+					Usage: "the base URL that clients reach the agent at, to fetch logs and artifacts (default: derived from --addr and the hostname)",
+				},
+				cli.StringFlag{
+					Name:   "token",
+					Usage:  "the API token to authenticate with, if the coordinator requires one",
+					EnvVar: "MISTRY_TOKEN",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if c.String("coordinator") == "" {
+					return errors.New("--coordinator is required")
+				}
+
+				cfg, err := parseConfigFromCli(c.Parent())
+				if err != nil {
+					return err
+				}
+
+				info := AgentInfo{Name: c.String("name"), URL: c.String("url")}
+				if info.URL == "" {
+					info.URL, err = agentURL(cfg.Addr)
+					if err != nil {
+						return err
+					}
+				}
+				if info.Name == "" {
+					u, err := url.Parse(info.URL)
+					if err != nil {
+						return fmt.Errorf("invalid agent URL; %s", err)
+					}
+					info.Name = u.Host
+				}
+
+				err = SetUp(cfg)
+				if err != nil {
+					return err
+				}
+				return StartAgent(cfg, info, c.String("coordinator"), c.String("token"))
+			},
+		},
+		{
+			Name:  "drain",
+			Usage: "Stop the running server, or one of its projects, from accepting new builds.",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "project, p",
+					Usage: "the project to drain. If not passed, the whole server is drained",
+				},
+				cli.StringFlag{
+					Name:  "reason",
+					Usage: "the reason reported to clients whose builds are rejected",
+				},
+				cli.DurationFlag{
+					Name:  "duration",
+					Usage: "how long the drain is expected to last, used to advise clients when to retry",
+				},
+				cli.StringFlag{
+					Name:   "token",
+					Usage:  "the API token to authenticate with, if the server requires one",
+					EnvVar: "MISTRY_TOKEN",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				req := DrainRequest{
+					Project:  c.String("project"),
+					Reason:   c.String("reason"),
+					Duration: Duration(c.Duration("duration")),
+				}
+				body, err := json.Marshal(req)
+				if err != nil {
+					return err
+				}
+
+				st, err := requestDrain(c.Parent().String("addr"), c.String("token"), "PUT", "", body)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("Drained %s.\n%s", drainTarget(req.Project), st)
+				return nil
+			},
+		},
+		{
+			Name:  "undrain",
+			Usage: "Lift a drain of the running server, or of one of its projects.",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "project, p",
+					Usage: "the project to undrain. If not passed, the drain of the whole server is lifted",
+				},
+				cli.StringFlag{
+					Name:   "token",
+					Usage:  "the API token to authenticate with, if the server requires one",
+					EnvVar: "MISTRY_TOKEN",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				project := c.String("project")
+				st, err := requestDrain(c.Parent().String("addr"), c.String("token"), "DELETE",
+					"project="+url.QueryEscape(project), nil)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("Undrained %s.\n%s", drainTarget(project), st)
+				return nil
+			},
+		},
+		{
+			Name:  "reindex",
+			Usage: "Rebuild the build index from the builds found in the build path. The server should not be running.",
+			Action: func(c *cli.Context) error {
+				cfg, err := parseConfigFromCli(c.Parent())
+				if err != nil {
+					return err
+				}
+
+				idx, err := OpenBuildIndex(cfg.BuildPath)
+				if err != nil {
+					return err
+				}
+				defer idx.Close()
+
+				n, err := idx.Rebuild()
+				if err != nil {
+					return fmt.Errorf("cannot rebuild index; %s", err)
+				}
+				fmt.Printf("Finished. Indexed %d builds\n", n)
+				return nil
+			},
+		},
 	}
 
 	err := app.Run(os.Args)
@@ -187,24 +363,123 @@ func parseConfigFromCli(c *cli.Context) (*Config, error) {
 	return cfg, nil
 }
 
-// StartServer sets up and spawns starts the HTTP server
-func StartServer(cfg *Config) error {
-	var wg sync.WaitGroup
+// StartServer sets up and spawns starts the HTTP server. The server is
+// shut down gracefully upon SIGTERM or SIGINT.
+//
+// Upon SIGHUP, the configuration is reloaded using reload, if not nil, and
+// the worker pool is resized according to job_concurrency and job_backlog.
+// Other settings are not reloaded.
+func StartServer(cfg *Config, reload func() (*Config, error)) error {
 	s, err := NewServer(cfg, log.New(os.Stderr, "[http] ", log.LstdFlags), true)
 	if err != nil {
 		return err
 	}
 
-	wg.Add(1)
+	err = s.RequeueJobs()
+	if err != nil {
+		return fmt.Errorf("cannot re-enqueue jobs from the journal; %s", err)
+	}
+
+	// agents don't run the schedules, since they build the scheduled
+	// jobs of their coordinator
+	go s.scheduler.Run()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(sigs)
+
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	defer signal.Stop(hups)
+
+	errs := make(chan error, 1)
 	go func() {
-		defer wg.Done()
-		err := s.ListenAndServe()
-		if err != nil {
-			log.Fatal(err)
+		errs <- s.ListenAndServe()
+	}()
+	s.Log.Printf("Listening on %s...", cfg.Addr)
+
+loop:
+	for {
+		select {
+		case err := <-errs:
+			return err
+		case sig := <-sigs:
+			s.Log.Printf("Received %s", sig)
+			break loop
+		case <-hups:
+			if reload == nil {
+				s.Log.Print("Received SIGHUP; configuration cannot be reloaded")
+				continue
+			}
+			s.Log.Print("Received SIGHUP; reloading configuration...")
+			newCfg, err := reload()
+			if err != nil {
+				s.Log.Printf("Cannot reload configuration; %s", err)
+				continue
+			}
+			err = s.workerPool.Resize(newCfg.Concurrency, newCfg.Backlog)
+			if err != nil {
+				s.Log.Printf("Cannot resize worker pool; %s", err)
+			}
 		}
+	}
+
+	return s.Shutdown(time.Duration(cfg.ShutdownGracePeriod))
+}
+
+// StartAgent starts a server that builds the jobs of the coordinator at the
+// given base URL (see Agent). Upon SIGTERM or SIGINT, the agent stops
+// receiving jobs and the server is shut down gracefully, after the results
+// of its builds are reported to the coordinator.
+func StartAgent(cfg *Config, info AgentInfo, coordinator, token string) error {
+	s, err := NewServer(cfg, log.New(os.Stderr, "[agent] ", log.LstdFlags), true)
+	if err != nil {
+		return err
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(sigs)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.ListenAndServe()
 	}()
 	s.Log.Printf("Listening on %s...", cfg.Addr)
-	wg.Wait()
-	s.workerPool.Stop()
-	return nil
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		NewAgent(s, info, coordinator, token).Run(ctx)
+		close(done)
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-sigs:
+		s.Log.Printf("Received %s", sig)
+	}
+
+	cancel()
+	err = s.Shutdown(time.Duration(cfg.ShutdownGracePeriod))
+	<-done
+	return err
+}
+
+// agentURL returns the base URL of an agent listening on addr. If addr has
+// no specific host, the hostname of the machine is used.
+func agentURL(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid address; %s", err)
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host, err = os.Hostname()
+		if err != nil {
+			return "", err
+		}
+	}
+	return "http://" + net.JoinHostPort(host, port), nil
 }
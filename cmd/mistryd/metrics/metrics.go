@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"strconv"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -22,6 +23,8 @@ type Recorder struct {
 	BuildsSucceeded              *prometheus.HistogramVec
 	BuildsFailed                 *prometheus.HistogramVec
 	CacheUtilization             *prometheus.CounterVec
+	JobsQueued                   *prometheus.GaugeVec
+	QueueWait                    *prometheus.HistogramVec
 }
 
 const namespace = "mistry"
@@ -109,6 +112,25 @@ func NewRecorder(logger *log.Logger) *Recorder {
 		[]string{"project"},
 	)
 
+	r.JobsQueued = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "jobs_queued",
+			Help:      "The number of jobs waiting for a worker, by priority",
+		},
+		[]string{"priority"},
+	)
+
+	r.QueueWait = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "queue_wait_seconds",
+			Help:      "Time jobs spent waiting for a worker, by priority.",
+			Buckets:   prometheus.ExponentialBuckets(1, 4, 7),
+		},
+		[]string{"priority"},
+	)
+
 	return r
 }
 
@@ -173,3 +195,27 @@ func (r *Recorder) RecordBuildFinished(
 func (r *Recorder) RecordCacheUtilization(project string) {
 	r.CacheUtilization.With(prometheus.Labels{"project": project}).Inc()
 }
+
+// RecordJobQueued records a job of the given priority added to the queue.
+func (r *Recorder) RecordJobQueued(priority int) {
+	r.JobsQueued.With(priorityLabels(priority)).Inc()
+}
+
+// RecordJobDequeued records a job of the given priority picked up by a worker
+// after waiting in the queue for wait.
+func (r *Recorder) RecordJobDequeued(priority int, wait time.Duration) {
+	labels := priorityLabels(priority)
+
+	r.JobsQueued.With(labels).Dec()
+	r.QueueWait.With(labels).Observe(wait.Seconds())
+}
+
+// RecordJobDropped records a job of the given priority removed from the queue
+// before any worker picked it up.
+func (r *Recorder) RecordJobDropped(priority int) {
+	r.JobsQueued.With(priorityLabels(priority)).Dec()
+}
+
+func priorityLabels(priority int) prometheus.Labels {
+	return prometheus.Labels{"priority": strconv.Itoa(priority)}
+}
@@ -100,7 +100,7 @@ func TestMain(m *testing.M) {
 		if err != nil {
 			panic(err)
 		}
-		err = StartServer(testcfg)
+		err = StartServer(testcfg, nil)
 		if err != nil {
 			panic(err)
 		}
@@ -166,7 +166,7 @@ func TestRebuildImages(t *testing.T) {
 		t.Fatalf("mistry-cli stdout: %s, stderr: %s, err: %#v", cmdout, cmderr, err)
 	}
 
-	j, err := NewJob("simple", params, "", testcfg)
+	j, err := NewJob("simple", params, nil, "", testcfg)
 	if err != nil {
 		t.Fatalf("%s", err)
 	}
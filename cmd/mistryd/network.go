@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// DefaultNetworkMode is the network mode of both phases of builds, unless
+// another one is configured.
+const DefaultNetworkMode = "host"
+
+// NetworkModes are the Docker network modes of the two phases of a build:
+// building the image of the project and running the build container. Modes
+// are "host", "bridge", "none" or the name of a user-defined network; the
+// build container may also use "container:<name>". Empty modes are
+// inherited.
+//
+// Like Resources, modes are configured server-wide, in the settings of each
+// project and for each project in the server's configuration, each
+// overriding the previous ones. In configuration files, a string sets the
+// mode of both phases.
+type NetworkModes struct {
+	Build string `json:"build"`
+	Run   string `json:"run"`
+}
+
+var networkModeRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// UnmarshalJSON parses NetworkModes from a JSON object, or from a string
+// that sets the mode of both phases.
+func (n *NetworkModes) UnmarshalJSON(data []byte) error {
+	var mode string
+	if err := json.Unmarshal(data, &mode); err == nil {
+		n.Build, n.Run = mode, mode
+		return nil
+	}
+
+	// avoid recursing into this method
+	type modes NetworkModes
+	return json.Unmarshal(data, (*modes)(n))
+}
+
+func (n NetworkModes) validate() error {
+	if n.Build != "" && !networkModeRegexp.MatchString(n.Build) {
+		return fmt.Errorf("invalid network mode '%s' of the image build", n.Build)
+	}
+	if n.Run != "" && !networkModeRegexp.MatchString(strings.TrimPrefix(n.Run, "container:")) {
+		return fmt.Errorf("invalid network mode '%s' of the build container", n.Run)
+	}
+	return nil
+}
+
+// Override returns n with the modes set in o overriding its own.
+func (n NetworkModes) Override(o NetworkModes) NetworkModes {
+	if o.Build != "" {
+		n.Build = o.Build
+	}
+	if o.Run != "" {
+		n.Run = o.Run
+	}
+	return n
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/skroutz/mistry/pkg/types"
+)
+
+func TestNetworkModes(t *testing.T) {
+	var n NetworkModes
+	failIfError(json.Unmarshal([]byte(`"none"`), &n), t)
+	assertEq(n, NetworkModes{Build: "none", Run: "none"}, t)
+
+	n = NetworkModes{}
+	failIfError(json.Unmarshal([]byte(`{"run": "bridge"}`), &n), t)
+	assertEq(n, NetworkModes{Run: "bridge"}, t)
+
+	for _, valid := range []NetworkModes{{}, {Build: "host", Run: "none"}, {Run: "container:proxy"}, {Build: "my_net.1"}} {
+		failIfError(valid.validate(), t)
+	}
+	for _, invalid := range []NetworkModes{{Build: "container:proxy"}, {Run: "container:"}, {Run: "-x"}, {Build: "a b"}} {
+		if invalid.validate() == nil {
+			t.Errorf("expected error for %#v", invalid)
+		}
+	}
+}
+
+func TestJobNetwork(t *testing.T) {
+	cfg, err := ParseConfig("localhost:8462", nil, strings.NewReader(`{"projects_path": "testdata/projects",
+		"build_path": "/tmp", "network_mode": {"run": "bridge"},
+		"projects": {"params": {"network_mode": "none"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEq(cfg.JobNetwork("simple", ProjectSettings{}), NetworkModes{Build: "host", Run: "bridge"}, t)
+	assertEq(cfg.JobNetwork("params", ProjectSettings{}), NetworkModes{Build: "none", Run: "none"}, t)
+
+	j, err := NewJob("settings", types.Params{"name": "net"}, nil, "", cfg)
+	failIfError(err, t)
+	assertEq(j.Network, NetworkModes{Build: "host", Run: "none"}, t)
+
+	s, cleanup := newAgentServer(t, 0, testcfg.ProjectsPath)
+	defer cleanup()
+	bi := s.newBuildInfo(j)
+	assertEq(bi.BuildNetworkMode, "host", t)
+	assertEq(bi.RunNetworkMode, "none", t)
+
+	_, err = ParseConfig("localhost:8462", nil, strings.NewReader(`{"projects_path": "testdata/projects",
+		"build_path": "/tmp", "network_mode": {"build": "container:foo"}}`))
+	if err == nil {
+		t.Fatal("expected error for invalid network mode")
+	}
+}
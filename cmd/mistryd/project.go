@@ -0,0 +1,436 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/skroutz/mistry/pkg/types"
+	"github.com/skroutz/mistry/pkg/utils"
+)
+
+// ProjectSettings are the settings of a project, found in the ProjectFname
+// file of the project's directory, next to its Dockerfile. They override the
+// server defaults for the builds of the project.
+type ProjectSettings struct {
+	// Timeout is the default maximum duration of the project's builds.
+	// The timeout configured for the project in the server's configuration
+	// takes precedence.
+	Timeout Duration `json:"timeout"`
+
+	// Env contains the environment variables of the build container.
+	Env map[string]string `json:"env"`
+
+	// Mounts are the paths from the host that are mounted inside the build
+	// container, in addition to the server's mounts.
+	Mounts map[string]string `json:"mounts"`
+
+	// NetworkMode are the network modes of the image build and the
+	// build container, overriding the server's.
+	NetworkMode NetworkModes `json:"network_mode"`
+
+	// Resources are the limits of the build container, overriding the
+	// server's default limits.
+	Resources Resources `json:"resources"`
+
+	// Params describe the params the builds of the project accept. Params
+	// not described are accepted as well.
+	Params map[string]ParamSpec `json:"params"`
+
+	Retention Retention `json:"retention"`
+}
+
+// ParamSpec describes a param of the builds of a project.
+type ParamSpec struct {
+	Description string `json:"description,omitempty"`
+
+	// Required determines whether builds must be given the param.
+	Required bool `json:"required,omitempty"`
+
+	// Pattern is a regular expression that the whole value must match.
+	Pattern string `json:"pattern,omitempty"`
+
+	// Values are the values the param may have. Empty means any value.
+	Values []string `json:"values,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// Retention determines how many of the ready builds of a project are kept.
+// Builds that are pointed to by the latest link, or the link of a group, are
+// always kept. Zero values mean no limit.
+type Retention struct {
+	// MaxBuilds is the maximum number of ready builds.
+	MaxBuilds int `json:"max_builds"`
+
+	// MaxAge is how long ready builds are kept after they're started.
+	MaxAge Duration `json:"max_age"`
+}
+
+// ReadProjectSettings reads the settings of the project found in
+// projectPath. If the project has no ProjectFname file, the zero settings
+// are returned.
+func ReadProjectSettings(projectPath string) (ProjectSettings, error) {
+	var ps ProjectSettings
+
+	f, err := os.Open(filepath.Join(projectPath, ProjectFname))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ps, nil
+		}
+		return ps, err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&ps)
+	if err != nil {
+		return ps, fmt.Errorf("could not parse %s; %s", ProjectFname, err)
+	}
+
+	err = ps.validate()
+	if err != nil {
+		return ps, fmt.Errorf("invalid %s; %s", ProjectFname, err)
+	}
+	return ps, nil
+}
+
+func (ps *ProjectSettings) validate() error {
+	if ps.Timeout < 0 {
+		return errors.New("timeout cannot be negative")
+	}
+
+	err := ValidateEnv(ps.Env)
+	if err != nil {
+		return err
+	}
+
+	for src, target := range ps.Mounts {
+		if !filepath.IsAbs(src) || !filepath.IsAbs(target) {
+			return fmt.Errorf("paths of mount '%s' must be absolute", src)
+		}
+	}
+
+	err = ps.NetworkMode.validate()
+	if err != nil {
+		return err
+	}
+
+	err = ps.Resources.validate()
+	if err != nil {
+		return err
+	}
+
+	for name, spec := range ps.Params {
+		if spec.Pattern != "" {
+			re, err := regexp.Compile("^(?:" + spec.Pattern + ")$")
+			if err != nil {
+				return fmt.Errorf("invalid pattern of param '%s'; %s", name, err)
+			}
+			spec.re = re
+			ps.Params[name] = spec
+		}
+	}
+
+	if ps.Retention.MaxBuilds < 0 || ps.Retention.MaxAge < 0 {
+		return errors.New("retention cannot be negative")
+	}
+
+	return nil
+}
+
+// ValidateEnv returns an error if env contains an environment variable that
+// cannot be passed to a container.
+func ValidateEnv(env map[string]string) error {
+	for k, v := range env {
+		if k == "" || strings.ContainsAny(k, "=\x00") || strings.Contains(v, "\x00") {
+			return fmt.Errorf("invalid environment variable '%s'", k)
+		}
+	}
+	return nil
+}
+
+// ValidateParams returns an error if params don't conform to the params
+// described in ps.
+func (ps ProjectSettings) ValidateParams(params types.Params) error {
+	names := make([]string, 0, len(ps.Params))
+	for name := range ps.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		spec := ps.Params[name]
+
+		v, ok := params[name]
+		if !ok {
+			if spec.Required {
+				return fmt.Errorf("param '%s' is required", name)
+			}
+			continue
+		}
+
+		if spec.re != nil && !spec.re.MatchString(v) {
+			return fmt.Errorf("param '%s' must match '%s'", name, spec.Pattern)
+		}
+
+		if len(spec.Values) > 0 {
+			valid := false
+			for _, allowed := range spec.Values {
+				if v == allowed {
+					valid = true
+					break
+				}
+			}
+			if !valid {
+				return fmt.Errorf("param '%s' must be one of %s", name, strings.Join(spec.Values, ", "))
+			}
+		}
+	}
+
+	return nil
+}
+
+// ProjectMounts returns the paths from the host that are mounted inside the
+// build containers of a project with the given settings.
+func (cfg *Config) ProjectMounts(ps ProjectSettings) map[string]string {
+	mounts := make(map[string]string)
+	for src, target := range cfg.Mounts {
+		mounts[src] = target
+	}
+	for src, target := range ps.Mounts {
+		mounts[src] = target
+	}
+	return mounts
+}
+
+// dockerSocket is the usual path of the socket of the Docker daemon, which
+// projects may never mount.
+const dockerSocket = "/var/run/docker.sock"
+
+// validateProjectMounts returns an error if ps mounts a path that is not
+// under cfg.AllowedMounts, or a path that overlaps the build path, the
+// secrets or the Docker socket of the server.
+func (cfg *Config) validateProjectMounts(ps ProjectSettings) error {
+	protected := []string{cfg.BuildPath, dockerSocket}
+	if cfg.SecretsPath != "" {
+		protected = append(protected, cfg.SecretsPath)
+	}
+
+	for src := range ps.Mounts {
+		path := resolvePath(src)
+
+		allowed := false
+		for _, dir := range cfg.AllowedMounts {
+			if isSubpath(path, resolvePath(dir)) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("mount '%s' is not under the allowed mounts of the server", src)
+		}
+
+		for _, p := range protected {
+			p = resolvePath(p)
+			if isSubpath(path, p) || isSubpath(p, path) {
+				return fmt.Errorf("mount '%s' overlaps '%s'", src, p)
+			}
+		}
+	}
+	return nil
+}
+
+// resolvePath returns the absolute path of path with any symlinks resolved,
+// as Docker resolves them when bind-mounting path. Paths that cannot be
+// resolved (eg. because they don't exist yet) are only cleaned.
+func resolvePath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+	resolved, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return abs
+	}
+	return resolved
+}
+
+// isSubpath reports whether path is dir or is under dir. Both should be
+// clean.
+func isSubpath(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// pruneBuilds removes the ready builds of j's project that exceed its
+// retention, along with their index entries, except for the ones that are
+// linked or in use (see BuildUsage). The project should be locked by the
+// caller.
+func (s *Server) pruneBuilds(j *Job) error {
+	r := j.Settings.Retention
+	if r.MaxBuilds == 0 && r.MaxAge == 0 {
+		return nil
+	}
+
+	linked := make(map[string]bool)
+	links, err := filepath.Glob(filepath.Join(j.RootBuildPath, "groups", "*"))
+	if err != nil {
+		return err
+	}
+	for _, link := range append(links, filepath.Join(j.RootBuildPath, "latest")) {
+		target, err := filepath.EvalSymlinks(link)
+		if err == nil {
+			linked[filepath.Base(target)] = true
+		}
+	}
+
+	readyPath := filepath.Join(j.RootBuildPath, "ready")
+	entries, err := ioutil.ReadDir(readyPath)
+	if err != nil {
+		return err
+	}
+
+	type build struct {
+		id        string
+		startedAt time.Time
+	}
+	builds := []build{}
+	for _, e := range entries {
+		bi, err := ReadJobBuildInfo(filepath.Join(readyPath, e.Name()), false)
+		if err != nil {
+			// not a complete build
+			continue
+		}
+		builds = append(builds, build{e.Name(), bi.StartedAt})
+	}
+	sort.Slice(builds, func(i, k int) bool { return builds[i].startedAt.After(builds[k].startedAt) })
+
+	now := time.Now()
+	for i, b := range builds {
+		if linked[b.id] {
+			continue
+		}
+		if (r.MaxBuilds > 0 && i >= r.MaxBuilds) || (r.MaxAge > 0 && now.Sub(b.startedAt) > time.Duration(r.MaxAge)) {
+			path := filepath.Join(readyPath, b.id)
+			removed, err := s.builds.Remove(path, func() error { return s.cfg.FileSystem.Remove(path) })
+			if err != nil {
+				return fmt.Errorf("could not remove build %s; %s", b.id, err)
+			}
+			if !removed {
+				// it's being served, it will be pruned later
+				continue
+			}
+			err = s.index.Delete(j.Project, b.id)
+			if err != nil {
+				return fmt.Errorf("could not remove build %s from the index; %s", b.id, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ProjectInfo is the response of the project info endpoint.
+type ProjectInfo struct {
+	Name string `json:"name"`
+
+	// Timeout, NetworkMode, Mounts and Resources are the effective
+	// settings of the project's builds, after applying the server
+	// defaults and overrides
+	Timeout     Duration          `json:"timeout"`
+	NetworkMode NetworkModes      `json:"networkMode"`
+	Mounts      map[string]string `json:"mounts"`
+	Resources   Resources         `json:"resources"`
+
+	// Secrets are the names of the secrets granted to the project
+	Secrets []string `json:"secrets"`
+
+	// Settings are the settings found in the project's directory
+	Settings ProjectSettings `json:"settings"`
+}
+
+// HandleProjects lists the projects that the requester is allowed to view,
+// or returns the info of a particular project (/projects/<project>).
+func (s *Server) HandleProjects(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Expected GET, got "+r.Method, http.StatusMethodNotAllowed)
+		return
+	}
+
+	var resp interface{}
+	project := strings.Trim(strings.TrimPrefix(r.URL.Path, "/projects"), "/")
+	if project == "" {
+		visible, err := s.visibleProjects(r)
+		if err != nil {
+			unauthorized(w, err)
+			return
+		}
+
+		projects, err := getProjects(s.cfg)
+		if err != nil {
+			s.Log.Print(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		names := []string{}
+		for _, p := range projects {
+			if visible == nil || visible[p] {
+				names = append(names, p)
+			}
+		}
+		resp = names
+	} else {
+		if _, ok := s.authorize(w, r, project, RoleView); !ok {
+			return
+		}
+
+		projectPath := filepath.Join(s.cfg.ProjectsPath, project)
+		if strings.Contains(project, "/") || utils.PathIsDir(projectPath) != nil {
+			http.Error(w, fmt.Sprintf("Unknown project '%s'", project), http.StatusNotFound)
+			return
+		}
+
+		ps, err := ReadProjectSettings(projectPath)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Cannot read settings of project '%s': %s", project, err),
+				http.StatusInternalServerError)
+			return
+		}
+
+		resp = ProjectInfo{
+			Name:        project,
+			Timeout:     Duration(s.cfg.JobTimeout(project, ps, 0)),
+			NetworkMode: s.cfg.JobNetwork(project, ps),
+			Mounts:      s.cfg.ProjectMounts(ps),
+			Resources:   s.cfg.JobResources(project, ps),
+			Secrets:     s.cfg.Projects[project].Secrets,
+			Settings:    ps,
+		}
+	}
+
+	out, err := json.Marshal(resp)
+	if err != nil {
+		s.Log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(out)
+	if err != nil {
+		s.Log.Printf("Error writing project response: %s", err)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/skroutz/mistry/pkg/types"
+)
+
+func TestReadProjectSettings(t *testing.T) {
+	ps, err := ReadProjectSettings(filepath.Join(testcfg.ProjectsPath, "simple"))
+	failIfError(err, t)
+	assertEq(ps.NetworkMode, NetworkModes{}, t)
+	assertEq(len(ps.Env), 0, t)
+
+	ps, err = ReadProjectSettings(filepath.Join(testcfg.ProjectsPath, "settings"))
+	failIfError(err, t)
+	assertEq(ps.Timeout, Duration(10*time.Minute), t)
+	assertEq(ps.Env, map[string]string{"GREETING": "hello"}, t)
+	assertEq(ps.NetworkMode, NetworkModes{Build: "host", Run: "none"}, t)
+	assertEq(ps.Resources.Memory, ByteSize(512*1024*1024), t)
+	assertEq(*ps.Resources.containerResources().PidsLimit, int64(100), t)
+	assertEq(ps.Resources.containerResources().NanoCPUs, int64(5e8), t)
+	assertEq(ps.Retention.MaxBuilds, 2, t)
+
+	assertEq(ps.ValidateParams(types.Params{"name": "foo", "_other": "bar"}), nil, t)
+	assertEq(ps.ValidateParams(types.Params{}).Error(), "param 'name' is required", t)
+	assertEq(ps.ValidateParams(types.Params{"name": "Foo"}).Error(), "param 'name' must match '[a-z]+'", t)
+	assertEq(ps.ValidateParams(types.Params{"name": "foo", "lang": "fr"}).Error(), "param 'lang' must be one of en, el", t)
+
+	path, err := ioutil.TempDir("", "mistry-test-settings")
+	failIfError(err, t)
+	defer os.RemoveAll(path)
+
+	for _, settings := range []string{
+		`{"timeout": "-1m"}`,
+		`{"mounts": {"relative": "/foo"}}`,
+		`{"params": {"foo": {"pattern": "("}}}`,
+		`{"resources": {"memory": "lots"}}`,
+		`{"unknown": true}`,
+	} {
+		failIfError(ioutil.WriteFile(filepath.Join(path, ProjectFname), []byte(settings), 0644), t)
+		_, err = ReadProjectSettings(path)
+		if err == nil {
+			t.Fatalf("expected error for %s", settings)
+		}
+	}
+}
+
+func TestValidateProjectMounts(t *testing.T) {
+	path, err := ioutil.TempDir("", "mistry-test-mounts")
+	failIfError(err, t)
+	defer os.RemoveAll(path)
+
+	for _, dir := range []string{"cache", "build", "secrets"} {
+		failIfError(os.Mkdir(filepath.Join(path, dir), 0755), t)
+	}
+	failIfError(os.Symlink(filepath.Join(path, "secrets"), filepath.Join(path, "cache", "link")), t)
+
+	cfg := *testcfg
+	cfg.AllowedMounts = []string{path, "/var/run"}
+	cfg.BuildPath = filepath.Join(path, "build")
+	cfg.SecretsPath = filepath.Join(path, "secrets")
+
+	mounts := func(src string) ProjectSettings {
+		return ProjectSettings{Mounts: map[string]string{src: "/mnt"}}
+	}
+
+	failIfError(cfg.validateProjectMounts(mounts(filepath.Join(path, "cache"))), t)
+	failIfError(cfg.validateProjectMounts(mounts(filepath.Join(path, "cache", "new"))), t)
+
+	for _, src := range []string{
+		"/etc",
+		filepath.Join(path, "..", "etc"),
+		path,
+		filepath.Join(path, "build", "foo"),
+		filepath.Join(path, "secrets"),
+		filepath.Join(path, "cache", "link"),
+		"/var/run/docker.sock",
+	} {
+		if cfg.validateProjectMounts(mounts(src)) == nil {
+			t.Fatalf("expected mount of %s to be rejected", src)
+		}
+	}
+
+	// projects may not mount anything without allowed mounts
+	cfg.AllowedMounts = nil
+	if cfg.validateProjectMounts(mounts(filepath.Join(path, "cache"))) == nil {
+		t.Fatal("expected mount to be rejected")
+	}
+}
+
+func TestPruneBuilds(t *testing.T) {
+	s, cleanup := newAgentServer(t, 0, testcfg.ProjectsPath)
+	defer cleanup()
+
+	j, err := NewJob("settings", types.Params{"name": "prune"}, nil, "", s.cfg)
+	failIfError(err, t)
+	failIfError(s.BootstrapProject(j), t)
+	readyPath := filepath.Join(j.RootBuildPath, "ready")
+
+	// builds from newest to oldest, the oldest being the latest one
+	now := time.Now()
+	ids := []string{"a", "b", "c", "d"}
+	for i, id := range ids {
+		path := filepath.Join(readyPath, id)
+		failIfError(os.MkdirAll(path, 0755), t)
+
+		bi := types.NewBuildInfo()
+		bi.StartedAt = now.Add(-time.Duration(i) * time.Hour)
+		out, err := json.Marshal(bi)
+		failIfError(err, t)
+		failIfError(ioutil.WriteFile(filepath.Join(path, BuildInfoFname), out, 0644), t)
+		failIfError(s.index.Put(j.Project, id, "ready", bi), t)
+	}
+	failIfError(os.Symlink(filepath.Join(readyPath, "d"), j.LatestBuildPath), t)
+
+	failIfError(s.pruneBuilds(j), t)
+
+	for id, kept := range map[string]bool{"a": true, "b": true, "c": false, "d": true} {
+		_, err := os.Stat(filepath.Join(readyPath, id))
+		assertEq(err == nil, kept, t)
+		_, err = s.index.Get(j.Project, id)
+		assertEq(err == nil, kept, t)
+	}
+
+	// builds that are being served, or were served recently, are kept
+	release, ok := s.builds.Use(filepath.Join(readyPath, "b"))
+	assert(ok, true, t)
+
+	j.Settings.Retention = Retention{MaxAge: Duration(30 * time.Minute)}
+	failIfError(s.pruneBuilds(j), t)
+	_, err = os.Stat(filepath.Join(readyPath, "b"))
+	failIfError(err, t)
+
+	release()
+	failIfError(s.pruneBuilds(j), t)
+	_, err = os.Stat(filepath.Join(readyPath, "b"))
+	failIfError(err, t)
+
+	s.builds = NewBuildUsage()
+	failIfError(s.pruneBuilds(j), t)
+	_, err = os.Stat(filepath.Join(readyPath, "b"))
+	assert(os.IsNotExist(err), true, t)
+	_, err = os.Stat(filepath.Join(readyPath, "a"))
+	failIfError(err, t)
+}
+
+func TestHandleProjects(t *testing.T) {
+	s, cleanup := newAgentServer(t, 0, testcfg.ProjectsPath)
+	defer cleanup()
+
+	rec := httptest.NewRecorder()
+	s.srv.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/projects", nil))
+	assertEq(rec.Code, 200, t)
+	projects := []string{}
+	failIfError(json.Unmarshal(rec.Body.Bytes(), &projects), t)
+	assertNotEq(len(projects), 0, t)
+
+	rec = httptest.NewRecorder()
+	s.srv.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/projects/settings", nil))
+	assertEq(rec.Code, 200, t)
+	info := ProjectInfo{}
+	failIfError(json.Unmarshal(rec.Body.Bytes(), &info), t)
+	assertEq(info.Name, "settings", t)
+	assertEq(info.NetworkMode, NetworkModes{Build: "host", Run: "none"}, t)
+	assertEq(info.Timeout, Duration(10*time.Minute), t)
+	assertEq(info.Settings.Env["GREETING"], "hello", t)
+	assertEq(info.Settings.Params["name"].Required, true, t)
+
+	rec = httptest.NewRecorder()
+	s.srv.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/projects/unknown", nil))
+	assertEq(rec.Code, 404, t)
+
+	// builds with invalid params are rejected
+	rec = httptest.NewRecorder()
+	s.srv.Handler.ServeHTTP(rec, httptest.NewRequest("POST", "/jobs?async",
+		bytes.NewBufferString(`{"project": "settings", "params": {"name": "Foo"}}`)))
+	assertEq(rec.Code, 400, t)
+}
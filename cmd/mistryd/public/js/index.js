@@ -1,16 +1,61 @@
 const JobsRoot = document.getElementById('js-jobs')
+const QueueRoot = document.getElementById('js-queue')
+
+// the API token, if the server requires one, is passed along from the URL of
+// the page since browsers can't set the Authorization header of links
+const AccessToken = new URLSearchParams(window.location.search).get("access_token")
+
+function withToken(url) {
+  if (!AccessToken) {
+    return url;
+  }
+  return url + (url.includes("?") ? "&" : "?") + "access_token=" + encodeURIComponent(AccessToken);
+}
 
 class Jobs extends React.Component {
   constructor(props) {
       super(props)
       this.every = props.every
-      this.state = {}
+      this.state = { filters: {}, cursors: [] }
     };
 
+  // cursor returns the cursor of the page being viewed; the first page has
+  // no cursor
+  cursor() {
+    let cursors = this.state.cursors;
+    return cursors.length > 0 ? cursors[cursors.length - 1] : "";
+  };
+
   fetchJobs() {
-    fetch("/index").
+    let params = new URLSearchParams({ limit: this.props.limit });
+    let filters = this.state.filters;
+    Object.keys(filters).forEach(k => {
+      if (filters[k] !== "") {
+        params.set(k, filters[k]);
+      }
+    });
+    if (this.cursor() !== "") {
+      params.set("cursor", this.cursor());
+    }
+
+    fetch(withToken("/index?" + params.toString())).
       then(response => response.json()).
-      then(data => this.setState({ jobs: data }));
+      then(data => this.setState({ jobs: data.jobs, next: data.next }));
+  };
+
+  setFilter(name, value) {
+    let filters = Object.assign({}, this.state.filters, { [name]: value });
+    this.setState({ filters: filters, cursors: [] }, () => this.fetchJobs());
+  };
+
+  nextPage() {
+    this.setState({ cursors: this.state.cursors.concat([this.state.next]) },
+      () => this.fetchJobs());
+  };
+
+  previousPage() {
+    this.setState({ cursors: this.state.cursors.slice(0, -1) },
+      () => this.fetchJobs());
   };
 
   componentDidMount() {
@@ -22,41 +67,211 @@ class Jobs extends React.Component {
     clearInterval(this.interval);
   };
 
+  renderFilters() {
+    return (
+      <div class="grid-x grid-padding-x">
+        <div class="medium-3 cell">
+          <input type="text" placeholder="Project"
+            onChange={e => this.setFilter("project", e.target.value)} />
+        </div>
+        <div class="medium-3 cell">
+          <input type="text" placeholder="Group"
+            onChange={e => this.setFilter("group", e.target.value)} />
+        </div>
+        <div class="medium-3 cell">
+          <select onChange={e => this.setFilter("state", e.target.value)}>
+            <option value="">Any state</option>
+            <option value="pending">pending</option>
+            <option value="ready">ready</option>
+          </select>
+        </div>
+        <div class="medium-3 cell">
+          <input type="number" placeholder="Exit code"
+            onChange={e => this.setFilter("exit_code", e.target.value)} />
+        </div>
+      </div>
+    );
+  };
+
+  renderPager() {
+    return (
+      <ul class="pagination text-center">
+        {this.state.cursors.length > 0 ?
+          <li class="pagination-previous"><a onClick={() => this.previousPage()}>Newer</a></li> :
+          <li class="pagination-previous disabled">Newer</li>}
+        {this.state.next ?
+          <li class="pagination-next"><a onClick={() => this.nextPage()}>Older</a></li> :
+          <li class="pagination-next disabled">Older</li>}
+      </ul>
+    );
+  };
+
   render() {
-    if (this.state.jobs == undefined) {
+    if (this.state.jobs == undefined || this.state.jobs.length == 0) {
       return (
+        <div>
+          {this.renderFilters()}
           <div class="jumbotron">
             <h3>No jobs...</h3>
           </div>
+        </div>
       );
     }
 
     let jobs = this.state.jobs;
+    return (
+      <div>
+        {this.renderFilters()}
+        <table class="hover unstriped">
+          <thead>
+            <tr>
+            <th>ID</th>
+            <th>Project</th>
+            <th>Group</th>
+            <th>Started At</th>
+            <th>State</th>
+            <th>Exit Code</th>
+            </tr>
+          </thead>
+          <tbody>
+            {jobs.map(function(j, idx){
+              return (
+                <tr key={idx}>
+                  <td><a href={withToken(`/job/${j.project}/${j.id}`)} > {j.id} </a></td>
+                  <td>{j.project}</td>
+                  <td>{j.buildInfo.Group}</td>
+                  <td>{j.startedAt}</td>
+                  <td>{j.state}</td>
+                  <td>{j.state == "ready" ? j.buildInfo.ExitCode : ""}</td>
+                </tr>
+              )
+             })}
+          </tbody>
+        </table>
+        {this.renderPager()}
+      </div>
+    );
+  }
+}
+
+// formatParams renders job params compactly; values may be whole files (eg.
+// lockfiles), so they're truncated
+function formatParams(params) {
+  return Object.keys(params || {}).map(k => {
+    let v = params[k];
+    return k + "=" + (v.length > 20 ? v.substring(0, 20) + "..." : v);
+  }).join(" ");
+}
+
+function formatTime(t) {
+  return t ? new Date(t).toLocaleTimeString() : "";
+}
+
+class Queue extends React.Component {
+  constructor(props) {
+      super(props)
+      this.every = props.every
+      this.state = { workers: [], queued: [] }
+    };
+
+  fetchQueue() {
+    fetch(withToken("/queue")).
+      then(response => response.json()).
+      then(data => this.setState({ workers: data.workers, queued: data.queued }));
+  };
+
+  componentDidMount() {
+    this.fetchQueue();
+    this.interval = setInterval(() => this.fetchQueue(), this.every);
+  };
+
+  componentWillUnmount() {
+    clearInterval(this.interval);
+  };
+
+  renderWorkers() {
     return (
       <table class="hover unstriped">
         <thead>
           <tr>
-          <th>ID</th>
+          <th>Worker</th>
+          <th>Job</th>
           <th>Project</th>
+          <th>Group</th>
           <th>Started At</th>
-          <th>State</th>
           </tr>
         </thead>
         <tbody>
-          {jobs.map(function(j, idx){
+          {this.state.workers.map(function(w){
+            if (!w.busy) {
+              return (<tr key={w.id}><td>{w.id}</td><td colSpan="4"><i>idle</i></td></tr>);
+            }
+            if (!w.job) {
+              return (<tr key={w.id}><td>{w.id}</td><td colSpan="4"><i>busy</i></td></tr>);
+            }
+            return (
+              <tr key={w.id}>
+                <td>{w.id}</td>
+                <td><a href={withToken("/" + w.job.url)}>{w.job.id}</a></td>
+                <td>{w.job.project}</td>
+                <td>{w.job.group}</td>
+                <td>{formatTime(w.startedAt)}</td>
+              </tr>
+            )
+          })}
+        </tbody>
+      </table>
+    );
+  };
+
+  renderQueued() {
+    if (this.state.queued.length == 0) {
+      return (<p>No jobs are waiting for a worker.</p>);
+    }
+
+    return (
+      <table class="hover unstriped">
+        <thead>
+          <tr>
+          <th>#</th>
+          <th>Job</th>
+          <th>Project</th>
+          <th>Group</th>
+          <th>Params</th>
+          <th>Priority</th>
+          <th>Enqueued At</th>
+          <th>Expected Start</th>
+          </tr>
+        </thead>
+        <tbody>
+          {this.state.queued.map(function(j){
             return (
-              <tr key={idx}>
-                <td><a href={`/job/${j.project}/${j.id}`} > {j.id} </a></td>
+              <tr key={j.position}>
+                <td>{j.position}</td>
+                <td>{j.id}</td>
                 <td>{j.project}</td>
-                <td>{j.startedAt}</td>
-                <td>{j.state}</td>
+                <td>{j.group}</td>
+                <td>{formatParams(j.params)}</td>
+                <td>{j.priority}</td>
+                <td>{formatTime(j.enqueuedAt)}</td>
+                <td>{formatTime(j.expectedStart)}</td>
               </tr>
             )
-           })}
+          })}
         </tbody>
       </table>
     );
+  };
+
+  render() {
+    return (
+      <div>
+        {this.renderWorkers()}
+        {this.renderQueued()}
+      </div>
+    );
   }
 }
 
-ReactDOM.render(<Jobs every={3000} />, JobsRoot)
+ReactDOM.render(<Queue every={3000} />, QueueRoot)
+ReactDOM.render(<Jobs every={3000} limit={50} />, JobsRoot)
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/skroutz/mistry/pkg/types"
+)
+
+// PoolJob is a job that is queued or running in the WorkerPool.
+type PoolJob struct {
+	ID       string       `json:"id"`
+	Project  string       `json:"project"`
+	Group    string       `json:"group"`
+	Params   types.Params `json:"params"`
+	Priority int          `json:"priority"`
+	URL      string       `json:"url"`
+}
+
+// QueuedJob is a job waiting for a worker.
+type QueuedJob struct {
+	PoolJob
+
+	// Position is the position of the job in the queue, starting from 1
+	Position   int       `json:"position"`
+	EnqueuedAt time.Time `json:"enqueuedAt"`
+
+	// ExpectedStart is an estimate of when a worker will pick up the job,
+	// based on the average time workers spend on each job. It is nil if
+	// there is no estimate yet.
+	ExpectedStart *time.Time `json:"expectedStart,omitempty"`
+}
+
+// WorkerReport is the state of a worker.
+type WorkerReport struct {
+	ID int `json:"id"`
+
+	// Busy is true if the worker is processing a job, which is Job unless
+	// the requester is not allowed to view it
+	Busy      bool       `json:"busy"`
+	Job       *PoolJob   `json:"job,omitempty"`
+	StartedAt *time.Time `json:"startedAt,omitempty"`
+}
+
+// QueueReport is the response of the queue endpoint.
+type QueueReport struct {
+	Workers []WorkerReport `json:"workers"`
+	Queued  []QueuedJob    `json:"queued"`
+}
+
+// Queue reports the jobs waiting in p, in the order they are expected to be
+// built, along with the state of each worker.
+func (p *WorkerPool) Queue() QueueReport {
+	queued := p.queue.Snapshot()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	report := QueueReport{Workers: []WorkerReport{}, Queued: []QueuedJob{}}
+
+	// slots contains the time each worker is expected to become free
+	slots := []time.Time{}
+	now := time.Now()
+
+	for id, wi := range p.current {
+		wr := WorkerReport{ID: id}
+		if wi == nil {
+			slots = append(slots, now)
+		} else {
+			startedAt := wi.startedAt
+			job := newPoolJob(wi.job)
+			wr.Busy, wr.Job, wr.StartedAt = true, &job, &startedAt
+
+			free := startedAt.Add(p.avgDuration)
+			if free.Before(now) {
+				free = now
+			}
+			slots = append(slots, free)
+		}
+		report.Workers = append(report.Workers, wr)
+	}
+	sort.Slice(report.Workers, func(i, j int) bool {
+		return report.Workers[i].ID < report.Workers[j].ID
+	})
+
+	// while the pool is shrinking, busy workers exit when they're done
+	sort.Slice(slots, func(i, j int) bool { return slots[i].Before(slots[j]) })
+	if len(slots) > p.concurrency {
+		slots = slots[:p.concurrency]
+	}
+
+	for i, qi := range queued {
+		qj := QueuedJob{
+			PoolJob:    newPoolJob(qi.wi.job),
+			Position:   i + 1,
+			EnqueuedAt: qi.enqueuedAt,
+		}
+
+		// the job is picked up by the worker that becomes free first
+		if len(slots) > 0 && (p.avgDuration > 0 || !slots[0].After(now)) {
+			start := slots[0]
+			qj.ExpectedStart = &start
+			slots[0] = start.Add(p.avgDuration)
+			sort.Slice(slots, func(i, j int) bool { return slots[i].Before(slots[j]) })
+		}
+
+		report.Queued = append(report.Queued, qj)
+	}
+
+	return report
+}
+
+func newPoolJob(j *Job) PoolJob {
+	return PoolJob{
+		ID:       j.ID,
+		Project:  j.Project,
+		Group:    j.Group,
+		Params:   j.Params,
+		Priority: j.Priority,
+		URL:      getJobURL(j),
+	}
+}
+
+// HandleQueue lists the jobs waiting for a worker and the jobs each worker
+// is running. Jobs of projects that the requester is not allowed to view
+// are omitted.
+func (s *Server) HandleQueue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Expected GET, got "+r.Method, http.StatusMethodNotAllowed)
+		return
+	}
+
+	visible, err := s.visibleProjects(r)
+	if err != nil {
+		unauthorized(w, err)
+		return
+	}
+
+	report := s.workerPool.Queue()
+	if visible != nil {
+		for i, wr := range report.Workers {
+			if wr.Job != nil && !visible[wr.Job.Project] {
+				report.Workers[i].Job = nil
+			}
+		}
+
+		queued := []QueuedJob{}
+		for _, qj := range report.Queued {
+			if visible[qj.Project] {
+				queued = append(queued, qj)
+			}
+		}
+		report.Queued = queued
+	}
+
+	resp, err := json.Marshal(report)
+	if err != nil {
+		s.Log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(resp)
+	if err != nil {
+		s.Log.Printf("Error writing queue response: %s", err)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/skroutz/mistry/pkg/types"
+)
+
+func TestWorkerPoolQueue(t *testing.T) {
+	s, cleanup := newAuthServer(t)
+	defer cleanup()
+
+	send := func(project string, params types.Params, priority int) *Job {
+		j, err := NewJob(project, params, nil, "", s.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		j.Priority = priority
+		_, err = s.workerPool.SendWork(j)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return j
+	}
+
+	low := send("simple", types.Params{"test": "queue-low"}, 0)
+	high := send("simple", types.Params{"test": "queue-high"}, 5)
+	other := send("sleep", types.Params{"test": "queue-other"}, 0)
+
+	report := s.workerPool.Queue()
+	assertEq(len(report.Workers), 0, t)
+	assertEq(len(report.Queued), 3, t)
+
+	ids := []string{}
+	for i, qj := range report.Queued {
+		assertEq(qj.Position, i+1, t)
+		assertEq(qj.ExpectedStart == nil, true, t)
+		ids = append(ids, qj.ID)
+	}
+	assertEq(ids, []string{high.ID, other.ID, low.ID}, t)
+	assertEq(report.Queued[0].Priority, 5, t)
+	assertEq(report.Queued[0].Params, high.Params, t)
+
+	// with an idle worker the next job starts immediately, the rest after
+	// the average build duration
+	s.workerPool.mu.Lock()
+	s.workerPool.current[0] = nil
+	s.workerPool.concurrency = 1
+	s.workerPool.avgDuration = time.Minute
+	s.workerPool.mu.Unlock()
+
+	report = s.workerPool.Queue()
+	assertEq(len(report.Workers), 1, t)
+	assertEq(report.Workers[0].Busy, false, t)
+	first, second := report.Queued[0].ExpectedStart, report.Queued[1].ExpectedStart
+	assertEq(first.After(time.Now()), false, t)
+	assertEq(second.Sub(*first), time.Minute, t)
+
+	// jobs of projects that are not visible are omitted
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/queue", nil)
+	req.Header.Set("Authorization", "Bearer ci-token")
+	s.srv.Handler.ServeHTTP(rec, req)
+	assertEq(rec.Code, 200, t)
+
+	err := json.Unmarshal(rec.Body.Bytes(), &report)
+	if err != nil {
+		t.Fatalf("cannot unmarshal %s; %s", rec.Body, err)
+	}
+	assertEq(len(report.Queued), 2, t)
+	assertEq(report.Queued[0].ID, high.ID, t)
+	assertEq(report.Queued[1].Position, 3, t)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/docker/docker/api/types/container"
+	units "github.com/docker/go-units"
+)
+
+// Resources are the limits of the resources a build container may use. Zero
+// values mean no limit.
+//
+// Limits are configured server-wide, in the settings of each project (see
+// ProjectSettings) and for each project in the server's configuration, each
+// overriding the limits they set of the previous ones (see Override).
+type Resources struct {
+	// Memory is the maximum amount of memory, in bytes or in a human
+	// readable form (eg. "2g").
+	Memory ByteSize `json:"memory"`
+
+	// MemorySwap is the maximum amount of memory plus swap. It must be
+	// greater than Memory; -1 means unlimited swap.
+	MemorySwap ByteSize `json:"memory_swap"`
+
+	// CPUs is the number of CPUs, which may be fractional (eg. 1.5). It's
+	// an alternative to CPUQuota.
+	CPUs float64 `json:"cpus"`
+
+	// CPUShares is the weight of the container relative to other
+	// containers, when CPUs are contended (1024 is the default weight).
+	CPUShares int64 `json:"cpu_shares"`
+
+	// CPUQuota is the CPU time, in microseconds, the container may use
+	// every CPUPeriod (which defaults to 100000).
+	CPUQuota  int64 `json:"cpu_quota"`
+	CPUPeriod int64 `json:"cpu_period"`
+
+	// PidsLimit is the maximum number of processes.
+	PidsLimit int64 `json:"pids_limit"`
+
+	// Ulimits are the ulimits of the container, by name (eg. "nofile").
+	Ulimits map[string]Ulimit `json:"ulimits"`
+}
+
+// Ulimit is the soft and hard limit of a ulimit.
+type Ulimit struct {
+	Soft int64 `json:"soft"`
+	Hard int64 `json:"hard"`
+}
+
+func (r Resources) validate() error {
+	if r.Memory < 0 || r.MemorySwap < -1 || r.CPUs < 0 || r.CPUShares < 0 ||
+		r.CPUQuota < 0 || r.CPUPeriod < 0 || r.PidsLimit < 0 {
+		return errors.New("resources cannot be negative")
+	}
+	if r.MemorySwap > 0 && r.MemorySwap < r.Memory {
+		return errors.New("memory_swap cannot be less than memory")
+	}
+	if r.CPUs > 0 && (r.CPUQuota > 0 || r.CPUPeriod > 0) {
+		return errors.New("cpus cannot be combined with cpu_quota or cpu_period")
+	}
+	for name, u := range r.Ulimits {
+		if u.Soft > u.Hard {
+			return fmt.Errorf("soft limit of ulimit '%s' exceeds its hard limit", name)
+		}
+	}
+	return nil
+}
+
+// Override returns r with the limits set in o overriding its own. Since
+// CPUs is an alternative to CPUQuota and CPUPeriod, setting either of them
+// overrides the other.
+func (r Resources) Override(o Resources) Resources {
+	if o.Memory != 0 {
+		r.Memory = o.Memory
+	}
+	if o.MemorySwap != 0 {
+		r.MemorySwap = o.MemorySwap
+	}
+	if o.CPUs != 0 {
+		r.CPUs, r.CPUQuota, r.CPUPeriod = o.CPUs, 0, 0
+	}
+	if o.CPUQuota != 0 || o.CPUPeriod != 0 {
+		r.CPUs, r.CPUQuota, r.CPUPeriod = 0, o.CPUQuota, o.CPUPeriod
+	}
+	if o.CPUShares != 0 {
+		r.CPUShares = o.CPUShares
+	}
+	if o.PidsLimit != 0 {
+		r.PidsLimit = o.PidsLimit
+	}
+	if len(o.Ulimits) > 0 {
+		ulimits := make(map[string]Ulimit)
+		for name, u := range r.Ulimits {
+			ulimits[name] = u
+		}
+		for name, u := range o.Ulimits {
+			ulimits[name] = u
+		}
+		r.Ulimits = ulimits
+	}
+	return r
+}
+
+// containerResources returns the Docker resources of a container limited to
+// r.
+func (r Resources) containerResources() container.Resources {
+	res := container.Resources{
+		Memory:     int64(r.Memory),
+		MemorySwap: int64(r.MemorySwap),
+		NanoCPUs:   int64(r.CPUs * 1e9),
+		CPUShares:  r.CPUShares,
+		CPUQuota:   r.CPUQuota,
+		CPUPeriod:  r.CPUPeriod,
+	}
+	if r.PidsLimit > 0 {
+		pids := r.PidsLimit
+		res.PidsLimit = &pids
+	}
+
+	names := make([]string, 0, len(r.Ulimits))
+	for name := range r.Ulimits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		u := r.Ulimits[name]
+		res.Ulimits = append(res.Ulimits, &units.Ulimit{Name: name, Soft: u.Soft, Hard: u.Hard})
+	}
+
+	return res
+}
+
+// ByteSize is a number of bytes that may also be configured using strings
+// such as "512m" or "2g".
+type ByteSize int64
+
+// UnmarshalJSON parses a ByteSize from a JSON number or string.
+func (b *ByteSize) UnmarshalJSON(data []byte) error {
+	var n int64
+	if err := json.Unmarshal(data, &n); err == nil {
+		*b = ByteSize(n)
+		return nil
+	}
+
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+	n, err = units.RAMInBytes(s)
+	if err != nil {
+		return err
+	}
+	*b = ByteSize(n)
+	return nil
+}
+
+func (b ByteSize) String() string {
+	if b < 0 {
+		return "unlimited"
+	}
+	return units.BytesSize(float64(b))
+}
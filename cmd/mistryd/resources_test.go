@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	units "github.com/docker/go-units"
+)
+
+func TestResourcesOverride(t *testing.T) {
+	server := Resources{
+		Memory:    ByteSize(4 << 30),
+		CPUs:      2,
+		PidsLimit: 1000,
+		Ulimits:   map[string]Ulimit{"nofile": {1024, 4096}, "nproc": {512, 512}},
+	}
+	project := Resources{
+		Memory:   ByteSize(1 << 30),
+		CPUQuota: 50000,
+		Ulimits:  map[string]Ulimit{"nofile": {2048, 2048}},
+	}
+
+	r := server.Override(project)
+	assertEq(r.Memory, ByteSize(1<<30), t)
+	assertEq(r.CPUs, float64(0), t)
+	assertEq(r.CPUQuota, int64(50000), t)
+	assertEq(r.PidsLimit, int64(1000), t)
+	assertEq(r.Ulimits, map[string]Ulimit{"nofile": {2048, 2048}, "nproc": {512, 512}}, t)
+
+	// the overridden limits are not modified
+	assertEq(server.Ulimits["nofile"], Ulimit{1024, 4096}, t)
+
+	res := r.containerResources()
+	assertEq(res.Memory, int64(1<<30), t)
+	assertEq(res.NanoCPUs, int64(0), t)
+	assertEq(res.CPUQuota, int64(50000), t)
+	assertEq(*res.PidsLimit, int64(1000), t)
+	assertEq(res.Ulimits, []*units.Ulimit{
+		{Name: "nofile", Soft: 2048, Hard: 2048},
+		{Name: "nproc", Soft: 512, Hard: 512},
+	}, t)
+
+	assertEq(Resources{}.containerResources().PidsLimit, (*int64)(nil), t)
+}
+
+func TestJobResources(t *testing.T) {
+	cfg, err := ParseConfig("localhost:8462", nil, strings.NewReader(`{"projects_path": "testdata/projects",
+		"build_path": "/tmp", "resources": {"memory": "2g", "cpus": 2, "pids_limit": 100},
+		"projects": {"settings": {"resources": {"pids_limit": 200}}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := cfg.JobResources("simple", ProjectSettings{})
+	assertEq(r, Resources{Memory: ByteSize(2 << 30), CPUs: 2, PidsLimit: 100}, t)
+
+	ps, err := ReadProjectSettings("testdata/projects/settings")
+	failIfError(err, t)
+	r = cfg.JobResources("settings", ps)
+	assertEq(r, Resources{Memory: ByteSize(512 << 20), CPUs: 0.5, PidsLimit: 200}, t)
+
+	for _, resources := range []string{
+		`{"memory": -1}`,
+		`{"memory": "1g", "memory_swap": "512m"}`,
+		`{"cpus": 1, "cpu_quota": 50000}`,
+		`{"ulimits": {"nofile": {"soft": 2048, "hard": 1024}}}`,
+	} {
+		_, err = ParseConfig("localhost:8462", nil, strings.NewReader(`{"projects_path": "testdata/projects",
+			"build_path": "/tmp", "resources": `+resources+`}`))
+		if err == nil {
+			t.Fatalf("expected error for resources %s", resources)
+		}
+	}
+
+	_, err = ParseConfig("localhost:8462", nil, strings.NewReader(`{"projects_path": "testdata/projects",
+		"build_path": "/tmp", "resources": {"memory": "1g", "memory_swap": -1}}`))
+	failIfError(err, t)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/skroutz/mistry/pkg/types"
+)
+
+// Scheduler enqueues the builds of the configured schedules when they are
+// due, so that the images and build caches of projects stay warm and the
+// first build after a change to a project is not slow for whoever happens
+// to request it.
+//
+// Runs that are missed while the server is down are not made up for.
+type Scheduler struct {
+	s   *Server
+	log *log.Logger
+
+	mu        sync.Mutex
+	schedules []*schedule
+
+	quit     chan struct{}
+	quitOnce sync.Once
+}
+
+type schedule struct {
+	ScheduleConfig
+	next time.Time
+	last *ScheduleRun
+}
+
+// ScheduleRun is a run of a schedule.
+type ScheduleRun struct {
+	Time time.Time `json:"time"`
+
+	// JobID and URL identify the job that was enqueued, unless it could
+	// not be scheduled (see Error)
+	JobID string `json:"jobId,omitempty"`
+	URL   string `json:"url,omitempty"`
+
+	State    types.JobState `json:"state,omitempty"`
+	ExitCode int            `json:"exitCode"`
+	Cached   bool           `json:"cached"`
+
+	// Error is set if the job could not be scheduled or built
+	Error string `json:"error,omitempty"`
+}
+
+// ScheduleStatus is the state of a schedule.
+type ScheduleStatus struct {
+	Name    string       `json:"name"`
+	Project string       `json:"project"`
+	Cron    string       `json:"cron"`
+	Params  types.Params `json:"params"`
+	Group   string       `json:"group"`
+
+	// NextRun is nil if the cron expression never matches
+	NextRun *time.Time   `json:"nextRun,omitempty"`
+	LastRun *ScheduleRun `json:"lastRun,omitempty"`
+}
+
+// NewScheduler returns a Scheduler for the schedules configured in s. It
+// doesn't enqueue any builds until it's started (see Run).
+func NewScheduler(s *Server, logger *log.Logger) *Scheduler {
+	sc := &Scheduler{s: s, log: logger, quit: make(chan struct{})}
+
+	now := time.Now()
+	for _, cfg := range s.cfg.Schedules {
+		sc.schedules = append(sc.schedules, &schedule{ScheduleConfig: cfg, next: cfg.spec.Next(now)})
+	}
+	return sc
+}
+
+// Run enqueues the builds of the schedules as they become due, until Stop
+// is called.
+func (sc *Scheduler) Run() {
+	for {
+		// if no schedule is ever due, wait until stopped
+		var wait <-chan time.Time
+		var timer *time.Timer
+		if next := sc.next(); !next.IsZero() {
+			timer = time.NewTimer(time.Until(next))
+			wait = timer.C
+		}
+
+		select {
+		case now := <-wait:
+			sc.runDue(now)
+		case <-sc.quit:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		}
+	}
+}
+
+// Stop stops the scheduler. Builds that were already enqueued are not
+// affected.
+func (sc *Scheduler) Stop() {
+	sc.quitOnce.Do(func() { close(sc.quit) })
+}
+
+// next returns the time the next schedule is due, or the zero time if none
+// is.
+func (sc *Scheduler) next() time.Time {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	var next time.Time
+	for _, sch := range sc.schedules {
+		if !sch.next.IsZero() && (next.IsZero() || sch.next.Before(next)) {
+			next = sch.next
+		}
+	}
+	return next
+}
+
+// runDue enqueues the builds of the schedules that are due at now.
+func (sc *Scheduler) runDue(now time.Time) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	for _, sch := range sc.schedules {
+		if sch.next.IsZero() || sch.next.After(now) {
+			continue
+		}
+		sch.last = sc.run(sch, now)
+		sch.next = sch.spec.Next(now)
+	}
+}
+
+// run enqueues the build of sch and returns its run. The run is updated
+// when the build completes.
+func (sc *Scheduler) run(sch *schedule, now time.Time) *ScheduleRun {
+	run := &ScheduleRun{Time: now}
+
+	j, err := NewJob(sch.Project, sch.Params, sch.Env, sch.Group, sc.s.cfg)
+	if err != nil {
+		run.Error = fmt.Sprintf("cannot create job; %s", err)
+		sc.log.Printf("Schedule %s: %s", sch.Name, run.Error)
+		return run
+	}
+	err = j.Settings.ValidateParams(j.Params)
+	if err != nil {
+		run.Error = fmt.Sprintf("invalid params; %s", err)
+		sc.log.Printf("Schedule %s: %s", sch.Name, run.Error)
+		return run
+	}
+	j.Priority = types.MinPriority
+	j.Timeout = sc.s.cfg.JobTimeout(j.Project, j.Settings, 0)
+
+	if derr := sc.s.drains.Check(j.Project); derr != nil {
+		run.Error = derr.Error()
+		sc.log.Printf("Schedule %s: skipped %s; %s", sch.Name, j, derr)
+		return run
+	}
+
+	future, err := sc.s.workerPool.SendWork(j)
+	if err != nil {
+		run.Error = fmt.Sprintf("cannot schedule %s; %s", j, err)
+		sc.log.Printf("Schedule %s: %s", sch.Name, run.Error)
+		return run
+	}
+	sc.log.Printf("Schedule %s: scheduled %s", sch.Name, j)
+
+	run.JobID, run.URL = j.ID, getJobURL(j)
+	run.State, run.ExitCode = types.JobQueued, types.ContainerPendingExitCode
+
+	go func() {
+		result := future.Wait()
+
+		sc.mu.Lock()
+		defer sc.mu.Unlock()
+
+		run.State = types.JobFinished
+		if result.BuildInfo != nil {
+			run.ExitCode = result.BuildInfo.ExitCode
+			run.Cached = result.BuildInfo.Cached
+		}
+		if result.Err != nil {
+			run.Error = result.Err.Error()
+		}
+	}()
+
+	return run
+}
+
+// Status returns the state of the schedules, in the order they are
+// configured.
+func (sc *Scheduler) Status() []ScheduleStatus {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	status := []ScheduleStatus{}
+	for _, sch := range sc.schedules {
+		st := ScheduleStatus{
+			Name:    sch.Name,
+			Project: sch.Project,
+			Cron:    sch.Cron,
+			Params:  sch.Params,
+			Group:   sch.Group,
+		}
+		if !sch.next.IsZero() {
+			next := sch.next
+			st.NextRun = &next
+		}
+		if sch.last != nil {
+			last := *sch.last
+			st.LastRun = &last
+		}
+		status = append(status, st)
+	}
+	return status
+}
+
+// HandleSchedules lists the schedules along with their next and last run.
+// Schedules of projects that the requester is not allowed to view are
+// omitted.
+func (s *Server) HandleSchedules(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Expected GET, got "+r.Method, http.StatusMethodNotAllowed)
+		return
+	}
+
+	visible, err := s.visibleProjects(r)
+	if err != nil {
+		unauthorized(w, err)
+		return
+	}
+
+	status := []ScheduleStatus{}
+	for _, st := range s.scheduler.Status() {
+		if visible == nil || visible[st.Project] {
+			status = append(status, st)
+		}
+	}
+
+	resp, err := json.Marshal(status)
+	if err != nil {
+		s.Log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(resp)
+	if err != nil {
+		s.Log.Printf("Error writing schedules response: %s", err)
+	}
+}
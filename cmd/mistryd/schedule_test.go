@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/skroutz/mistry/pkg/types"
+)
+
+func TestScheduler(t *testing.T) {
+	s, cleanup := newAgentServer(t, 0, testcfg.ProjectsPath)
+	defer cleanup()
+
+	spec, err := parseCron("0 * * * *")
+	failIfError(err, t)
+	s.cfg.Schedules = []ScheduleConfig{
+		{Name: "warm-simple", Project: "simple", Cron: "0 * * * *",
+			Params: types.Params{"test": "schedule"}, Group: "latest", spec: spec},
+		{Name: "warm-params", Project: "params", Cron: "0 * * * *", spec: spec},
+	}
+	sc := NewScheduler(s, s.Log)
+	s.scheduler = sc
+
+	now := time.Now()
+	st := sc.Status()
+	assertEq(len(st), 2, t)
+	assertEq(st[0].LastRun, (*ScheduleRun)(nil), t)
+	assertEq(*st[0].NextRun, spec.Next(now), t)
+
+	// nothing is due yet
+	sc.runDue(now)
+	assertEq(sc.Status()[0].LastRun, (*ScheduleRun)(nil), t)
+
+	failIfError(s.drains.Drain("params", Drain{Reason: "upgrade"}), t)
+
+	due := *st[0].NextRun
+	sc.runDue(due)
+	st = sc.Status()
+	assertEq(*st[0].NextRun, due.Add(time.Hour), t)
+
+	run := st[0].LastRun
+	assertNotEq(run, (*ScheduleRun)(nil), t)
+	assertEq(run.Time, due, t)
+	assertEq(run.State, types.JobQueued, t)
+	assertEq(run.Error, "", t)
+
+	queued := s.workerPool.Queue().Queued
+	assertEq(len(queued), 1, t)
+	assertEq(queued[0].ID, run.JobID, t)
+	assertEq(queued[0].Group, "latest", t)
+	assertEq(queued[0].Priority, types.MinPriority, t)
+
+	// drained projects are skipped
+	run = st[1].LastRun
+	assertEq(run.JobID, "", t)
+	assertEq(run.Error, "project params is drained: upgrade", t)
+
+	// the run is updated once the job completes
+	assert(s.workerPool.Cancel("simple", st[0].LastRun.JobID), true, t)
+	for i := 0; sc.Status()[0].LastRun.State != types.JobFinished; i++ {
+		if i > 100 {
+			t.Fatal("scheduled job did not complete")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assertEq(sc.Status()[0].LastRun.ExitCode, types.ContainerPendingExitCode, t)
+	assertNotEq(sc.Status()[0].LastRun.Error, "", t)
+
+	rec := httptest.NewRecorder()
+	s.srv.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/schedules", nil))
+	assertEq(rec.Code, 200, t)
+	result := []ScheduleStatus{}
+	failIfError(json.Unmarshal(rec.Body.Bytes(), &result), t)
+	assertEq(len(result), 2, t)
+	assertEq(result[0].Name, "warm-simple", t)
+	assertEq(result[0].LastRun.JobID, queued[0].ID, t)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// RedactedSecret replaces the values of secrets in build logs.
+const RedactedSecret = "[REDACTED]"
+
+var secretNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+func validateSecrets(secretsPath string, names []string) error {
+	if len(names) > 0 && secretsPath == "" {
+		return errors.New("secrets_path is not configured")
+	}
+	for _, name := range names {
+		if !secretNameRegexp.MatchString(name) {
+			return fmt.Errorf("invalid secret name '%s'", name)
+		}
+	}
+	return nil
+}
+
+// ProjectSecrets returns the values of the secrets granted to project, by
+// name. Each secret is a file in SecretsPath; trailing newlines are not part
+// of its value.
+func (cfg *Config) ProjectSecrets(project string) (map[string]string, error) {
+	secrets := make(map[string]string)
+	for _, name := range cfg.Projects[project].Secrets {
+		v, err := ioutil.ReadFile(filepath.Join(cfg.SecretsPath, name))
+		if err != nil {
+			return nil, fmt.Errorf("could not read secret '%s'; %s", name, err)
+		}
+		secrets[name] = strings.TrimRight(string(v), "\r\n")
+	}
+	return secrets, nil
+}
+
+// redactor is an io.Writer that replaces the values of secrets with
+// RedactedSecret before writing to the underlying writer. Since a value may
+// be split across writes, bytes that may be the beginning of a value are held
+// back until more bytes are written or Flush is called.
+type redactor struct {
+	w       io.Writer
+	secrets [][]byte
+	buf     []byte
+}
+
+func newRedactor(w io.Writer, secrets map[string]string) *redactor {
+	r := &redactor{w: w}
+	for _, v := range secrets {
+		if v != "" {
+			r.secrets = append(r.secrets, []byte(v))
+		}
+	}
+	// longer values first, in case a value contains another one
+	sort.Slice(r.secrets, func(i, k int) bool { return len(r.secrets[i]) > len(r.secrets[k]) })
+	return r
+}
+
+func (r *redactor) Write(p []byte) (int, error) {
+	if len(r.secrets) == 0 {
+		return r.w.Write(p)
+	}
+
+	r.buf = append(r.buf, p...)
+	err := r.write(false)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes the bytes that are held back.
+func (r *redactor) Flush() error {
+	return r.write(true)
+}
+
+// write writes the redacted contents of the buffer, up to the first byte
+// that may be the beginning of a value that is not yet complete. If final is
+// true, the whole buffer is written.
+func (r *redactor) write(final bool) error {
+	var out []byte
+	i := 0
+scan:
+	for i < len(r.buf) {
+		rest := r.buf[i:]
+		for _, v := range r.secrets {
+			if !final && len(rest) < len(v) && bytes.HasPrefix(v, rest) {
+				break scan
+			}
+		}
+		for _, v := range r.secrets {
+			if bytes.HasPrefix(rest, v) {
+				out = append(out, RedactedSecret...)
+				i += len(v)
+				continue scan
+			}
+		}
+		out = append(out, r.buf[i])
+		i++
+	}
+
+	r.buf = append(r.buf[:0], r.buf[i:]...)
+	if len(out) == 0 {
+		return nil
+	}
+	_, err := r.w.Write(out)
+	return err
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRedactor(t *testing.T) {
+	secrets := map[string]string{"a": "hunter2", "b": "hunter2000", "empty": ""}
+	in := "password: hunter2000, again: hunter2\nhunter"
+
+	// write in chunks of every size, so that secrets are split across
+	// writes
+	for size := 1; size <= len(in); size++ {
+		var out strings.Builder
+		r := newRedactor(&out, secrets)
+		for i := 0; i < len(in); i += size {
+			end := i + size
+			if end > len(in) {
+				end = len(in)
+			}
+			n, err := r.Write([]byte(in[i:end]))
+			failIfError(err, t)
+			assertEq(n, end-i, t)
+		}
+		failIfError(r.Flush(), t)
+		assertEq(out.String(), "password: [REDACTED], again: [REDACTED]\nhunter", t)
+	}
+
+	var out strings.Builder
+	r := newRedactor(&out, nil)
+	_, err := r.Write([]byte("hunter2"))
+	failIfError(err, t)
+	assertEq(out.String(), "hunter2", t)
+}
+
+func TestProjectSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mistry-secrets")
+	failIfError(err, t)
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "npm_token"), []byte("s3cr3t\n"), 0600)
+	failIfError(err, t)
+
+	cfg := &Config{SecretsPath: dir, Projects: map[string]ProjectConfig{
+		"simple":  {Secrets: []string{"npm_token"}},
+		"missing": {Secrets: []string{"gem_token"}},
+	}}
+
+	secrets, err := cfg.ProjectSecrets("simple")
+	failIfError(err, t)
+	assertEq(secrets, map[string]string{"npm_token": "s3cr3t"}, t)
+
+	secrets, err = cfg.ProjectSecrets("other")
+	failIfError(err, t)
+	assertEq(len(secrets), 0, t)
+
+	_, err = cfg.ProjectSecrets("missing")
+	if err == nil {
+		t.Fatal("expected error for missing secret")
+	}
+}
+
+func TestParseConfigSecrets(t *testing.T) {
+	cfg, err := ParseConfig("localhost:8462", nil, strings.NewReader(`{"projects_path": "testdata/projects",
+		"build_path": "/tmp", "secrets_path": "testdata/secrets",
+		"projects": {"simple": {"secrets": ["token"]}}}`))
+	failIfError(err, t)
+	assertEq(filepath.IsAbs(cfg.SecretsPath), true, t)
+	assertEq(cfg.Projects["simple"].Secrets, []string{"token"}, t)
+
+	for _, c := range []string{
+		`"projects": {"simple": {"secrets": ["token"]}}`,
+		`"secrets_path": "testdata/secrets", "projects": {"simple": {"secrets": ["../token"]}}`,
+		`"secrets_path": "testdata/nonexistent"`,
+	} {
+		_, err = ParseConfig("localhost:8462", nil, strings.NewReader(`{"projects_path": "testdata/projects",
+			"build_path": "/tmp", `+c+`}`))
+		if err == nil {
+			t.Fatalf("expected error for %s", c)
+		}
+	}
+}
@@ -13,9 +13,11 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
 	"os"
 	"path/filepath"
-	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -31,6 +33,10 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// httpShutdownTimeout is how long the server waits for responses to be
+// written while shutting down.
+const httpShutdownTimeout = 10 * time.Second
+
 // Server is the component that performs the actual work (builds images, runs
 // commands etc.). It also exposes the JSON API by which users interact with
 // mistry.
@@ -49,6 +55,24 @@ type Server struct {
 	// web-view related
 	br *broker.Broker
 
+	// indexes the pending and ready builds
+	index *BuildIndex
+
+	// the ready builds that are being served, which are not pruned
+	builds *BuildUsage
+
+	// records the accepted jobs until they're built
+	journal *Journal
+
+	// the projects that don't accept new builds
+	drains *Drains
+
+	// runs checkFileSystem for the health endpoints
+	fileSystemCheck *cachedCheck
+
+	// enqueues the scheduled builds
+	scheduler *Scheduler
+
 	// related to prometheus
 	metrics *metrics.Recorder
 }
@@ -77,10 +101,21 @@ func NewServer(cfg *Config, logger *log.Logger, enableMetrics bool) (*Server, er
 
 	mux.Handle("/", http.StripPrefix("/", http.FileServer(s.fs)))
 	mux.HandleFunc("/jobs", s.HandleNewJob)
+	mux.HandleFunc("/jobs/", s.HandleJob)
 	mux.HandleFunc("/index/", s.HandleIndex)
 	mux.HandleFunc("/job/", s.HandleShowJob)
 	mux.HandleFunc("/log/", s.HandleServerPush)
-	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/metrics", s.requireToken(promhttp.Handler()))
+	mux.HandleFunc("/healthz", s.HandleHealth)
+	mux.HandleFunc("/readyz", s.HandleReady)
+	mux.HandleFunc("/queue", s.HandleQueue)
+	mux.HandleFunc("/schedules", s.HandleSchedules)
+	mux.HandleFunc("/projects", s.HandleProjects)
+	mux.HandleFunc("/projects/", s.HandleProjects)
+	mux.HandleFunc("/admin/pool", s.HandlePool)
+	mux.HandleFunc("/admin/drain", s.HandleDrain)
+	mux.HandleFunc("/agents", s.HandleAgents)
+	mux.HandleFunc("/agents/", s.HandleAgents)
 
 	s.srv = &http.Server{Handler: mux, Addr: cfg.Addr}
 	s.cfg = cfg
@@ -88,11 +123,25 @@ func NewServer(cfg *Config, logger *log.Logger, enableMetrics bool) (*Server, er
 	s.jq = NewJobQueue()
 	s.pq = NewProjectQueue()
 	s.br = broker.NewBroker(s.Log)
-	s.workerPool = NewWorkerPool(s, cfg.Concurrency, cfg.Backlog, logger)
-
+	s.index, err = OpenBuildIndex(cfg.BuildPath)
+	if err != nil {
+		return nil, err
+	}
+	s.builds = NewBuildUsage()
+	s.journal, err = OpenJournal(cfg.BuildPath)
+	if err != nil {
+		return nil, err
+	}
+	s.drains, err = OpenDrains(cfg.BuildPath)
+	if err != nil {
+		return nil, err
+	}
 	if enableMetrics {
 		s.metrics = metrics.NewRecorder(logger)
 	}
+	s.fileSystemCheck = newCachedCheck(s.checkFileSystem, fileSystemCheckInterval)
+	s.workerPool = NewWorkerPool(s, cfg.Concurrency, cfg.Backlog, logger)
+	s.scheduler = NewScheduler(s, logger)
 
 	return s, nil
 }
@@ -118,26 +167,97 @@ func (s *Server) HandleNewJob(w http.ResponseWriter, r *http.Request) {
 			http.StatusBadRequest)
 		return
 	}
-	j, err := NewJob(jr.Project, jr.Params, jr.Group, s.cfg)
+
+	requester, ok := s.authorize(w, r, jr.Project, RoleBuild)
+	if !ok {
+		return
+	}
+
+	if jr.Priority < types.MinPriority || jr.Priority > types.MaxPriority {
+		http.Error(w, fmt.Sprintf("Priority must be between %d and %d, got %d",
+			types.MinPriority, types.MaxPriority, jr.Priority), http.StatusBadRequest)
+		return
+	}
+
+	err = ValidateEnv(jr.Env)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// drained projects are rejected before creating the job, which is
+	// costly, unless they may have a ready build to serve
+	derr := s.drains.Check(jr.Project)
+	if derr != nil && !s.hasReadyBuilds(jr.Project) {
+		s.rejectDrained(w, jr.Project, derr)
+		return
+	}
+
+	j, err := NewJob(jr.Project, jr.Params, jr.Env, jr.Group, s.cfg)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error creating new job %v: %s", jr, err),
 			http.StatusInternalServerError)
 		return
 	}
+	err = j.Settings.ValidateParams(j.Params)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid params of %s: %s", j, err), http.StatusBadRequest)
+		return
+	}
 	j.Rebuild = jr.Rebuild
+	j.Priority = jr.Priority
+	j.RequestedBy = requester
+	j.Timeout = s.cfg.JobTimeout(j.Project, j.Settings, jr.Timeout)
+
+	if derr != nil {
+		// builds that are already ready are still served
+		bi, err := ReadJobBuildInfo(j.ReadyBuildPath, true)
+		if err != nil || bi.ExitCode != types.ContainerSuccessExitCode {
+			s.rejectDrained(w, j.Project, derr)
+			return
+		}
+		bi.Cached = true
+
+		if _, async := r.URL.Query()["async"]; async {
+			s.writeJobStatus(w, http.StatusCreated, types.JobStatus{
+				ID:       j.ID,
+				Project:  j.Project,
+				Group:    j.Group,
+				State:    types.JobFinished,
+				ExitCode: bi.ExitCode,
+				URL:      getJobURL(j),
+			})
+		} else {
+			s.writeWorkResult(j, WorkResult{BuildInfo: bi}, w)
+		}
+		return
+	}
 
-	// send the work item to the worker pool
-	future, err := s.workerPool.SendWork(j)
+	// send the work item to the worker pool, waiting for room in the
+	// backlog if configured to
+	var future FutureWorkResult
+	if s.cfg.BacklogWait > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(s.cfg.BacklogWait))
+		future, err = s.workerPool.SendWorkContext(ctx, j)
+		cancel()
+	} else {
+		future, err = s.workerPool.SendWork(j)
+	}
 	if err != nil {
-		// the in-memory queue is overloaded, we have to wait for the workers to pick
-		// up new items.
-		// return a 503 to signal that the server is overloaded and for clients to try
-		// again later
-		// 503 is an appropriate status code to signal that the server is overloaded
-		// for all users, while 429 would have been used if we implemented user-specific
-		// throttling
-		s.Log.Print("Failed to send message to work queue")
-		w.WriteHeader(http.StatusServiceUnavailable)
+		s.Log.Printf("Failed to send message to work queue; %s", err)
+
+		if _, full := err.(*queueFullError); full {
+			// the in-memory queue is overloaded, we have to wait for the workers to pick
+			// up new items.
+			// return a 503 to signal that the server is overloaded and for clients to try
+			// again later, along with an estimate of when there will be room
+			// 503 is an appropriate status code to signal that the server is overloaded
+			// for all users, while 429 would have been used if we implemented user-specific
+			// throttling
+			retryAfter := s.workerPool.RetryAfter()
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter/time.Second)))
+		}
+		http.Error(w, fmt.Sprintf("Cannot schedule %s: %s", j, err), http.StatusServiceUnavailable)
 		return
 	}
 
@@ -145,13 +265,41 @@ func (s *Server) HandleNewJob(w http.ResponseWriter, r *http.Request) {
 	_, async := r.URL.Query()["async"]
 	if async {
 		s.Log.Printf("Scheduled %s", j)
-		w.WriteHeader(http.StatusCreated)
+		s.writeJobStatus(w, http.StatusCreated, types.JobStatus{
+			ID:       j.ID,
+			Project:  j.Project,
+			Group:    j.Group,
+			State:    types.JobQueued,
+			ExitCode: types.ContainerPendingExitCode,
+			URL:      getJobURL(j),
+		})
 	} else {
 		s.Log.Printf("Scheduled %s and waiting for result...", j)
 		s.writeWorkResult(j, future.Wait(), w)
 	}
 }
 
+// hasReadyBuilds returns true if project may have ready builds.
+func (s *Server) hasReadyBuilds(project string) bool {
+	f, err := os.Open(filepath.Join(s.cfg.BuildPath, project, "ready"))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	names, _ := f.Readdirnames(1)
+	return len(names) > 0
+}
+
+// rejectDrained responds that a job of project cannot be scheduled, because
+// of the drain denoted by derr.
+func (s *Server) rejectDrained(w http.ResponseWriter, project string, derr *drainError) {
+	s.Log.Printf("Rejected job of project %s; %s", project, derr)
+	retryAfter := derr.RetryAfter()
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter/time.Second)))
+	http.Error(w, fmt.Sprintf("Cannot schedule job of project %s: %s", project, derr), http.StatusServiceUnavailable)
+}
+
 func (s *Server) writeWorkResult(j *Job, r WorkResult, w http.ResponseWriter) {
 	if r.Err != nil {
 		http.Error(w, fmt.Sprintf("Error building %s: %s", j, r.Err),
@@ -159,6 +307,10 @@ func (s *Server) writeWorkResult(j *Job, r WorkResult, w http.ResponseWriter) {
 		return
 	}
 
+	// the client downloads the build next, which shouldn't be pruned in
+	// the meantime
+	s.builds.Touch(j.ReadyBuildPath)
+
 	w.WriteHeader(http.StatusCreated)
 	w.Header().Set("Content-Type", "application/json")
 
@@ -172,37 +324,228 @@ func (s *Server) writeWorkResult(j *Job, r WorkResult, w http.ResponseWriter) {
 	}
 }
 
-// HandleIndex returns all available jobs.
+// HandleJob receives requests concerning a particular job, in the form of
+// /jobs/{project}/{id} and /jobs/{project}/{id}/artifacts.
+func (s *Server) HandleJob(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) == 5 && parts[4] == "artifacts" {
+		if _, ok := s.authorize(w, r, parts[2], RoleView); ok {
+			s.handleArtifacts(w, r, parts[2], parts[3])
+		}
+		return
+	}
+	if len(parts) != 4 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	project := parts[2]
+	id := parts[3]
+
+	switch r.Method {
+	case "GET":
+		if _, ok := s.authorize(w, r, project, RoleView); ok {
+			s.handleJobStatus(w, project, id)
+		}
+	case "DELETE":
+		if _, ok := s.authorize(w, r, project, RoleAdmin); ok {
+			s.handleCancelJob(w, project, id)
+		}
+	default:
+		http.Error(w, "Expected GET or DELETE, got "+r.Method, http.StatusMethodNotAllowed)
+	}
+}
+
+// handleJobStatus responds with the status of the job denoted by project and
+// id in JSON.
+func (s *Server) handleJobStatus(w http.ResponseWriter, project, id string) {
+	st, ok := s.workerPool.Status(project, id)
+	if !ok {
+		j, err := s.index.Get(project, id)
+		if err == errJobNotFound {
+			http.Error(w, fmt.Sprintf("Job %s of project %s not found", id, project), http.StatusNotFound)
+			return
+		} else if err != nil {
+			s.Log.Print(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		bi := j.BuildInfo
+
+		st = types.JobStatus{
+			ID:       id,
+			Project:  project,
+			Group:    bi.Group,
+			State:    types.JobRunning,
+			ExitCode: bi.ExitCode,
+			ErrBuild: bi.ErrBuild,
+			URL:      bi.URL,
+		}
+		if j.State == "ready" {
+			st.State = types.JobFinished
+		}
+	}
+
+	s.writeJobStatus(w, http.StatusOK, st)
+}
+
+func (s *Server) writeJobStatus(w http.ResponseWriter, code int, st types.JobStatus) {
+	resp, err := json.Marshal(st)
+	if err != nil {
+		s.Log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_, err = w.Write(resp)
+	if err != nil {
+		s.Log.Printf("Error writing status response for job %s: %s", st.ID, err)
+	}
+}
+
+// handleArtifacts serves the artifacts of a ready build as a tar archive.
+// The archive is compressed with zstd or gzip, if the client accepts it, and
+// Range requests are supported so that interrupted downloads can be resumed.
+func (s *Server) handleArtifacts(w http.ResponseWriter, r *http.Request, project, id string) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Expected GET, got "+r.Method, http.StatusMethodNotAllowed)
+		return
+	}
+
+	j, err := s.index.Get(project, id)
+	if err == errJobNotFound {
+		http.Error(w, fmt.Sprintf("Job %s of project %s not found", id, project), http.StatusNotFound)
+		return
+	} else if err != nil {
+		s.Log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if s.proxyToAgent(w, r, j) {
+		return
+	}
+	if j.State != "ready" {
+		http.Error(w, fmt.Sprintf("Job %s of project %s is not finished yet", id, project),
+			http.StatusConflict)
+		return
+	}
+
+	// the build is not pruned while its archive is created and served
+	buildPath := filepath.Join(s.cfg.BuildPath, project, j.State, id)
+	release, ok := s.builds.Use(buildPath)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Job %s of project %s not found", id, project), http.StatusNotFound)
+		return
+	}
+	defer release()
+
+	encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+	archive, err := EnsureArtifactsArchive(buildPath, encoding)
+	if err != nil {
+		s.Log.Printf("cannot create artifacts archive of job %s of project %s; %s", id, project, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	f, err := os.Open(archive)
+	if err != nil {
+		s.Log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		s.Log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Vary", "Accept-Encoding")
+	if encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
+	}
+	// the modification time changes if the build is ever re-run and the
+	// archive is re-created
+	w.Header().Set("ETag", fmt.Sprintf(`"%s-%x-%s"`, id, fi.ModTime().UnixNano(), encoding))
+
+	http.ServeContent(w, r, "", fi.ModTime(), f)
+}
+
+// handleCancelJob cancels the job denoted by project and id, if it's queued
+// or running. Running builds are killed and their outcome is persisted as
+// cancelled.
+func (s *Server) handleCancelJob(w http.ResponseWriter, project, id string) {
+	if !s.workerPool.Cancel(project, id) {
+		http.Error(w, fmt.Sprintf("Job %s of project %s is not queued or running", id, project),
+			http.StatusNotFound)
+		return
+	}
+
+	s.Log.Printf("Cancelled job %s of project %s", id, project)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// HandleIndex returns the available jobs that match the criteria given in the
+// query parameters (see ParseJobFilter), one page at a time.
 func (s *Server) HandleIndex(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		http.Error(w, "Expected GET, got "+r.Method, http.StatusMethodNotAllowed)
 		return
 	}
 
-	jobs, err := s.getJobs()
+	f, err := ParseJobFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if f.Project != "" {
+		_, ok := s.authorize(w, r, f.Project, RoleView)
+		if !ok {
+			return
+		}
+	} else {
+		f.Projects, err = s.visibleProjects(r)
+		if err != nil {
+			unauthorized(w, err)
+			return
+		}
+	}
+
+	page := struct {
+		Jobs []Job `json:"jobs"`
+
+		// Next is the cursor of the next page, if there is one
+		Next string `json:"next,omitempty"`
+	}{}
+	var next *JobCursor
+	page.Jobs, next, err = s.index.List(f)
 	if err != nil {
-		s.Log.Printf("cannot get jobs for path %s; %s", s.cfg.BuildPath, err)
+		s.Log.Printf("cannot list jobs; %s", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	sort.Slice(jobs, func(i, j int) bool {
-		return jobs[j].StartedAt.Before(jobs[i].StartedAt)
-	})
+	if next != nil {
+		page.Next = next.String()
+	}
 
-	resp, err := json.Marshal(jobs)
+	resp, err := json.Marshal(page)
 	if err != nil {
-		s.Log.Printf("cannot marshal jobs '%#v'; %s", jobs, err)
+		s.Log.Printf("cannot marshal jobs '%#v'; %s", page.Jobs, err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
 
 	_, err = w.Write(resp)
 	if err != nil {
 		s.Log.Printf("cannot write response %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 }
@@ -223,27 +566,31 @@ func (s *Server) HandleShowJob(w http.ResponseWriter, r *http.Request) {
 	project := parts[2]
 	id := parts[3]
 
-	state, err := GetState(s.cfg.BuildPath, project, id)
-	if err != nil {
+	_, ok := s.authorize(w, r, project, RoleView)
+	if !ok {
+		return
+	}
+
+	j, err := s.index.Get(project, id)
+	if err == errJobNotFound {
+		http.Error(w, fmt.Sprintf("Job %s of project %s not found", id, project), http.StatusNotFound)
+		return
+	} else if err != nil {
 		s.Log.Print(err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	jPath := filepath.Join(s.cfg.BuildPath, project, state, id)
+	if s.proxyToAgent(w, r, j) {
+		return
+	}
 
-	buildInfo, err := ReadJobBuildInfo(jPath, true)
+	logs, err := ReadJobLogs(filepath.Join(s.cfg.BuildPath, project, j.State, id))
 	if err != nil {
 		s.Log.Print(err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-
-	j := Job{
-		BuildInfo: buildInfo,
-		ID:        id,
-		Project:   project,
-		State:     state,
-	}
+	j.BuildInfo.ContainerStdouterr = string(logs)
 
 	if r.Header.Get("Content-type") == "application/json" {
 		jData, err := json.Marshal(j)
@@ -298,6 +645,55 @@ func (s *Server) HandleShowJob(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// proxyToAgent proxies r to the remote agent that built j, which serves its
+// logs and artifacts, and returns true. If j was not built by an agent, or
+// its build is available locally (eg. because the agent shares the build path
+// of s), it returns false.
+//
+// The token of r is passed to the agent in the Authorization header, so
+// agents must accept the tokens of their coordinator, if any.
+func (s *Server) proxyToAgent(w http.ResponseWriter, r *http.Request, j Job) bool {
+	if j.BuildInfo == nil || j.BuildInfo.AgentURL == "" {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(s.cfg.BuildPath, j.Project, j.State, j.ID))
+	if err == nil {
+		return false
+	}
+
+	target, err := url.Parse(j.BuildInfo.AgentURL)
+	if err != nil {
+		s.Log.Printf("Invalid URL of the agent of job %s of project %s; %s", j.ID, j.Project, err)
+		w.WriteHeader(http.StatusBadGateway)
+		return true
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = target.Scheme
+			req.URL.Host = target.Host
+			req.URL.Path = strings.TrimSuffix(target.Path, "/") + req.URL.Path
+			req.URL.RawPath = ""
+			req.Host = target.Host
+
+			// tokens are never passed in URLs, which may be logged
+			q := req.URL.Query()
+			if token := q.Get("access_token"); token != "" {
+				if req.Header.Get("Authorization") == "" {
+					req.Header.Set("Authorization", "Bearer "+token)
+				}
+				q.Del("access_token")
+				req.URL.RawQuery = q.Encode()
+			}
+		},
+		// log streams are relayed as they arrive
+		FlushInterval: -1,
+		ErrorLog:      s.Log,
+	}
+	proxy.ServeHTTP(w, r)
+	return true
+}
+
 func getJobURL(j *Job) string {
 	return strings.Join([]string{"job", j.Project, j.ID}, "/")
 }
@@ -317,16 +713,27 @@ func (s *Server) HandleServerPush(w http.ResponseWriter, r *http.Request) {
 	project := parts[2]
 	id := parts[3]
 
-	state, err := GetState(s.cfg.BuildPath, project, id)
-	if err != nil {
+	_, ok := s.authorize(w, r, project, RoleView)
+	if !ok {
+		return
+	}
+
+	j, err := s.index.Get(project, id)
+	if err == errJobNotFound {
+		http.Error(w, fmt.Sprintf("Job %s of project %s not found", id, project), http.StatusNotFound)
+		return
+	} else if err != nil {
 		s.Log.Print(err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	if s.proxyToAgent(w, r, j) {
+		return
+	}
 
 	// Decide whether to tail the log file and keep the connection alive for
 	// sending server side events.
-	if state != "pending" {
+	if j.State != "pending" {
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
@@ -342,7 +749,7 @@ func (s *Server) HandleServerPush(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Connection", "keep-alive")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
-	jPath := filepath.Join(s.cfg.BuildPath, project, state, id)
+	jPath := filepath.Join(s.cfg.BuildPath, project, j.State, id)
 	buildLogPath := filepath.Join(jPath, BuildLogFname)
 	client := &broker.Client{ID: id, Data: make(chan []byte), Extra: buildLogPath}
 	s.br.NewClients <- client
@@ -383,6 +790,36 @@ func (s *Server) ListenAndServe() error {
 	return s.srv.ListenAndServe()
 }
 
+// Shutdown gracefully shuts down the server. New jobs are rejected and
+// running builds are given grace time to complete, after which they are
+// interrupted. The HTTP server is closed after the results of the builds
+// are sent to their clients.
+//
+// Queued and interrupted jobs remain in the journal (see RequeueJobs).
+func (s *Server) Shutdown(grace time.Duration) error {
+	s.Log.Printf("Shutting down; waiting up to %s for running builds...", grace)
+	s.scheduler.Stop()
+	s.workerPool.Shutdown(grace, s.Log)
+
+	ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer cancel()
+	err := s.srv.Shutdown(ctx)
+	if err != nil {
+		// long-lived connections (eg. log streams) are not waited for
+		s.Log.Printf("Closing remaining connections; %s", err)
+		err = s.srv.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	err = s.journal.Close()
+	if err != nil {
+		return err
+	}
+	return s.index.Close()
+}
+
 type pruneResult struct {
 	prunedImages     int
 	prunedContainers int
@@ -428,7 +865,7 @@ func RebuildImages(cfg *Config, log *log.Logger, projects []string, stopErr, ver
 	for _, project := range projects {
 		start := time.Now()
 		log.Printf("Rebuilding %s...\n", project)
-		j, err := NewJob(project, types.Params{}, "", cfg)
+		j, err := NewJob(project, types.Params{}, nil, "", cfg)
 		if err != nil {
 			r.failed = append(r.failed, project)
 			if stopErr {
@@ -499,7 +936,8 @@ func dockerPruneUnused(ctx context.Context, c *docker.Client) (pruneResult, erro
 		reclaimedSpace:   ir.SpaceReclaimed + cr.SpaceReclaimed}, nil
 }
 
-// PruneZombieBuilds removes any pending builds from the filesystem.
+// PruneZombieBuilds removes any pending builds from the filesystem and the
+// build index.
 func PruneZombieBuilds(cfg *Config) error {
 	projects, err := getProjects(cfg)
 	if err != nil {
@@ -507,6 +945,12 @@ func PruneZombieBuilds(cfg *Config) error {
 	}
 	l := log.New(os.Stderr, "[cleanup] ", log.LstdFlags)
 
+	idx, err := OpenBuildIndex(cfg.BuildPath)
+	if err != nil {
+		return err
+	}
+	defer idx.Close()
+
 	for _, p := range projects {
 		pendingPath := filepath.Join(cfg.BuildPath, p, "pending")
 		pendingBuilds, err := ioutil.ReadDir(pendingPath)
@@ -524,7 +968,25 @@ func PruneZombieBuilds(cfg *Config) error {
 			l.Printf("Pruned zombie build '%s' of project '%s'", pending.Name(), p)
 		}
 	}
-	return nil
+
+	// no build is pending at this point, so any pending jobs left in the
+	// index are stale
+	for {
+		jobs, _, err := idx.List(JobFilter{State: "pending", Limit: MaxIndexLimit})
+		if err != nil {
+			return fmt.Errorf("Error listing pending builds of the index; %s", err)
+		}
+		if len(jobs) == 0 {
+			return nil
+		}
+
+		for _, j := range jobs {
+			err = idx.Delete(j.Project, j.ID)
+			if err != nil {
+				return fmt.Errorf("Error removing zombie build '%s' of project '%s' from the index; %s", j.ID, j.Project, err)
+			}
+		}
+	}
 }
 
 func getProjects(cfg *Config) ([]string, error) {
@@ -555,81 +1017,3 @@ func getProjects(cfg *Config) ([]string, error) {
 
 	return projects, nil
 }
-
-// getJobs returns all pending and ready jobs.
-func (s *Server) getJobs() ([]Job, error) {
-	var pendingJobs, readyJobs []os.FileInfo
-	jobs := []Job{}
-	projects := []string{}
-
-	// find projects
-	folders, err := ioutil.ReadDir(s.cfg.BuildPath)
-	if err != nil {
-		return nil, fmt.Errorf("cannot scan projects; %s", err)
-	}
-	for _, f := range folders {
-		if f.IsDir() {
-			projects = append(projects, f.Name())
-		}
-	}
-
-	for _, p := range projects {
-		pendingPath := filepath.Join(s.cfg.BuildPath, p, "pending")
-		_, err := os.Stat(pendingPath)
-		pendingExists := !os.IsNotExist(err)
-		if err != nil && !os.IsNotExist(err) {
-			return nil, fmt.Errorf("cannot check if pending path exists; %s", err)
-		}
-		readyPath := filepath.Join(s.cfg.BuildPath, p, "ready")
-		_, err = os.Stat(readyPath)
-		readyExists := !os.IsNotExist(err)
-		if err != nil && !os.IsNotExist(err) {
-			return nil, fmt.Errorf("cannot check if ready path exists; %s", err)
-		}
-
-		if pendingExists {
-			pendingJobs, err = ioutil.ReadDir(pendingPath)
-			if err != nil {
-				return nil, fmt.Errorf("cannot scan pending jobs of project %s; %s", p, err)
-			}
-		}
-		if readyExists {
-			readyJobs, err = ioutil.ReadDir(readyPath)
-			if err != nil {
-				return nil, fmt.Errorf("cannot scan ready jobs of project %s; %s", p, err)
-			}
-		}
-
-		getJob := func(path, jobID, project, state string) (Job, error) {
-			bi, err := ReadJobBuildInfo(filepath.Join(path, jobID), false)
-			if err != nil {
-				return Job{}, err
-			}
-
-			return Job{
-				ID:        jobID,
-				Project:   project,
-				StartedAt: bi.StartedAt,
-				State:     state,
-				BuildInfo: bi}, nil
-		}
-
-		for _, j := range pendingJobs {
-			job, err := getJob(pendingPath, j.Name(), p, "pending")
-			if err != nil {
-				return nil, fmt.Errorf("cannot find job %s; %s", j.Name(), err)
-			}
-			jobs = append(jobs, job)
-		}
-
-		for _, j := range readyJobs {
-			job, err := getJob(readyPath, j.Name(), p, "ready")
-			if err != nil {
-				return nil, fmt.Errorf("cannot find job %s; %s", j.Name(), err)
-			}
-			jobs = append(jobs, job)
-		}
-	}
-
-	return jobs, nil
-}
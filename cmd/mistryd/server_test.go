@@ -1,19 +1,27 @@
 package main
 
 import (
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"path"
+	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/skroutz/mistry/pkg/types"
+	"github.com/skroutz/mistry/pkg/utils"
 )
 
 func TestBootstrapProjectRace(t *testing.T) {
@@ -23,7 +31,7 @@ func TestBootstrapProjectRace(t *testing.T) {
 	var wg sync.WaitGroup
 
 	for i := 0; i < n; i++ {
-		j, err := NewJob(project, params, "", testcfg)
+		j, err := NewJob(project, params, nil, "", testcfg)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -122,13 +130,15 @@ func TestHandleShowJob(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	job := make([]Job, 0)
-	err = json.Unmarshal([]byte(body), &job)
+	page := struct {
+		Jobs []Job `json:"jobs"`
+	}{}
+	err = json.Unmarshal([]byte(body), &page)
 	if err != nil {
 		t.Fatal(err)
 	}
-	jobID := job[0].ID
-	project := job[0].Project
+	jobID := page.Jobs[0].ID
+	project := page.Jobs[0].Project
 
 	// Request the show page of the job selected from the index page.
 	showPath := path.Join("/job", project, jobID)
@@ -166,5 +176,368 @@ func TestNewJobAsync(t *testing.T) {
 		t.Errorf("Error in reading response body: %s", err)
 	}
 	assertEq(resp.StatusCode, 201, t)
-	assertEq(string(body), "", t)
+
+	st := types.JobStatus{}
+	err = json.Unmarshal(body, &st)
+	if err != nil {
+		t.Fatalf("cannot unmarshal %s; %s", body, err)
+	}
+	assertEq(st.Project, "simple", t)
+	assertEq(st.State, types.JobQueued, t)
+	assertEq(st.URL, path.Join("job", "simple", st.ID), t)
+}
+
+func TestNewJobInvalidPriority(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/jobs?async", strings.NewReader("{\"project\": \"simple\", \"priority\": 101}"))
+	server.srv.Handler.ServeHTTP(rec, req)
+	assertEq(rec.Code, 400, t)
+}
+
+func TestHandleJobStatus(t *testing.T) {
+	// a server without workers keeps its jobs queued
+	cfg := *testcfg
+	cfg.Concurrency = 0
+	s, err := NewServer(&cfg, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.workerPool.Stop()
+
+	j, err := NewJob("simple", types.Params{"test": "job-status"}, nil, "", &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.workerPool.SendWork(j)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	getStatus := func(project, id string) (int, types.JobStatus) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", path.Join("/jobs", project, id), nil)
+		s.srv.Handler.ServeHTTP(rec, req)
+
+		st := types.JobStatus{}
+		if rec.Code == http.StatusOK {
+			err := json.Unmarshal(rec.Body.Bytes(), &st)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rec.Code, st
+	}
+
+	code, st := getStatus(j.Project, j.ID)
+	assertEq(code, http.StatusOK, t)
+	assertEq(st.ID, j.ID, t)
+	assertEq(st.State, types.JobQueued, t)
+	assertEq(st.ExitCode, types.ContainerPendingExitCode, t)
+
+	// a finished build
+	readyPath := filepath.Join(cfg.BuildPath, "status-test", "ready", "abc")
+	err = os.MkdirAll(readyPath, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bi := types.NewBuildInfo()
+	bi.ExitCode = 3
+	biJSON, err := json.Marshal(bi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(readyPath, BuildInfoFname), biJSON, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.index.Put("status-test", "abc", "ready", bi)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, st = getStatus("status-test", "abc")
+	assertEq(code, http.StatusOK, t)
+	assertEq(st.State, types.JobFinished, t)
+	assertEq(st.ExitCode, 3, t)
+
+	code, _ = getStatus("status-test", "idontexist")
+	assertEq(code, http.StatusNotFound, t)
+}
+
+func TestCancelJob(t *testing.T) {
+	params := types.Params{"test": "cancel-job"}
+	j, err := NewJob("sleep", params, nil, "", testcfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = server.workerPool.SendWork(j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// give the chance for the container to start
+	time.Sleep(3 * time.Second)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("DELETE", path.Join("/jobs", j.Project, j.ID), nil)
+	server.srv.Handler.ServeHTTP(rec, req)
+	assertEq(rec.Result().StatusCode, http.StatusAccepted, t)
+
+	buildInfoPath := filepath.Join(j.ReadyBuildPath, BuildInfoFname)
+	err = waitUntilExists(buildInfoPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bi, err := ReadJobBuildInfo(j.ReadyBuildPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(bi.Cancelled, true, t)
+	assertNotEq(bi.ErrBuild, "", t)
+}
+
+func TestShowUnknownJob(t *testing.T) {
+	for _, p := range []string{"/job/simple/idontexist", "/log/simple/idontexist"} {
+		rec := httptest.NewRecorder()
+		server.srv.Handler.ServeHTTP(rec, httptest.NewRequest("GET", p, nil))
+		assertEq(rec.Result().StatusCode, http.StatusNotFound, t)
+	}
+}
+
+func TestCancelUnknownJob(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("DELETE", "/jobs/simple/idontexist", nil)
+	server.srv.Handler.ServeHTTP(rec, req)
+	assertEq(rec.Result().StatusCode, http.StatusNotFound, t)
+}
+
+func TestHandleArtifacts(t *testing.T) {
+	buildPath := filepath.Join(testcfg.BuildPath, "artifacts-test", "ready", "abc")
+	artifactsPath := filepath.Join(buildPath, DataDir, ArtifactsDir)
+	err := os.MkdirAll(filepath.Join(artifactsPath, "dir"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(artifactsPath, "dir", "out.txt"), []byte("artifact!"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.index.Put("artifacts-test", "abc", "ready", types.NewBuildInfo())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, encoding := range []string{"zstd", "gzip", ""} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/jobs/artifacts-test/abc/artifacts", nil)
+		req.Header.Set("Accept-Encoding", encoding)
+		server.srv.Handler.ServeHTTP(rec, req)
+		resp := rec.Result()
+
+		assertEq(resp.StatusCode, http.StatusOK, t)
+		assertEq(resp.Header.Get("Content-Encoding"), encoding, t)
+
+		var body io.Reader = resp.Body
+		switch encoding {
+		case "zstd":
+			body, err = zstd.NewReader(resp.Body)
+		case "gzip":
+			body, err = gzip.NewReader(resp.Body)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dst, err := ioutil.TempDir("", "mistry-test-artifacts-http")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dst)
+		err = utils.ExtractArchive(body, dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadFile(filepath.Join(dst, "dir", "out.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEq(string(out), "artifact!", t)
+	}
+
+	// resume a download
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/jobs/artifacts-test/abc/artifacts", nil)
+	req.Header.Set("Range", "bytes=10-")
+	server.srv.Handler.ServeHTTP(rec, req)
+	assertEq(rec.Result().StatusCode, http.StatusPartialContent, t)
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/jobs/artifacts-test/idontexist/artifacts", nil)
+	server.srv.Handler.ServeHTTP(rec, req)
+	assertEq(rec.Result().StatusCode, http.StatusNotFound, t)
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	cases := map[string]string{
+		"":                     "",
+		"gzip":                 "gzip",
+		"gzip, deflate, zstd":  "zstd",
+		"zstd;q=0, gzip;q=0.5": "gzip",
+		"identity":             "",
+		"br, GZIP":             "gzip",
+	}
+
+	for header, expected := range cases {
+		assertEq(negotiateEncoding(header), expected, t)
+	}
+}
+
+func TestHandleHealth(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/healthz", nil)
+	server.srv.Handler.ServeHTTP(rec, req)
+
+	report := HealthReport{}
+	err := json.Unmarshal(rec.Body.Bytes(), &report)
+	if err != nil {
+		t.Fatalf("cannot unmarshal %s; %s", rec.Body, err)
+	}
+
+	checks := make(map[string]HealthCheck)
+	for _, c := range report.Checks {
+		checks[c.Name] = c
+	}
+	assertEq(len(checks), 4, t)
+	for _, name := range []string{"build_path", "projects_path", "filesystem"} {
+		assertEq(checks[name].OK, true, t)
+	}
+
+	if report.OK {
+		assertEq(rec.Code, http.StatusOK, t)
+	} else {
+		assertEq(rec.Code, http.StatusServiceUnavailable, t)
+	}
+}
+
+func TestHandleReadyBacklog(t *testing.T) {
+	// a server without workers saturates as soon as its backlog is full
+	cfg := *testcfg
+	cfg.Concurrency = 0
+	cfg.Backlog = 1
+	s, err := NewServer(&cfg, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.workerPool.Stop()
+
+	backlogCheck := func() HealthCheck {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/readyz", nil)
+		s.srv.Handler.ServeHTTP(rec, req)
+
+		report := HealthReport{}
+		err := json.Unmarshal(rec.Body.Bytes(), &report)
+		if err != nil {
+			t.Fatalf("cannot unmarshal %s; %s", rec.Body, err)
+		}
+		return report.Checks[len(report.Checks)-1]
+	}
+
+	c := backlogCheck()
+	assertEq(c.Name, "backlog", t)
+	assertEq(c.OK, true, t)
+
+	j, err := NewJob("simple", types.Params{"test": "readiness"}, nil, "", &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.workerPool.SendWork(j)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c = backlogCheck()
+	assertEq(c.OK, false, t)
+	assertNotEq(c.Error, "", t)
+}
+
+func TestHandleReadyDrainShutdown(t *testing.T) {
+	s, cleanup := newAgentServer(t, 0, testcfg.ProjectsPath)
+	defer cleanup()
+
+	readyChecks := func() map[string]HealthCheck {
+		rec := httptest.NewRecorder()
+		s.srv.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+
+		report := HealthReport{}
+		err := json.Unmarshal(rec.Body.Bytes(), &report)
+		if err != nil {
+			t.Fatalf("cannot unmarshal %s; %s", rec.Body, err)
+		}
+		checks := make(map[string]HealthCheck)
+		for _, c := range report.Checks {
+			checks[c.Name] = c
+		}
+		return checks
+	}
+
+	checks := readyChecks()
+	assertEq(checks["drain"].OK, true, t)
+	assertEq(checks["shutdown"].OK, true, t)
+
+	// drains of projects don't affect readiness
+	failIfError(s.drains.Drain("simple", Drain{Since: time.Now()}), t)
+	assertEq(readyChecks()["drain"].OK, true, t)
+
+	failIfError(s.drains.Drain("", Drain{Reason: "upgrade", Since: time.Now()}), t)
+	assertEq(readyChecks()["drain"], HealthCheck{Name: "drain", Error: "server is drained: upgrade"}, t)
+
+	s.workerPool.Shutdown(time.Second, log.New(ioutil.Discard, "", 0))
+	assertEq(readyChecks()["shutdown"], HealthCheck{Name: "shutdown", Error: "server is shutting down"}, t)
+}
+
+func TestCachedCheck(t *testing.T) {
+	runs := 0
+	c := newCachedCheck(func(ctx context.Context) error {
+		runs++
+		return fmt.Errorf("run %d", runs)
+	}, 50*time.Millisecond)
+
+	assertEq(c.check(context.Background()).Error(), "run 1", t)
+	assertEq(c.check(context.Background()).Error(), "run 1", t)
+
+	time.Sleep(60 * time.Millisecond)
+	assertEq(c.check(context.Background()).Error(), "run 2", t)
+	assertEq(runs, 2, t)
+}
+
+func TestHandleNewJobBacklogFull(t *testing.T) {
+	cfg := *testcfg
+	cfg.Concurrency = 0
+	cfg.Backlog = 1
+	cfg.BacklogWait = Duration(100 * time.Millisecond)
+	s, err := NewServer(&cfg, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.workerPool.Stop()
+
+	newJob := func(test string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		body := `{"project": "simple", "params": {"test": "` + test + `"}}`
+		req := httptest.NewRequest("POST", "/jobs?async", strings.NewReader(body))
+		s.srv.Handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := newJob("backlog-full")
+	assertEq(rec.Code, http.StatusCreated, t)
+
+	start := time.Now()
+	rec = newJob("backlog-full2")
+	assertEq(rec.Code, http.StatusServiceUnavailable, t)
+	assert(time.Since(start) >= 100*time.Millisecond, true, t)
+
+	// there's no estimate of the drain rate yet
+	assertEq(rec.Header().Get("Retry-After"), "30", t)
 }
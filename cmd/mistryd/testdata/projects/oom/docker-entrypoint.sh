@@ -0,0 +1,5 @@
+#!/bin/bash
+set -e
+
+# buffers an endless line until it runs out of memory
+tail /dev/zero
@@ -0,0 +1,4 @@
+#!/bin/bash
+set -e
+
+echo -n "$GREETING $(cat params/name)" > artifacts/out.txt
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// workQueue is a bounded queue of work items, ordered by the priority of
+// their jobs. Items of the same priority are popped in the order they were
+// pushed.
+//
+// To prevent starvation, items age while they wait: an item that has been
+// queued for an aging period is considered to have a priority higher by one.
+// Since all items age at the same rate, their relative order never changes
+// after they're pushed. If the aging period is zero, items don't age.
+//
+// Items are also grouped by project, so that each project can be limited to
+// a number of queued and running items. Among items of the same (aged)
+// priority, projects are served in a weighted round-robin fashion, so that a
+// project with many queued items doesn't delay the rest.
+type workQueue struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	// projects contains the projects with queued or running items
+	projects map[string]*projectWork
+	limits   map[string]ProjectConfig
+
+	len    int
+	size   int
+	aging  time.Duration
+	closed bool
+
+	// pushed is the number of items ever pushed, used to break ties
+	pushed uint64
+
+	// pass is the pass of the project that was last served, used as the
+	// starting pass of projects that become active
+	pass float64
+
+	// retire is the number of Pop calls that should return false, so that
+	// the workers calling them exit
+	retire int
+
+	// freed is closed, and replaced, whenever room is made in the queue
+	freed chan struct{}
+}
+
+// projectWork contains the queued items of a project and tracks how much it
+// has been served.
+type projectWork struct {
+	items   workHeap
+	running int
+
+	// pass advances by the inverse of the project's weight every time
+	// one of its items is popped; the project with the lowest pass is
+	// served next (see stride scheduling)
+	pass float64
+}
+
+// queuedItem is a work item along with its position in the queue.
+type queuedItem struct {
+	wi *workItem
+
+	// rank is the time the item would have been pushed if it had the
+	// default priority; items with lower ranks are popped first
+	rank  time.Time
+	order uint64
+
+	enqueuedAt time.Time
+}
+
+// queueFullError is returned when an item cannot be pushed because the queue,
+// or the backlog of the item's project, is full.
+type queueFullError struct {
+	project string
+}
+
+func (e *queueFullError) Error() string {
+	if e.project != "" {
+		return fmt.Sprintf("backlog of project %s is full", e.project)
+	}
+	return "queue is full"
+}
+
+var errQueueClosed = errors.New("queue is closed")
+
+// newWorkQueue returns a queue that holds up to size items. limits contains
+// the concurrency, backlog and weight of projects; projects not found in it
+// are not limited and have a weight of 1.
+func newWorkQueue(size int, aging time.Duration, limits map[string]ProjectConfig) *workQueue {
+	q := &workQueue{
+		size:     size,
+		aging:    aging,
+		limits:   limits,
+		projects: make(map[string]*projectWork),
+		freed:    make(chan struct{}),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// Push adds wi to the queue. It returns a *queueFullError if the queue or the
+// backlog of the project of wi is full, or errQueueClosed if the queue is
+// closed.
+func (q *workQueue) Push(wi *workItem) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return errQueueClosed
+	}
+	if q.len >= q.size {
+		return &queueFullError{}
+	}
+
+	project := wi.job.Project
+	pw := q.projects[project]
+	if pw == nil {
+		pw = &projectWork{}
+		q.projects[project] = pw
+	}
+	if len(pw.items) == 0 && pw.pass < q.pass {
+		// projects don't accumulate credit while they're idle
+		pw.pass = q.pass
+	}
+	if backlog := q.limits[project].Backlog; backlog > 0 && len(pw.items) >= backlog {
+		return &queueFullError{project}
+	}
+
+	now := time.Now()
+	var rank time.Time
+	if q.aging > 0 {
+		rank = now.Add(-time.Duration(wi.job.Priority) * q.aging)
+	}
+	heap.Push(&pw.items, &queuedItem{wi: wi, rank: rank, order: q.pushed, enqueuedAt: now})
+	q.pushed++
+	q.len++
+	q.cond.Broadcast()
+	return nil
+}
+
+// Pop removes and returns the next item to be processed. It blocks until an
+// item is available and its project is below its maximum concurrency. Done
+// must be called once the item is processed.
+//
+// After the queue is closed, the remaining items are still returned. The
+// second value is false if the caller should stop popping items, ie. if the
+// queue is closed and empty or workers are being retired (see Retire).
+func (q *workQueue) Pop() (*queuedItem, bool) {
+	return q.pop(context.Background(), true)
+}
+
+// PopContext is like Pop, but meant for callers other than the workers of
+// the pool (ie. remote agents): it's not affected by Retire and it also
+// returns false if ctx is done before an item is available.
+func (q *workQueue) PopContext(ctx context.Context) (*queuedItem, bool) {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			q.mu.Lock()
+			q.cond.Broadcast()
+			q.mu.Unlock()
+		case <-stop:
+		}
+	}()
+
+	return q.pop(ctx, false)
+}
+
+func (q *workQueue) pop(ctx context.Context, worker bool) (*queuedItem, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		if worker && q.retire > 0 {
+			q.retire--
+			return nil, false
+		}
+		if ctx.Err() != nil {
+			return nil, false
+		}
+		if q.len == 0 && q.closed {
+			return nil, false
+		}
+
+		project, pw := q.next()
+		if pw != nil {
+			q.len--
+			q.notifyFreed()
+			return q.dispatch(project, pw), true
+		}
+
+		q.cond.Wait()
+	}
+}
+
+// dispatch removes and returns the next item of pw, the work of project,
+// accounting for it.
+func (q *workQueue) dispatch(project string, pw *projectWork) *queuedItem {
+	qi := heap.Pop(&pw.items).(*queuedItem)
+	pw.running++
+	q.pass = pw.pass
+	pw.pass += 1 / float64(q.weight(project))
+	return qi
+}
+
+// Remove removes wi from the queue, if it's still queued, making room for
+// another item. It returns false if wi is not queued.
+func (q *workQueue) Remove(wi *workItem) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	project := wi.job.Project
+	pw := q.projects[project]
+	if pw == nil {
+		return false
+	}
+	for i, qi := range pw.items {
+		if qi.wi == wi {
+			heap.Remove(&pw.items, i)
+			q.len--
+			if pw.running == 0 && len(pw.items) == 0 {
+				delete(q.projects, project)
+			}
+			q.notifyFreed()
+			q.cond.Broadcast()
+			return true
+		}
+	}
+	return false
+}
+
+// Freed returns a channel that is closed the next time room is made in the
+// queue, ie. when an item is popped or the queue grows. Callers waiting to
+// push an item should obtain it before trying, so that they don't miss any
+// room made in the meantime.
+func (q *workQueue) Freed() <-chan struct{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.freed
+}
+
+func (q *workQueue) notifyFreed() {
+	close(q.freed)
+	q.freed = make(chan struct{})
+}
+
+// Snapshot returns the queued items in the order they are expected to be
+// popped. Projects that are at their maximum concurrency are assumed to
+// be served once their running items are done.
+func (q *workQueue) Snapshot() []*queuedItem {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// simulate popping all items on a copy of q
+	sim := &workQueue{
+		aging:    q.aging,
+		limits:   q.limits,
+		pass:     q.pass,
+		projects: make(map[string]*projectWork),
+	}
+	for name, pw := range q.projects {
+		items := make(workHeap, len(pw.items))
+		copy(items, pw.items)
+		sim.projects[name] = &projectWork{items: items, running: pw.running, pass: pw.pass}
+	}
+
+	order := make([]*queuedItem, 0, q.len)
+	for len(order) < q.len {
+		project, pw := sim.next()
+		if pw == nil {
+			for _, pw := range sim.projects {
+				pw.running = 0
+			}
+			continue
+		}
+		order = append(order, sim.dispatch(project, pw))
+	}
+	return order
+}
+
+// next returns the project to be served next, or nil if no project may be
+// served right now. Projects whose next item has the highest priority are
+// preferred; among them, the one with the lowest pass is chosen.
+func (q *workQueue) next() (string, *projectWork) {
+	var (
+		best      *projectWork
+		bestName  string
+		bestLevel int
+	)
+
+	now := time.Now()
+	for name, pw := range q.projects {
+		if len(pw.items) == 0 {
+			continue
+		}
+		if max := q.limits[name].MaxConcurrency; max > 0 && pw.running >= max {
+			continue
+		}
+
+		level := q.level(pw.items[0], now)
+		if best == nil || level > bestLevel ||
+			(level == bestLevel && (pw.pass < best.pass ||
+				(pw.pass == best.pass && pw.items[0].order < best.items[0].order))) {
+			best, bestName, bestLevel = pw, name, level
+		}
+	}
+
+	return bestName, best
+}
+
+// level returns the priority of qi, as raised by the time it has waited.
+func (q *workQueue) level(qi *queuedItem, now time.Time) int {
+	level := qi.wi.job.Priority
+	if q.aging > 0 {
+		level += int(now.Sub(qi.enqueuedAt) / q.aging)
+	}
+	return level
+}
+
+func (q *workQueue) weight(project string) int {
+	if w := q.limits[project].Weight; w > 0 {
+		return w
+	}
+	return 1
+}
+
+// Done marks an item of project, previously returned by Pop, as processed.
+func (q *workQueue) Done(project string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	pw := q.projects[project]
+	if pw == nil {
+		return
+	}
+	pw.running--
+	if pw.running == 0 && len(pw.items) == 0 {
+		delete(q.projects, project)
+	}
+	q.cond.Broadcast()
+}
+
+// Retire makes the next n calls to Pop return false, waking up any pending
+// ones.
+func (q *workQueue) Retire(n int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.retire += n
+	q.cond.Broadcast()
+}
+
+// Unretire cancels up to n pending retirements and returns how many were
+// cancelled.
+func (q *workQueue) Unretire(n int) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if n > q.retire {
+		n = q.retire
+	}
+	q.retire -= n
+	return n
+}
+
+// Resize sets the maximum number of items in the queue to size. Items
+// already queued are kept, even if they exceed it.
+func (q *workQueue) Resize(size int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if size > q.size {
+		q.notifyFreed()
+	}
+	q.size = size
+}
+
+// Close prevents further items from being pushed and wakes up any pending
+// Pop calls, as well as any callers waiting for room.
+func (q *workQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.notifyFreed()
+	q.cond.Broadcast()
+}
+
+// Len returns the number of items in the queue.
+func (q *workQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.len
+}
+
+// workHeap implements heap.Interface.
+type workHeap []*queuedItem
+
+func (h workHeap) Len() int { return len(h) }
+
+func (h workHeap) Less(i, j int) bool {
+	if !h[i].rank.Equal(h[j].rank) {
+		return h[i].rank.Before(h[j].rank)
+	}
+	if h[i].wi.job.Priority != h[j].wi.job.Priority {
+		return h[i].wi.job.Priority > h[j].wi.job.Priority
+	}
+	return h[i].order < h[j].order
+}
+
+func (h workHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *workHeap) Push(x interface{}) { *h = append(*h, x.(*queuedItem)) }
+
+func (h *workHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return item
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func pushJob(q *workQueue, id string, priority int) error {
+	return pushProjectJob(q, "", id, priority)
+}
+
+func pushProjectJob(q *workQueue, project, id string, priority int) error {
+	return q.Push(&workItem{job: &Job{ID: id, Project: project, Priority: priority}})
+}
+
+func popJobs(q *workQueue, t *testing.T) []string {
+	ids := []string{}
+	for q.Len() > 0 {
+		qi, ok := q.Pop()
+		if !ok {
+			t.Fatal("Unexpectedly closed queue")
+		}
+		ids = append(ids, qi.wi.job.ID)
+	}
+	return ids
+}
+
+func TestWorkQueuePriority(t *testing.T) {
+	q := newWorkQueue(10, time.Hour, nil)
+
+	pushJob(q, "low", -1)
+	pushJob(q, "default", 0)
+	pushJob(q, "high", 5)
+	pushJob(q, "default2", 0)
+	pushJob(q, "high2", 5)
+
+	assertEq(popJobs(q, t), []string{"high", "high2", "default", "default2", "low"}, t)
+}
+
+func TestWorkQueueAging(t *testing.T) {
+	q := newWorkQueue(10, 10*time.Millisecond, nil)
+
+	pushJob(q, "low", 0)
+	time.Sleep(30 * time.Millisecond)
+	// "low" has aged beyond the priority of "high"
+	pushJob(q, "high", 1)
+	pushJob(q, "urgent", 10)
+
+	assertEq(popJobs(q, t), []string{"urgent", "low", "high"}, t)
+}
+
+func TestWorkQueueBounds(t *testing.T) {
+	q := newWorkQueue(1, time.Hour, nil)
+
+	assertEq(pushJob(q, "foo", 0), nil, t)
+	assertEq(pushJob(q, "bar", 0), &queueFullError{}, t)
+
+	q.Close()
+	assertEq(pushJob(q, "baz", 0), errQueueClosed, t)
+
+	// items pushed before closing are still returned
+	qi, ok := q.Pop()
+	assertEq(ok, true, t)
+	assertEq(qi.wi.job.ID, "foo", t)
+
+	_, ok = q.Pop()
+	assertEq(ok, false, t)
+}
+
+func TestWorkQueuePopBlocks(t *testing.T) {
+	q := newWorkQueue(1, time.Hour, nil)
+
+	popped := make(chan string)
+	go func() {
+		qi, ok := q.Pop()
+		if ok {
+			popped <- qi.wi.job.ID
+		}
+		close(popped)
+	}()
+
+	pushJob(q, "foo", 0)
+	select {
+	case id := <-popped:
+		assertEq(id, "foo", t)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Pop did not return after an item was pushed")
+	}
+}
+
+func TestWorkQueueFairShare(t *testing.T) {
+	q := newWorkQueue(20, time.Hour, map[string]ProjectConfig{"heavy": {Weight: 2}})
+
+	// "busy" filled the queue first
+	for _, id := range []string{"b1", "b2", "b3", "b4"} {
+		pushProjectJob(q, "busy", id, 0)
+	}
+	for _, id := range []string{"h1", "h2", "h3", "h4"} {
+		pushProjectJob(q, "heavy", id, 0)
+	}
+	pushProjectJob(q, "other", "o1", 0)
+	pushProjectJob(q, "busy", "urgent", 1)
+
+	ids := popJobs(q, t)
+	assertEq(ids[0], "urgent", t)
+
+	// all projects are served before "busy" gets a second turn, and
+	// "heavy" gets twice as many turns
+	count := map[byte]int{}
+	for _, id := range ids[1:5] {
+		count[id[0]]++
+	}
+	assertEq(count, map[byte]int{'b': 1, 'h': 2, 'o': 1}, t)
+}
+
+func TestWorkQueueProjectLimits(t *testing.T) {
+	q := newWorkQueue(10, time.Hour, map[string]ProjectConfig{"limited": {MaxConcurrency: 1, Backlog: 2}})
+
+	assertEq(pushProjectJob(q, "limited", "l1", 0), nil, t)
+	assertEq(pushProjectJob(q, "limited", "l2", 0), nil, t)
+	assertEq(pushProjectJob(q, "limited", "l3", 0), &queueFullError{"limited"}, t)
+	assertEq(pushProjectJob(q, "other", "o1", 0), nil, t)
+
+	qi, _ := q.Pop()
+	assertEq(qi.wi.job.ID, "l1", t)
+
+	// "limited" is at its maximum concurrency
+	qi, _ = q.Pop()
+	assertEq(qi.wi.job.ID, "o1", t)
+
+	popped := make(chan string)
+	go func() {
+		qi, _ := q.Pop()
+		popped <- qi.wi.job.ID
+	}()
+
+	select {
+	case id := <-popped:
+		t.Fatalf("Expected Pop to block, got %s", id)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	q.Done("limited")
+	select {
+	case id := <-popped:
+		assertEq(id, "l2", t)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Pop did not return after a running item was done")
+	}
+}
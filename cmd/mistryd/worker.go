@@ -20,76 +20,136 @@ import (
 
 // Work performs the work denoted by j and returns a BuildInfo upon
 // successful completion, or an error.
+//
+// Builds that fail due to infrastructure failures are retried, as determined
+// by the retry policy of the server.
 func (s *Server) Work(ctx context.Context, j *Job) (buildInfo *types.BuildInfo, err error) {
 	log := log.New(os.Stderr, fmt.Sprintf("[worker] [%s] ", j), log.LstdFlags)
-	start := time.Now()
 
-	buildInfo = types.NewBuildInfo()
+	buildInfo = s.newBuildInfo(j)
 	j.BuildInfo = buildInfo
-	j.BuildInfo.Path = filepath.Join(j.ReadyBuildPath, DataDir, ArtifactsDir)
-	j.BuildInfo.TransportMethod = types.Rsync
-	j.BuildInfo.Params = j.Params
-	j.BuildInfo.StartedAt = j.StartedAt
-	j.BuildInfo.URL = getJobURL(j)
-	j.BuildInfo.Group = j.Group
 
 	if s.metrics != nil {
 		s.metrics.RecordBuildStarted(j.Project)
 	}
 
 	// build coalescing
-	added := s.jq.Add(j)
-	if added {
-		defer s.jq.Delete(j)
-	} else {
-		t := time.NewTicker(2 * time.Second)
-		defer t.Stop()
+	for {
+		completion, added := s.jq.Add(j)
+		if added {
+			defer func() { s.jq.Complete(j, buildInfo, err) }()
+			break
+		}
+
 		log.Printf("Coalescing with %s...", j.PendingBuildPath)
-		for {
-			select {
-			case <-ctx.Done():
-				err = workErr("context cancelled while coalescing", nil)
-				return
-			case <-t.C:
-				_, err = os.Stat(j.ReadyBuildPath)
-				if err == nil {
-					i, err := ExitCode(j)
-					if err != nil {
-						return j.BuildInfo, err
-					}
-					j.BuildInfo.ExitCode = i
-					j.BuildInfo.Coalesced = true
-
-					if s.metrics != nil {
-						s.metrics.RecordBuildCoalesced(j.Project)
-					}
-
-					return j.BuildInfo, err
-				}
+		select {
+		case <-ctx.Done():
+			err = failErr(types.FailureCancelled, "context cancelled while coalescing", nil)
+			return
+		case <-completion.Done():
+		}
 
-				if os.IsNotExist(err) {
-					continue
-				} else {
-					err = workErr("could not coalesce", err)
-					return
-				}
-			}
+		// share the outcome of the original build, including the
+		// case that it was stopped, unless it was put back in the
+		// queue, in which case j is built instead
+		bi, cerr := completion.Result()
+		if cerr == errBuildRequeued {
+			continue
+		}
+		if bi != nil {
+			coalesced := *bi
+			j.BuildInfo = &coalesced
+		}
+		j.BuildInfo.Coalesced = true
+
+		if s.metrics != nil {
+			s.metrics.RecordBuildCoalesced(j.Project)
 		}
+
+		return j.BuildInfo, cerr
+	}
+
+	for attempt := 1; ; attempt++ {
+		buildInfo, err = s.build(ctx, j, attempt, log)
+
+		kind := types.FailureKindOf(err)
+		if ctx.Err() != nil || !s.cfg.Retry.Allows(kind, attempt) {
+			return
+		}
+
+		delay := s.cfg.Retry.Backoff(attempt)
+		log.Printf("Attempt %d failed (%s), retrying in %s: %s", attempt, kind, delay, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// readyBuild returns the build info of the successful build of j, if it was
+// already built by s or by one of its remote agents, or nil.
+func (s *Server) readyBuild(j *Job) *types.BuildInfo {
+	bi, err := ReadJobBuildInfo(j.ReadyBuildPath, true)
+	if err != nil {
+		indexed, err := s.index.Get(j.Project, j.ID)
+		if err != nil || indexed.State != "ready" || indexed.BuildInfo.AgentURL == "" {
+			return nil
+		}
+		bi = indexed.BuildInfo
+	}
+	if bi.ExitCode != types.ContainerSuccessExitCode {
+		return nil
+	}
+	bi.Cached = true
+	return bi
+}
+
+// newBuildInfo returns a BuildInfo for a new build of j.
+func (s *Server) newBuildInfo(j *Job) *types.BuildInfo {
+	bi := types.NewBuildInfo()
+	bi.Path = filepath.Join(j.ReadyBuildPath, DataDir, ArtifactsDir)
+	bi.TransportMethod = s.cfg.TransportMethod
+	bi.Params = j.Params
+	bi.Env = j.Env
+	bi.StartedAt = j.StartedAt
+	bi.URL = getJobURL(j)
+	bi.Group = j.Group
+	bi.RequestedBy = j.RequestedBy
+	bi.BuildNetworkMode = j.Network.Build
+	bi.RunNetworkMode = j.Network.Run
+	return bi
+}
+
+// build makes the given attempt at building j. A failed build of j from a
+// previous attempt, or a previous request, is removed first. Errors are
+// classified using types.ErrBuildFailure.
+func (s *Server) build(ctx context.Context, j *Job, attempt int, log *log.Logger) (buildInfo *types.BuildInfo, err error) {
+	start := time.Now()
+
+	if attempt > 1 {
+		j.BuildInfo = s.newBuildInfo(j)
 	}
+	j.BuildInfo.Attempts = attempt
+	buildInfo = j.BuildInfo
 
 	// build result cache
 	_, err = os.Stat(j.ReadyBuildPath)
 	if err == nil {
 		buildInfo, err := ReadJobBuildInfo(j.ReadyBuildPath, true)
 		if err != nil {
-			return nil, err
+			return nil, failErr(types.FailureFilesystem, "could not read existing build info", err)
 		} else if buildInfo.ExitCode != 0 {
 			// Previous build failed, remove its build dir to
 			// restart it. We know it's not pointed to by a
 			// latest link since we only symlink successful builds
 			err = s.cfg.FileSystem.Remove(j.ReadyBuildPath)
 			if err != nil {
-				return buildInfo, workErr("could not remove existing failed build", err)
+				return buildInfo, failErr(types.FailureFilesystem, "could not remove existing failed build", err)
+			}
+			err = s.index.Delete(j.Project, j.ID)
+			if err != nil {
+				return buildInfo, failErr(types.FailureFilesystem, "could not remove existing failed build from the index", err)
 			}
 		} else { // if a successful result already exists, use that
 			buildInfo.Cached = true
@@ -101,35 +161,53 @@ func (s *Server) Work(ctx context.Context, j *Job) (buildInfo *types.BuildInfo,
 			return buildInfo, err
 		}
 	} else if !os.IsNotExist(err) {
-		err = workErr("could not check for ready path", err)
+		err = failErr(types.FailureFilesystem, "could not check for ready path", err)
 		return
+	} else if remote := s.readyBuild(j); remote != nil {
+		// j was built by a remote agent
+		if s.metrics != nil {
+			s.metrics.RecordCacheUtilization(j.Project)
+		}
+		return remote, nil
+	}
+
+	if j.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, j.Timeout)
+		defer cancel()
 	}
 
 	_, err = os.Stat(filepath.Join(s.cfg.ProjectsPath, j.Project))
 	if err != nil {
 		if os.IsNotExist(err) {
-			err = workErr("Unknown project", nil)
+			err = failErr(types.FailureProject, "Unknown project", nil)
 			return
 		}
-		err = workErr("could not check for project", err)
+		err = failErr(types.FailureFilesystem, "could not check for project", err)
 		return
 	}
 
 	err = s.BootstrapProject(j)
 	if err != nil {
-		err = workErr("could not bootstrap project", err)
+		err = failErr(types.FailureFilesystem, "could not bootstrap project", err)
 		return
 	}
 
 	err = j.BootstrapBuildDir(s.cfg.FileSystem)
 	if err != nil {
-		err = workErr("could not bootstrap build dir", err)
+		err = failErr(types.FailureFilesystem, "could not bootstrap build dir", err)
 		return
 	}
 
 	err = persistBuildInfo(j)
 	if err != nil {
-		err = workErr("could not persist build info", err)
+		err = failErr(types.FailureFilesystem, "could not persist build info", err)
+		return
+	}
+
+	err = s.index.Put(j.Project, j.ID, "pending", j.BuildInfo)
+	if err != nil {
+		err = failErr(types.FailureFilesystem, "could not index pending build", err)
 		return
 	}
 
@@ -139,9 +217,19 @@ func (s *Server) Work(ctx context.Context, j *Job) (buildInfo *types.BuildInfo,
 		if rerr != nil {
 			errstr := "could not move pending path"
 			if err == nil {
-				err = fmt.Errorf("%s; %s", errstr, rerr)
+				err = failErr(types.FailureFilesystem, errstr, rerr)
 			} else {
-				err = fmt.Errorf("%s; %s | %s", errstr, rerr, err)
+				err = fmt.Errorf("%s; %s | %w", errstr, rerr, err)
+			}
+		} else {
+			ierr := s.index.Put(j.Project, j.ID, "ready", j.BuildInfo)
+			if ierr != nil {
+				errstr := "could not index ready build"
+				if err == nil {
+					err = failErr(types.FailureFilesystem, errstr, ierr)
+				} else {
+					err = fmt.Errorf("%s; %s | %w", errstr, ierr, err)
+				}
 			}
 		}
 
@@ -158,17 +246,24 @@ func (s *Server) Work(ctx context.Context, j *Job) (buildInfo *types.BuildInfo,
 			if err == nil {
 				err = os.Remove(j.LatestBuildPath)
 				if err != nil {
-					err = workErr("could not remove latest build link", err)
+					err = failErr(types.FailureFilesystem, "could not remove latest build link", err)
 					return
 				}
 			} else if !os.IsNotExist(err) {
-				err = workErr("could not stat the latest build link", err)
+				err = failErr(types.FailureFilesystem, "could not stat the latest build link", err)
 				return
 			}
 
 			err = os.Symlink(j.ReadyBuildPath, j.LatestBuildPath)
 			if err != nil {
-				err = workErr("could not create latest build link", err)
+				err = failErr(types.FailureFilesystem, "could not create latest build link", err)
+				return
+			}
+
+			// failing to prune older builds doesn't affect this one
+			perr := s.pruneBuilds(j)
+			if perr != nil {
+				log.Printf("Could not prune builds; %s", perr)
 			}
 		}
 	}()
@@ -176,13 +271,38 @@ func (s *Server) Work(ctx context.Context, j *Job) (buildInfo *types.BuildInfo,
 	// populate j.BuildInfo.Err and persist build_info file one last
 	// time
 	defer func() {
+		// the container is killed when the build is cancelled, times
+		// out or is interrupted, so a non-zero exit code is expected as
+		// well
+		if ctx.Err() != nil && (err != nil || j.BuildInfo.ExitCode != types.ContainerSuccessExitCode) {
+			if j.Interrupted() {
+				j.BuildInfo.Interrupted = true
+				err = failErr(types.FailureCancelled, "build was interrupted by server shutdown", err)
+				log.Println("Interrupted")
+			} else if ctx.Err() == context.DeadlineExceeded {
+				j.BuildInfo.TimedOut = true
+				err = failErr(types.FailureTimeout, fmt.Sprintf("build timed out after %s", j.Timeout), err)
+				log.Println("Timed out after", j.Timeout)
+			} else {
+				j.BuildInfo.Cancelled = true
+				err = failErr(types.FailureCancelled, "build was cancelled", err)
+				log.Println("Cancelled")
+			}
+		}
+
 		if err != nil {
 			j.BuildInfo.ErrBuild = err.Error()
+			j.BuildInfo.FailureKind = types.FailureKindOf(err)
+		} else if j.BuildInfo.ExitCode != types.ContainerSuccessExitCode {
+			j.BuildInfo.FailureKind = types.FailureExitCode
+			if j.BuildInfo.OOMKilled {
+				j.BuildInfo.FailureKind = types.FailureOOM
+			}
 		}
 
 		biErr := persistBuildInfo(j)
 		if biErr != nil {
-			err = workErr("could not persist build info", biErr)
+			err = failErr(types.FailureFilesystem, "could not persist build info", biErr)
 			return
 		}
 	}()
@@ -190,14 +310,20 @@ func (s *Server) Work(ctx context.Context, j *Job) (buildInfo *types.BuildInfo,
 	for k, v := range j.Params {
 		err = ioutil.WriteFile(filepath.Join(j.PendingBuildPath, DataDir, ParamsDir, k), []byte(v), 0644)
 		if err != nil {
-			err = workErr("could not write param file", err)
+			err = failErr(types.FailureFilesystem, "could not write param file", err)
 			return
 		}
 	}
 
+	secrets, err := s.cfg.ProjectSecrets(j.Project)
+	if err != nil {
+		err = failErr(types.FailureFilesystem, "could not read secrets", err)
+		return
+	}
+
 	out, err := os.Create(j.BuildLogPath)
 	if err != nil {
-		err = workErr("could not create build log file", err)
+		err = failErr(types.FailureFilesystem, "could not create build log file", err)
 		return
 	}
 	defer func() {
@@ -205,16 +331,20 @@ func (s *Server) Work(ctx context.Context, j *Job) (buildInfo *types.BuildInfo,
 		errstr := "could not close build log file"
 		if ferr != nil {
 			if err == nil {
-				err = fmt.Errorf("%s; %s", errstr, ferr)
+				err = failErr(types.FailureFilesystem, errstr, ferr)
 			} else {
-				err = fmt.Errorf("%s; %s | %s", errstr, ferr, err)
+				err = fmt.Errorf("%s; %s | %w", errstr, ferr, err)
 			}
 		}
 	}()
 
+	// the values of secrets must not end up in the logs
+	buildLog := newRedactor(out, secrets)
+	defer buildLog.Flush()
+
 	client, err := docker.NewEnvClient()
 	if err != nil {
-		err = workErr("could not create docker client", err)
+		err = failErr(types.FailureContainerStart, "could not create docker client", err)
 		return
 	}
 	defer func() {
@@ -222,35 +352,52 @@ func (s *Server) Work(ctx context.Context, j *Job) (buildInfo *types.BuildInfo,
 		errstr := "could not close docker client"
 		if derr != nil {
 			if err == nil {
-				err = fmt.Errorf("%s; %s", errstr, derr)
+				err = failErr(types.FailureContainerStart, errstr, derr)
 			} else {
-				err = fmt.Errorf("%s; %s | %s", errstr, derr, err)
+				err = fmt.Errorf("%s; %s | %w", errstr, derr, err)
 			}
 		}
 	}()
 
-	err = j.BuildImage(ctx, s.cfg.UID, client, out, j.Rebuild, j.Rebuild)
+	err = j.BuildImage(ctx, s.cfg.UID, client, buildLog, j.Rebuild, j.Rebuild)
 	if err != nil {
-		err = workErr("could not build docker image", err)
+		err = failErr(imageBuildFailure(err), "could not build docker image", err)
 		return
 	}
 
 	var outErr strings.Builder
-	j.BuildInfo.ExitCode, err = j.StartContainer(ctx, s.cfg, client, out, &outErr)
+	errLog := newRedactor(&outErr, secrets)
+	result, err := j.StartContainer(ctx, s.cfg, client, buildLog, errLog)
+	if err != nil {
+		err = failErr(types.FailureContainerStart, "could not start docker container", err)
+		return
+	}
+	j.BuildInfo.ExitCode = result.ExitCode
+	j.BuildInfo.OOMKilled = result.OOMKilled
+	if result.OOMKilled {
+		log.Printf("Container ran out of memory (limit: %s)", s.cfg.JobResources(j.Project, j.Settings).Memory)
+	}
+
+	err = buildLog.Flush()
 	if err != nil {
-		err = workErr("could not start docker container", err)
+		err = failErr(types.FailureFilesystem, "could not write the output log", err)
+		return
+	}
+	err = errLog.Flush()
+	if err != nil {
+		err = failErr(types.FailureFilesystem, "could not write the error output", err)
 		return
 	}
 
 	err = out.Sync()
 	if err != nil {
-		err = workErr("could not flush the output log", err)
+		err = failErr(types.FailureFilesystem, "could not flush the output log", err)
 		return
 	}
 
 	stdouterr, err := ReadJobLogs(j.PendingBuildPath)
 	if err != nil {
-		err = workErr("could not read the job logs", err)
+		err = failErr(types.FailureFilesystem, "could not read the job logs", err)
 		return
 	}
 
@@ -302,14 +449,10 @@ func (s *Server) BootstrapProject(j *Job) error {
 	return nil
 }
 
-// ExitCode returns the exit code of the job's container build.
-// If an error is returned, the exit code is irrelevant.
-func ExitCode(j *Job) (int, error) {
-	buildInfo, err := ReadJobBuildInfo(j.ReadyBuildPath, false)
-	if err != nil {
-		return types.ContainerPendingExitCode, err
-	}
-	return buildInfo.ExitCode, nil
+// failErr is like workErr, but classifies the error as a failure of the
+// given kind.
+func failErr(kind types.FailureKind, s string, e error) error {
+	return types.ErrBuildFailure{Kind: kind, Err: workErr(s, e)}
 }
 
 func workErr(s string, e error) error {
@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"log"
 	"sync"
+	"time"
 
+	"github.com/skroutz/mistry/cmd/mistryd/metrics"
 	"github.com/skroutz/mistry/pkg/types"
 )
 
@@ -38,20 +40,101 @@ func (f FutureWorkResult) Wait() WorkResult {
 type workItem struct {
 	job    *Job
 	result chan<- WorkResult
+
+	// ctx is passed to Server.Work and is cancelled if the job is
+	// cancelled by the user
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// running is true after a worker picks up the item
+	running bool
+
+	// startedAt is when a worker picked up the item
+	startedAt time.Time
+
+	// seq is the sequence number of the job in the journal
+	seq uint64
+
+	// agent is the name of the remote agent building the item, if any
+	agent string
+
+	// assignedAt is when the item was assigned to the agent; acked is
+	// true once the agent reports that it's building the item
+	assignedAt time.Time
+	acked      bool
 }
 
-// WorkerPool implements a fixed-size pool of workers that build jobs
-// build jobs and communicate their result
+// WorkerPool implements a pool of workers that build jobs and communicate
+// their result. The pool can be resized while it's running (see Resize).
 type WorkerPool struct {
-	// the fixed amount of goroutines that will be handling running jobs
+	// the amount of goroutines that will be handling running jobs.
+	// Guarded by mu.
 	concurrency int
 
 	// the maximum backlog of pending requests. if exceeded, sending new work
-	// to the pool will return an error
+	// to the pool will return an error. Guarded by mu.
 	backlogSize int
 
-	queue chan workItem
+	// workers is the number of worker goroutines alive, which may exceed
+	// concurrency while the pool is shrinking, and nextWorker is the ID of
+	// the next worker to be spawned. Guarded by mu.
+	workers    int
+	nextWorker int
+
+	// current contains the item each worker is currently processing, keyed
+	// by worker ID; idle workers map to nil. Guarded by mu.
+	current map[int]*workItem
+
+	// avgDuration is a moving average of the time workers spend on each
+	// item, used to estimate when queued jobs will start. Guarded by mu.
+	avgDuration time.Duration
+
+	// dispatches contains the times the latest items were picked up by
+	// workers, oldest first, used to estimate how fast the backlog
+	// drains. Guarded by mu.
+	dispatches []time.Time
+
+	// queue contains the work items waiting for a worker, ordered by
+	// priority
+	queue *workQueue
 	wg    sync.WaitGroup
+
+	// items contains the queued or running work items, keyed by job ID.
+	// Multiple work items may exist for the same job ID (ie. coalesced
+	// builds).
+	mu    sync.Mutex
+	items map[string][]*workItem
+
+	// closed is true after the pool is stopped; no more work is accepted
+	// after that. Guarded by mu.
+	closed bool
+
+	// agents contains the registered remote agents, keyed by name.
+	// Guarded by mu.
+	agents map[string]*agent
+
+	// records the jobs until they're built
+	journal *Journal
+
+	// may be nil, if metrics are disabled
+	metrics *metrics.Recorder
+
+	server *Server
+	logger *log.Logger
+}
+
+// PoolSize is the size of a WorkerPool, as reported and updated by the admin
+// endpoint.
+type PoolSize struct {
+	Concurrency int `json:"concurrency"`
+	Backlog     int `json:"backlog"`
+
+	// Workers is the number of workers alive, which may exceed Concurrency
+	// until busy workers finish their builds after the pool is shrunk
+	Workers int `json:"workers"`
+
+	// Queued is the number of jobs waiting for a worker
+	Queued int `json:"queued"`
 }
 
 // NewWorkerPool initializes and starts a new worker pool, waiting for incoming
@@ -60,54 +143,524 @@ func NewWorkerPool(s *Server, concurrency, backlog int, logger *log.Logger) *Wor
 	p := new(WorkerPool)
 	p.concurrency = concurrency
 	p.backlogSize = backlog
-	p.queue = make(chan workItem, backlog)
+	p.queue = newWorkQueue(backlog, time.Duration(s.cfg.PriorityAging), s.cfg.Projects)
+	p.items = make(map[string][]*workItem)
+	p.current = make(map[int]*workItem)
+	p.agents = make(map[string]*agent)
+	p.journal = s.journal
+	p.metrics = s.metrics
+	p.server = s
+	p.logger = logger
 
-	for i := 0; i < concurrency; i++ {
-		go work(s, i, p.queue, &p.wg)
-		p.wg.Add(1)
-	}
+	p.spawn(concurrency)
 	logger.Printf("Set up %d workers", concurrency)
+
+	go p.reapAgents()
 	return p
 }
 
-// Stop signals the workers to close and blocks until they are closed.
+// spawn starts n new workers. It must be called with mu held, unless p is
+// not yet shared.
+func (p *WorkerPool) spawn(n int) {
+	for i := 0; i < n; i++ {
+		p.wg.Add(1)
+		p.workers++
+		p.current[p.nextWorker] = nil
+		go work(p.server, p.nextWorker, p)
+		p.nextWorker++
+	}
+}
+
+// Resize changes the number of workers and the backlog size of p. When the
+// workers are reduced, idle workers exit immediately, while busy ones exit
+// after they finish their current build. When the backlog is reduced, jobs
+// already queued are kept, but no more jobs are accepted until the backlog
+// drains below the new size.
+func (p *WorkerPool) Resize(concurrency, backlog int) error {
+	if concurrency < 1 || backlog < 1 {
+		return fmt.Errorf("concurrency and backlog must be positive, got %d and %d", concurrency, backlog)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return errors.New("server is shutting down")
+	}
+
+	if delta := concurrency - p.concurrency; delta > 0 {
+		// workers that are about to exit are kept instead
+		delta -= p.queue.Unretire(delta)
+		p.spawn(delta)
+	} else if delta < 0 {
+		p.queue.Retire(-delta)
+	}
+	p.queue.Resize(backlog)
+
+	if concurrency != p.concurrency || backlog != p.backlogSize {
+		p.logger.Printf("Resized worker pool from %d workers and a backlog of %d to %d workers and a backlog of %d",
+			p.concurrency, p.backlogSize, concurrency, backlog)
+	}
+	p.concurrency = concurrency
+	p.backlogSize = backlog
+	return nil
+}
+
+// Size returns the current size of p.
+func (p *WorkerPool) Size() PoolSize {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return PoolSize{
+		Concurrency: p.concurrency,
+		Backlog:     p.backlogSize,
+		Workers:     p.workers,
+		Queued:      p.queue.Len(),
+	}
+}
+
+// Closed returns true if p is stopped or shutting down, ie. it doesn't
+// accept any more work.
+func (p *WorkerPool) Closed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.closed
+}
+
+// Stop signals the workers to close and blocks until they are closed. Jobs
+// being built by remote agents fail immediately.
 func (p *WorkerPool) Stop() {
-	close(p.queue)
+	p.mu.Lock()
+	p.closed = true
+	p.queue.Close()
+	p.mu.Unlock()
+
+	p.dropRemote(failErr(types.FailureCancelled, "server is shutting down", nil))
 	p.wg.Wait()
 }
 
+// Shutdown stops p from accepting new work and waits for the running jobs to
+// complete, for up to grace. Queued jobs are dropped and jobs still running
+// after grace are interrupted. Shutdown blocks until all workers exit.
+func (p *WorkerPool) Shutdown(grace time.Duration, logger *log.Logger) {
+	p.mu.Lock()
+	p.closed = true
+	p.queue.Close()
+	for _, items := range p.items {
+		for _, wi := range items {
+			if !wi.running {
+				wi.job.Interrupt()
+				wi.cancel()
+			}
+		}
+	}
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-time.After(grace):
+	}
+
+	p.mu.Lock()
+	for _, items := range p.items {
+		for _, wi := range items {
+			logger.Printf("Interrupting %s", wi.job)
+			wi.job.Interrupt()
+			wi.cancel()
+		}
+	}
+	p.mu.Unlock()
+
+	// remote agents are not waited for any longer
+	p.dropRemote(failErr(types.FailureCancelled, "build was interrupted by server shutdown", nil))
+
+	<-done
+}
+
 // SendWork schedules the work j on p and returns a FutureWorkResult.
 // The actual result can be obtained by calling FutureWorkResult.Wait().
 //
-// An error is returned if the work backlog is full.
+// j is recorded in the journal until its build completes. An error is
+// returned if the work backlog is full.
 func (p *WorkerPool) SendWork(j *Job) (FutureWorkResult, error) {
+	return p.send(context.Background(), j, false)
+}
+
+// SendWorkContext is like SendWork, but if the work backlog is full it waits
+// for room until ctx is done.
+func (p *WorkerPool) SendWorkContext(ctx context.Context, j *Job) (FutureWorkResult, error) {
+	return p.send(ctx, j, true)
+}
+
+func (p *WorkerPool) send(ctx context.Context, j *Job, wait bool) (FutureWorkResult, error) {
+	seq, err := p.journal.Append(j)
+	if err != nil {
+		return FutureWorkResult{}, fmt.Errorf("cannot record job in the journal; %s", err)
+	}
+
+	wi, result := newWorkItem(j, seq)
+	if wait {
+		err = p.pushWait(ctx, wi)
+	} else {
+		err = p.push(wi)
+	}
+	if err != nil {
+		wi.cancel()
+		jerr := p.journal.Delete(seq)
+		if jerr != nil {
+			err = fmt.Errorf("%s; cannot remove job from the journal; %s", err, jerr)
+		}
+		return result, err
+	}
+
+	return result, nil
+}
+
+// requeue schedules the work j, which is already recorded in the journal
+// with the given sequence number. Unlike SendWork, it waits for room in the
+// backlog. An error is returned if p is stopped in the meantime.
+func (p *WorkerPool) requeue(j *Job, seq uint64) error {
+	wi, _ := newWorkItem(j, seq)
+
+	err := p.pushWait(context.Background(), wi)
+	if err != nil {
+		wi.cancel()
+	}
+	return err
+}
+
+// pushWait is like push, but if the backlog is full it waits for room until
+// ctx is done, in which case the *queueFullError is returned.
+func (p *WorkerPool) pushWait(ctx context.Context, wi *workItem) error {
+	for {
+		freed := p.queue.Freed()
+
+		err := p.push(wi)
+		if _, full := err.(*queueFullError); !full {
+			return err
+		}
+
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// push adds wi to the queue of p. A *queueFullError is returned if the
+// backlog of p, or of the project of wi, is full.
+func (p *WorkerPool) push(wi *workItem) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return errors.New("server is shutting down")
+	}
+
+	err := p.queue.Push(wi)
+	if err != nil {
+		return err
+	}
+	p.items[wi.job.ID] = append(p.items[wi.job.ID], wi)
+	if p.metrics != nil {
+		p.metrics.RecordJobQueued(wi.job.Priority)
+	}
+	return nil
+}
+
+func newWorkItem(j *Job, seq uint64) (*workItem, FutureWorkResult) {
 	resultQueue := make(chan WorkResult, 1)
-	wi := workItem{j, resultQueue}
-	result := FutureWorkResult{resultQueue}
+	ctx, cancel := context.WithCancel(context.Background())
+	wi := &workItem{job: j, result: resultQueue, ctx: ctx, cancel: cancel, seq: seq}
+	return wi, FutureWorkResult{resultQueue}
+}
+
+// Cancel cancels all the work items of the job denoted by project and id,
+// either queued or running. Queued work items are dropped from the queue and
+// completed immediately. It returns false if no such work item exists.
+func (p *WorkerPool) Cancel(project, id string) bool {
+	p.mu.Lock()
+
+	items := p.items[id]
+	if len(items) == 0 || items[0].job.Project != project {
+		p.mu.Unlock()
+		return false
+	}
+
+	dropped := []*workItem{}
+	for _, wi := range items {
+		wi.cancel()
+		if !wi.running && p.queue.Remove(wi) {
+			dropped = append(dropped, wi)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, wi := range dropped {
+		p.drop(wi)
+	}
+	return true
+}
+
+// drop unregisters wi, which was removed from the queue before any worker
+// picked it up, and sends its result: a cancelled BuildInfo and the error
+// of droppedErr.
+func (p *WorkerPool) drop(wi *workItem) {
+	p.remove(wi)
+	if p.metrics != nil {
+		p.metrics.RecordJobDropped(wi.job.Priority)
+	}
+
+	jerr := p.journal.Delete(wi.seq)
+	if jerr != nil {
+		p.logger.Printf("Cannot remove %s from the journal; %s", wi.job, jerr)
+	}
+
+	err := droppedErr(wi)
+	bi := p.server.newBuildInfo(wi.job)
+	bi.Cancelled = true
+	bi.ErrBuild = err.Error()
+	bi.FailureKind = types.FailureCancelled
+	wi.job.BuildInfo = bi
+
+	wi.result <- WorkResult{bi, err}
+	close(wi.result)
+}
+
+// Status returns the status of the job denoted by project and id, if it is
+// queued or running in p. The second value is false if no such job exists.
+func (p *WorkerPool) Status(project, id string) (types.JobStatus, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	items := p.items[id]
+	if len(items) == 0 || items[0].job.Project != project {
+		return types.JobStatus{}, false
+	}
+
+	j := items[0].job
+	st := types.JobStatus{
+		ID:       j.ID,
+		Project:  j.Project,
+		Group:    j.Group,
+		State:    types.JobQueued,
+		ExitCode: types.ContainerPendingExitCode,
+		URL:      getJobURL(j),
+	}
+	for _, wi := range items {
+		if wi.running {
+			st.State = types.JobRunning
+		}
+	}
+	return st, true
+}
+
+// Saturated returns true if p cannot accept any more work, ie. all of its
+// workers are busy and its backlog is full.
+func (p *WorkerPool) Saturated() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	running := 0
+	for _, items := range p.items {
+		for _, wi := range items {
+			if wi.running {
+				running++
+			}
+		}
+	}
+	return running >= p.concurrency && p.queue.Len() >= p.backlogSize
+}
+
+// durationWeight is the weight of the latest item in avgDuration.
+const durationWeight = 0.2
+
+const (
+	// drainSamples is the number of dispatches used to estimate the
+	// rate at which the backlog drains
+	drainSamples = 20
+
+	// minRetryAfter and maxRetryAfter bound the delay suggested to clients
+	// whose jobs are rejected, and defaultRetryAfter is suggested when
+	// there is no estimate yet
+	minRetryAfter     = 1 * time.Second
+	maxRetryAfter     = 5 * time.Minute
+	defaultRetryAfter = 30 * time.Second
+)
+
+// RetryAfter estimates how long it takes for room to be made in the backlog
+// of p, based on the rate at which queued items were recently picked up by
+// workers or, if there were none, on the time workers spend on each item.
+func (p *WorkerPool) RetryAfter() time.Duration {
+	queued := p.queue.Len()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// the number of items that have to be picked up before there's room
+	excess := queued - p.backlogSize + 1
+	if excess < 1 {
+		excess = 1
+	}
+
+	// rate is in items per second; the time since the latest dispatch is
+	// taken into account, so that the rate drops while workers are stuck
+	var rate float64
+	if n := len(p.dispatches); n > 1 {
+		rate = float64(n-1) / time.Since(p.dispatches[0]).Seconds()
+	} else if p.avgDuration > 0 {
+		rate = float64(p.concurrency) / p.avgDuration.Seconds()
+	}
+	if rate <= 0 {
+		return defaultRetryAfter
+	}
+
+	d := time.Duration(float64(excess) / rate * float64(time.Second))
+	if d < minRetryAfter {
+		return minRetryAfter
+	}
+	if d > maxRetryAfter {
+		return maxRetryAfter
+	}
+	return d
+}
+
+// finish records that the worker denoted by id finished processing wi.
+func (p *WorkerPool) finish(id int, wi *workItem) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.current[id] = nil
+	p.recordDuration(time.Since(wi.startedAt))
+}
+
+// recordDuration accounts for an item that took d to process in avgDuration.
+// It must be called with mu held.
+func (p *WorkerPool) recordDuration(d time.Duration) {
+	if p.avgDuration == 0 {
+		p.avgDuration = d
+	} else {
+		p.avgDuration += time.Duration(durationWeight * float64(d-p.avgDuration))
+	}
+}
+
+// start marks wi as picked up by a worker or agent. It must be called with
+// mu held.
+func (p *WorkerPool) start(wi *workItem) {
+	wi.running = true
+	wi.startedAt = time.Now()
+	p.dispatches = append(p.dispatches, wi.startedAt)
+	if len(p.dispatches) > drainSamples {
+		p.dispatches = p.dispatches[1:]
+	}
+}
+
+// complete unregisters wi, which was processed by a worker or agent, and
+// sends its result.
+func (p *WorkerPool) complete(wi *workItem, buildInfo *types.BuildInfo, err error) {
+	wi.cancel()
+	p.remove(wi)
+	p.queue.Done(wi.job.Project)
+
+	// interrupted jobs are kept in the journal, to be re-enqueued
+	// when the server starts again
+	if !wi.job.Interrupted() {
+		jerr := p.journal.Delete(wi.seq)
+		if jerr != nil {
+			p.logger.Printf("Cannot remove %s from the journal; %s", wi.job, jerr)
+		}
+	}
 
 	select {
-	case p.queue <- wi:
-		return result, nil
+	case wi.result <- WorkResult{buildInfo, err}:
 	default:
-		return result, errors.New("queue is full")
+		// this should never happen, the result chan should be unique for this item
+		p.logger.Panicf("Failed to write result of %s to the result channel", wi.job)
+	}
+	close(wi.result)
+}
+
+// remove unregisters wi from the queued or running items of p.
+func (p *WorkerPool) remove(wi *workItem) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	items := p.items[wi.job.ID]
+	for i, item := range items {
+		if item == wi {
+			items = append(items[:i], items[i+1:]...)
+			break
+		}
+	}
+
+	if len(items) == 0 {
+		delete(p.items, wi.job.ID)
+	} else {
+		p.items[wi.job.ID] = items
 	}
 }
 
+// droppedErr returns the error of wi, which was cancelled while it was still
+// queued.
+func droppedErr(wi *workItem) error {
+	if wi.job.Interrupted() {
+		return failErr(types.FailureCancelled, "job was dropped since the server is shutting down", nil)
+	}
+	return failErr(types.FailureCancelled, "job was cancelled while queued", nil)
+}
+
 // work listens to the workQueue, runs Work() on any incoming work items, and
 // sends the result through the result queue
-func work(s *Server, id int, queue <-chan workItem, wg *sync.WaitGroup) {
-	defer wg.Done()
+func work(s *Server, id int, p *WorkerPool) {
+	defer p.wg.Done()
+	defer func() {
+		p.mu.Lock()
+		p.workers--
+		delete(p.current, id)
+		p.mu.Unlock()
+	}()
 	logPrefix := fmt.Sprintf("[worker %d]", id)
-	for item := range queue {
-		buildInfo, err := s.Work(context.Background(), item.job)
+	for {
+		qi, ok := p.queue.Pop()
+		if !ok {
+			break
+		}
+		item := qi.wi
 
-		select {
-		case item.result <- WorkResult{buildInfo, err}:
-		default:
-			// this should never happen, the result chan should be unique for this worker
-			s.Log.Panicf("%s failed to write result to the result channel", logPrefix)
+		var (
+			buildInfo *types.BuildInfo
+			err       error
+		)
+
+		if p.metrics != nil {
+			p.metrics.RecordJobDequeued(item.job.Priority, time.Since(qi.enqueuedAt))
+		}
+
+		p.mu.Lock()
+		p.start(item)
+		p.current[id] = item
+		p.mu.Unlock()
+
+		if item.ctx.Err() != nil {
+			err = droppedErr(item)
+		} else {
+			jerr := p.journal.MarkStarted(item.seq)
+			if jerr != nil {
+				s.Log.Printf("%s cannot mark %s as started in the journal; %s", logPrefix, item.job, jerr)
+			}
+			buildInfo, err = s.Work(item.ctx, item.job)
 		}
-		close(item.result)
+		p.finish(id, item)
+		p.complete(item, buildInfo, err)
 	}
 	s.Log.Printf("%s exiting...", logPrefix)
 }
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"context"
+	"io/ioutil"
+	"log"
 	"testing"
 	"time"
 
@@ -23,6 +26,104 @@ func TestBacklogLimit(t *testing.T) {
 	}
 }
 
+func TestCancelQueued(t *testing.T) {
+	wp, cfg := setupQueue(t, 0, 1)
+	defer wp.Stop()
+
+	project := "simple"
+	j, queued := sendWorkNoErr(wp, project, types.Params{"test": "pool-cancel-queued"}, cfg, t)
+	_, _, err := sendWork(wp, project, types.Params{"test": "pool-cancel-queued2"}, cfg, t)
+	assertEq(err, &queueFullError{}, t)
+
+	assertEq(wp.Cancel(project, j.ID), true, t)
+
+	// the job is completed without waiting for a worker
+	select {
+	case r := <-queued.result:
+		assertEq(r.BuildInfo.Cancelled, true, t)
+		assertEq(r.BuildInfo.FailureKind, types.FailureCancelled, t)
+		assertEq(types.FailureKindOf(r.Err), types.FailureCancelled, t)
+	case <-time.After(time.Second):
+		t.Fatal("Expected the cancelled job to complete")
+	}
+
+	_, ok := wp.Status(project, j.ID)
+	assertEq(ok, false, t)
+	assertEq(wp.Size().Queued, 0, t)
+
+	entries, err := wp.journal.Entries()
+	failIfError(err, t)
+	for _, e := range entries {
+		assertNotEq(e.ID, j.ID, t)
+	}
+
+	// its backlog slot is freed
+	sendWorkNoErr(wp, project, types.Params{"test": "pool-cancel-queued2"}, cfg, t)
+}
+
+func TestBacklogWait(t *testing.T) {
+	wp, cfg := setupQueue(t, 0, 1)
+	defer wp.Stop()
+
+	project := "simple"
+	sendWorkNoErr(wp, project, types.Params{"test": "pool-backlog-wait"}, cfg, t)
+
+	j, err := NewJob(project, types.Params{"test": "pool-backlog-wait2"}, nil, "", cfg)
+	failIfError(err, t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = wp.SendWorkContext(ctx, j)
+	assertEq(err, &queueFullError{}, t)
+
+	sent := make(chan error)
+	go func() {
+		_, err := wp.SendWorkContext(context.Background(), j)
+		sent <- err
+	}()
+
+	select {
+	case err := <-sent:
+		t.Fatalf("Expected SendWorkContext to wait, got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// make room in the backlog, as a worker would
+	_, ok := wp.queue.Pop()
+	assertEq(ok, true, t)
+
+	select {
+	case err := <-sent:
+		failIfError(err, t)
+	case <-time.After(5 * time.Second):
+		t.Fatal("SendWorkContext did not return after room was made")
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	wp, cfg := setupQueue(t, 0, 1)
+	defer wp.Stop()
+
+	// no estimate yet
+	assertEq(wp.RetryAfter(), defaultRetryAfter, t)
+
+	sendWorkNoErr(wp, "simple", types.Params{"test": "pool-retry-after"}, cfg, t)
+
+	// 4 items were picked up within the last 20 seconds
+	now := time.Now()
+	wp.mu.Lock()
+	wp.dispatches = []time.Time{now.Add(-20 * time.Second), now.Add(-15 * time.Second),
+		now.Add(-10 * time.Second), now.Add(-5 * time.Second)}
+	wp.mu.Unlock()
+	assert(wp.RetryAfter() >= 6*time.Second && wp.RetryAfter() <= 7*time.Second, true, t)
+
+	// workers are stuck, so the backlog drains slower
+	wp.mu.Lock()
+	wp.dispatches = []time.Time{now.Add(-time.Hour), now.Add(-time.Hour)}
+	wp.mu.Unlock()
+	assertEq(wp.RetryAfter(), maxRetryAfter, t)
+}
+
 func TestConcurrency(t *testing.T) {
 	// instatiate server with 1 worker
 	wp, cfg := setupQueue(t, 1, 100)
@@ -39,16 +140,72 @@ func TestConcurrency(t *testing.T) {
 	j, _ := sendWorkNoErr(wp, project, params2, cfg, t)
 
 	// the queue should contain only 1 item, the work item for the 2nd job
-	assertEq(len(wp.queue), 1, t)
-	select {
-	case i, ok := <-wp.queue:
-		if !ok {
-			t.Fatalf("Unexpectedly closed worker pool queue")
-		}
-		assertEq(i.job, j, t)
-	default:
-		t.Fatalf("Expected to find a work item in the queue")
+	if wp.queue.Len() != 1 {
+		t.Fatalf("Expected to find 1 work item in the queue, found %d", wp.queue.Len())
+	}
+	qi, ok := wp.queue.Pop()
+	if !ok {
+		t.Fatalf("Unexpectedly closed worker pool queue")
+	}
+	assertEq(qi.wi.job, j, t)
+}
+
+func TestResize(t *testing.T) {
+	wp, _ := setupQueue(t, 2, 10)
+	defer wp.Stop()
+
+	err := wp.Resize(4, 20)
+	failIfError(err, t)
+	assertEq(wp.Size(), PoolSize{Concurrency: 4, Backlog: 20, Workers: 4}, t)
+
+	// idle workers exit immediately
+	err = wp.Resize(1, 5)
+	failIfError(err, t)
+	for i := 0; i < 20 && wp.Size().Workers > 1; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	assertEq(wp.Size(), PoolSize{Concurrency: 1, Backlog: 5, Workers: 1}, t)
+
+	// grow again
+	err = wp.Resize(3, 5)
+	failIfError(err, t)
+	assertEq(wp.Size().Workers, 3, t)
+
+	err = wp.Resize(0, 5)
+	if err == nil {
+		t.Fatal("Expected error")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	wp, cfg := setupQueue(t, 1, 100)
+
+	project := "sleep"
+	j, running := sendWorkNoErr(wp, project, types.Params{"test": "pool-shutdown"}, cfg, t)
+	// give the chance for the worker to start work
+	time.Sleep(1 * time.Second)
+	_, queued := sendWorkNoErr(wp, project, types.Params{"test": "pool-shutdown2"}, cfg, t)
+
+	wp.Shutdown(1*time.Second, log.New(ioutil.Discard, "", 0))
+
+	_, _, err := sendWork(wp, project, types.Params{"test": "pool-shutdown3"}, cfg, t)
+	if err == nil {
+		t.Fatal("Expected error")
 	}
+
+	r := queued.Wait()
+	if r.Err == nil {
+		t.Fatal("Expected queued job to be dropped")
+	}
+
+	r = running.Wait()
+	if r.Err == nil {
+		t.Fatal("Expected running job to be interrupted")
+	}
+	bi, err := ReadJobBuildInfo(j.ReadyBuildPath, false)
+	failIfError(err, t)
+	assertEq(bi.Interrupted, true, t)
+	assertEq(bi.FailureKind, types.FailureCancelled, t)
 }
 
 func setupQueue(t *testing.T, workers, backlog int) (*WorkerPool, *Config) {
@@ -62,7 +219,7 @@ func setupQueue(t *testing.T, workers, backlog int) (*WorkerPool, *Config) {
 }
 
 func sendWork(wp *WorkerPool, project string, params types.Params, cfg *Config, t *testing.T) (*Job, FutureWorkResult, error) {
-	j, err := NewJob(project, params, "", cfg)
+	j, err := NewJob(project, params, nil, "", cfg)
 	failIfError(err, t)
 
 	r, err := wp.SendWork(j)
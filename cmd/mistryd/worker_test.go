@@ -1,9 +1,16 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/docker/docker/pkg/jsonmessage"
 	"github.com/skroutz/mistry/pkg/types"
 )
 
@@ -106,3 +113,96 @@ func TestBuildCacheWhenFailed(t *testing.T) {
 	}
 
 }
+
+func TestServerBuildTimeout(t *testing.T) {
+	jr := types.JobRequest{Project: "sleep", Params: types.Params{"test": "server-timeout"},
+		Timeout: 1 * time.Second}
+
+	_, err := postJob(jr)
+	if err == nil {
+		t.Fatal("expected timeout error")
+	}
+	if !strings.Contains(err.Error(), "build timed out after 1s") {
+		t.Fatalf("Expected '%s' to contain the timeout error", err)
+	}
+
+	j, err := NewJob(jr.Project, jr.Params, nil, jr.Group, testcfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bi, err := ReadJobBuildInfo(j.ReadyBuildPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEq(bi.TimedOut, true, t)
+	assertEq(bi.Cancelled, false, t)
+	assertEq(bi.FailureKind, types.FailureTimeout, t)
+	assertEq(bi.Attempts, 1, t)
+}
+
+func TestWorkRetriesInfrastructureFailures(t *testing.T) {
+	cfg := *testcfg
+	cfg.Concurrency = 0
+	cfg.Retry = RetryPolicy{MaxAttempts: 3, Delay: Duration(10 * time.Millisecond),
+		On: []types.FailureKind{types.FailureFilesystem}}
+	path, err := ioutil.TempDir("", "mistry-test-retry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+	cfg.BuildPath = path
+
+	s, err := NewServer(&cfg, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		s.workerPool.Stop()
+		s.index.Close()
+		s.journal.Close()
+	}()
+
+	// the build path of the project is not a directory
+	err = ioutil.WriteFile(filepath.Join(path, "simple"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := NewJob("simple", types.Params{"test": "retry"}, nil, "", &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bi, err := s.Work(context.Background(), j)
+	assertNotEq(err, nil, t)
+	assertEq(types.FailureKindOf(err), types.FailureFilesystem, t)
+	assertEq(bi.Attempts, 3, t)
+
+	// failures not covered by the policy are not retried
+	s.cfg.Retry.On = []types.FailureKind{types.FailureContainerStart}
+	bi, err = s.Work(context.Background(), j)
+	assertEq(types.FailureKindOf(err), types.FailureFilesystem, t)
+	assertEq(bi.Attempts, 1, t)
+}
+
+func TestImageBuildFailureKind(t *testing.T) {
+	err := types.ErrImageBuild{Image: "foo", Err: &jsonmessage.JSONError{Message: "step failed"}}
+	assertEq(imageBuildFailure(err), types.FailureDockerfile, t)
+
+	err = types.ErrImageBuild{Image: "foo", Err: errors.New("connection refused")}
+	assertEq(imageBuildFailure(err), types.FailureImageBuild, t)
+	assertEq(types.FailureImageBuild.Infrastructure(), true, t)
+	assertEq(types.FailureDockerfile.Infrastructure(), false, t)
+}
+
+func TestWorkUnknownProject(t *testing.T) {
+	j, err := NewJob("simple", types.Params{"test": "unknown-project"}, nil, "", testcfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Project = "nonexistent"
+
+	_, err = server.Work(context.Background(), j)
+	assertNotEq(err, nil, t)
+	assertEq(types.FailureKindOf(err), types.FailureProject, t)
+}
@@ -21,6 +21,10 @@ type BuildInfo struct {
 	// Group is the job group
 	Group string
 
+	// RequestedBy identifies who requested the build, if the server
+	// requires authentication.
+	RequestedBy string
+
 	// Path is the absolute path where the build artifacts are located.
 	Path string
 
@@ -35,6 +39,32 @@ type BuildInfo struct {
 	// used as the base for this build (ie. build cache).
 	Incremental bool
 
+	// Cancelled is true if the build was cancelled by the user before
+	// it completed.
+	Cancelled bool
+
+	// TimedOut is true if the build was stopped because it didn't
+	// complete within its timeout.
+	TimedOut bool
+
+	// Interrupted is true if the build was stopped because the server
+	// shut down before it completed.
+	Interrupted bool
+
+	// Env contains the environment variables the build was requested
+	// with.
+	Env map[string]string `json:",omitempty"`
+
+	// OOMKilled is true if the build container was killed because it
+	// exceeded its memory limit.
+	OOMKilled bool
+
+	// BuildNetworkMode and RunNetworkMode are the Docker network modes
+	// that the image was built and the build container was run with.
+	// Builds run with "none" had no network access.
+	BuildNetworkMode string
+	RunNetworkMode   string
+
 	// ExitCode is the exit code of the container command.
 	//
 	// It is initialized to ContainerFailureExitCode and is updated upon
@@ -45,10 +75,18 @@ type BuildInfo struct {
 	// It is irrelevant and should be ignored if Coalesced is true.
 	ExitCode int
 
+	// FailureKind classifies why the build failed. It is empty if the
+	// build was successful or its failure could not be classified.
+	FailureKind FailureKind
+
+	// Attempts is the number of times the build was attempted, which
+	// exceeds 1 if it was retried after infrastructure failures.
+	Attempts int
+
 	// ErrBuild contains any errors that occurred during the build.
 	//
-	// TODO: It might contain errors internal to the server, that the
-	// user can do nothing about. This should be fixed
+	// It might contain errors internal to the server, that the user can
+	// do nothing about; see FailureKind.
 	ErrBuild string
 
 	// ContainerStdouterr contains the stdout/stderr of the container.
@@ -72,6 +110,11 @@ type BuildInfo struct {
 
 	// URL is the relative URL at which the build log is available.
 	URL string
+
+	// AgentURL is the base URL of the remote agent that performed the
+	// build, if any. If set, URL and the build artifacts are relative to
+	// it, rather than to the server the build was requested from.
+	AgentURL string `json:",omitempty"`
 }
 
 // NewBuildInfo initializes a new BuildInfo with its StartedAt set to the
@@ -1,6 +1,9 @@
 package types
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
 
 // ErrImageBuild indicates an error occurred while building a Docker image.
 type ErrImageBuild struct {
@@ -11,3 +14,97 @@ type ErrImageBuild struct {
 func (e ErrImageBuild) Error() string {
 	return fmt.Sprintf("could not build docker image '%s': %s", e.Image, e.Err)
 }
+
+func (e ErrImageBuild) Unwrap() error {
+	return e.Err
+}
+
+// FailureKind classifies the cause of a failed build.
+type FailureKind string
+
+const (
+	// FailureImageBuild indicates that the Docker daemon failed to build
+	// the image of the project (eg. it was unreachable or the build was
+	// interrupted), as opposed to a step of its Dockerfile failing.
+	FailureImageBuild FailureKind = "image_build"
+
+	// FailureDockerfile indicates that a step of the project's Dockerfile
+	// failed.
+	FailureDockerfile FailureKind = "dockerfile"
+
+	// FailureProject indicates that the project of the build doesn't
+	// exist or its settings are invalid.
+	FailureProject FailureKind = "project"
+
+	// FailureAgent indicates that the remote agent building the job was
+	// lost or could not build it.
+	FailureAgent FailureKind = "agent"
+
+	// FailureContainerStart indicates that the build container could not
+	// be created, started or waited for.
+	FailureContainerStart FailureKind = "container_start"
+
+	// FailureFilesystem indicates that the build or its artifacts could not
+	// be set up or stored in the server's filesystem.
+	FailureFilesystem FailureKind = "filesystem"
+
+	// FailureExitCode indicates that the build command exited with a
+	// non-zero exit code.
+	FailureExitCode FailureKind = "exit_code"
+
+	// FailureOOM indicates that the build container was killed because
+	// it exceeded its memory limit.
+	FailureOOM FailureKind = "oom"
+
+	// FailureTimeout indicates that the build didn't complete within its
+	// timeout.
+	FailureTimeout FailureKind = "timeout"
+
+	// FailureCancelled indicates that the build was cancelled by the user
+	// or interrupted by the server shutting down.
+	FailureCancelled FailureKind = "cancelled"
+)
+
+// Infrastructure returns true if failures of kind k are caused by the
+// server's environment (eg. the Docker daemon or the filesystem), rather
+// than by the build itself.
+func (k FailureKind) Infrastructure() bool {
+	switch k {
+	case FailureImageBuild, FailureContainerStart, FailureFilesystem, FailureAgent:
+		return true
+	default:
+		return false
+	}
+}
+
+// ErrBuildFailure is an error that caused a build to fail, classified by
+// its Kind.
+type ErrBuildFailure struct {
+	Kind FailureKind
+	Err  error
+}
+
+func (e ErrBuildFailure) Error() string {
+	return e.Err.Error()
+}
+
+func (e ErrBuildFailure) Unwrap() error {
+	return e.Err
+}
+
+// FailureKindOf returns the kind of the first ErrBuildFailure or
+// ErrImageBuild found in the chain of err, or an empty FailureKind if
+// there is none.
+func FailureKindOf(err error) FailureKind {
+	var failure ErrBuildFailure
+	if errors.As(err, &failure) {
+		return failure.Kind
+	}
+
+	var imageErr ErrImageBuild
+	if errors.As(err, &imageErr) {
+		return FailureImageBuild
+	}
+
+	return ""
+}
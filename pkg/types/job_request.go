@@ -1,9 +1,32 @@
 package types
 
+import "time"
+
 // JobRequest contains the data the job was requested with
 type JobRequest struct {
 	Project string
 	Params  Params
 	Group   string
 	Rebuild bool
+
+	// Env contains environment variables of the build container. Like
+	// params, variables starting with "_" don't affect the ID of the job.
+	Env map[string]string `json:",omitempty"`
+
+	// Timeout is the maximum duration of the build. If zero, the
+	// project's or server's default is used.
+	Timeout time.Duration
+
+	// Priority determines the order in which queued jobs are built; jobs
+	// with higher priority are built first. It must be between
+	// MinPriority and MaxPriority.
+	Priority int
 }
+
+const (
+	// MinPriority is the lowest priority a job may have.
+	MinPriority = -100
+
+	// MaxPriority is the highest priority a job may have.
+	MaxPriority = 100
+)
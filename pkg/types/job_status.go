@@ -0,0 +1,36 @@
+package types
+
+// JobState is the state of a scheduled job.
+type JobState string
+
+const (
+	// JobQueued indicates that the job is waiting for a worker to pick
+	// it up.
+	JobQueued JobState = "queued"
+
+	// JobRunning indicates that the job is being built.
+	JobRunning JobState = "running"
+
+	// JobFinished indicates that the build of the job is complete,
+	// either successfully or not.
+	JobFinished JobState = "finished"
+)
+
+// JobStatus describes a scheduled job and its current state. It is returned
+// when scheduling jobs asynchronously and when querying the status of a job.
+type JobStatus struct {
+	ID      string
+	Project string
+	Group   string
+	State   JobState
+
+	// ExitCode is the exit code of the container command. It is set to
+	// ContainerPendingExitCode until the job is finished.
+	ExitCode int
+
+	// ErrBuild contains any errors that occurred during the build.
+	ErrBuild string `json:",omitempty"`
+
+	// URL is the relative URL at which the build log is available.
+	URL string
+}
@@ -13,4 +13,9 @@ const (
 
 	// Scp instructs the client to use scp(1) to download the assets.
 	Scp = "scp"
+
+	// HTTP instructs the client to download the assets as a tar archive
+	// from the server's HTTP API. It requires no SSH accounts or rsync
+	// daemon on the server.
+	HTTP = "http"
 )
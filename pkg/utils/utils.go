@@ -4,10 +4,12 @@ import (
 	"archive/tar"
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 )
 
 // PathIsDir returns an error if p does not exist or is not a directory.
@@ -115,3 +117,206 @@ func Tar(root string) ([]byte, error) {
 
 	return buf.Bytes(), nil
 }
+
+// ArchiveDir writes to w a tar archive of the contents of root. Contrary to
+// Tar, directories and symbolic links are preserved. The files are walked
+// in lexical order.
+func ArchiveDir(root string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	walkFn := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+		} else if !info.Mode().IsRegular() && !info.IsDir() {
+			return nil
+		}
+
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name, err = filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(hdr.Name)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+		return err
+	}
+
+	err := filepath.Walk(root, walkFn)
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// ExtractArchive extracts the tar archive read from r to the directory dst,
+// which should already exist. Entries that would be placed outside of dst,
+// or under a symlink, and symlinks pointing outside of dst result in an
+// error.
+func ExtractArchive(r io.Reader, dst string) error {
+	dst = filepath.Clean(dst)
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		path := filepath.Join(dst, hdr.Name)
+		if !isWithin(dst, path) {
+			return fmt.Errorf("invalid archive entry '%s'", hdr.Name)
+		}
+
+		// entries must not be written through symlinks, which may
+		// point anywhere
+		err = checkNoSymlinks(dst, filepath.Dir(path))
+		if err != nil {
+			return fmt.Errorf("invalid archive entry '%s'; %s", hdr.Name, err)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = checkNoSymlinks(dst, path)
+			if err != nil {
+				return fmt.Errorf("invalid archive entry '%s'; %s", hdr.Name, err)
+			}
+			err = os.MkdirAll(path, os.FileMode(hdr.Mode).Perm())
+		case tar.TypeSymlink:
+			if !isValidLink(dst, path, hdr.Linkname) {
+				return fmt.Errorf("invalid archive entry '%s'; symlink to '%s' points outside of %s",
+					hdr.Name, hdr.Linkname, dst)
+			}
+			err = os.RemoveAll(path)
+			if err == nil {
+				err = os.Symlink(hdr.Linkname, path)
+			}
+		case tar.TypeReg:
+			// replace symlinks instead of writing to their targets
+			fi, lerr := os.Lstat(path)
+			if lerr == nil && fi.Mode()&os.ModeSymlink != 0 {
+				err = os.Remove(path)
+			}
+			if err == nil {
+				err = extractFile(tr, path, os.FileMode(hdr.Mode).Perm())
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// isWithin returns true if path is dir or is under dir. Both paths must be
+// clean.
+func isWithin(dir, path string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(os.PathSeparator))
+}
+
+// checkNoSymlinks returns an error if path, or any of its parents up to dir,
+// is a symlink. path must be under dir.
+func checkNoSymlinks(dir, path string) error {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return err
+	}
+	if rel == "." {
+		return nil
+	}
+
+	cur := dir
+	for _, c := range strings.Split(rel, string(os.PathSeparator)) {
+		cur = filepath.Join(cur, c)
+		fi, err := os.Lstat(cur)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s is a symlink", cur)
+		}
+	}
+	return nil
+}
+
+// isValidLink returns true if a symlink at path, which is under dir, with
+// the given target resolves to a path under dir. Absolute targets are
+// rejected, as are targets with ".." after other components (eg. "a/../.."),
+// since the result would depend on whether these components are symlinks
+// themselves.
+func isValidLink(dir, path, target string) bool {
+	if target == "" || filepath.IsAbs(target) || strings.HasPrefix(target, "/") {
+		return false
+	}
+
+	leading := true
+	for _, c := range strings.Split(filepath.ToSlash(target), "/") {
+		switch c {
+		case "", ".":
+		case "..":
+			if !leading {
+				return false
+			}
+		default:
+			leading = false
+		}
+	}
+
+	return isWithin(dir, filepath.Join(filepath.Dir(path), target))
+}
+
+func extractFile(r io.Reader, path string, mode os.FileMode) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}